@@ -0,0 +1,109 @@
+package proto
+
+import (
+	"fmt"
+	"strings"
+
+	rt "github.com/arnodel/golua/runtime"
+	"google.golang.org/protobuf/proto"
+	pr "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// anyFullName is the full name of the google.protobuf.Any message.
+const anyFullName = pr.FullName("google.protobuf.Any")
+
+// init initializes the methods for google.protobuf.Any messages.
+func init() {
+	methods := make(map[string]rt.Value)
+	setMapFunc(methods, "Is", anyIs, 2, false, cpuIOMemTimeSafe)
+	setMapFunc(methods, "TypeName", anyTypeName, 1, false, cpuIOMemTimeSafe)
+	setMapFunc(methods, "Unpack", anyUnpack, 1, false, cpuIOTimeSafe)
+	msgTypeMethods[anyFullName] = methods
+}
+
+// anyFields returns the type URL and the value of the given Any message.
+func anyFields(rmsg pr.Message) (typeURL string, value []byte) {
+	fields := rmsg.Descriptor().Fields()
+	typeURL = rmsg.Get(fields.ByName("type_url")).String()
+	value = rmsg.Get(fields.ByName("value")).Bytes()
+	return
+}
+
+// anyIs checks whether an Any message contains a message of the given type.
+func anyIs(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	rmsg := readableUserData(t, ud)
+	typeURL, _ := anyFields(rmsg)
+	arg := c.Arg(1)
+	var name pr.FullName
+	if s, ok := arg.TryString(); ok {
+		mt, err := findMessageType(s)
+		if err != nil {
+			return nil, err
+		}
+		name = mt.Descriptor().FullName()
+	} else if ud, ok := arg.TryUserData(); ok {
+		md, err := userDataMessageDescriptor(ud)
+		if err != nil {
+			return nil, err
+		}
+		name = md.FullName()
+	} else {
+		return nil, fmt.Errorf("invalid argument type %s", arg.TypeName())
+	}
+	return pushingBool(t, c, typeURLToFullName(typeURL) == name)
+}
+
+// anyTypeName returns the full name of the message type contained in an
+// Any message.
+func anyTypeName(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	rmsg := readableUserData(t, ud)
+	typeURL, _ := anyFields(rmsg)
+	return pushingString(t, c, string(typeURLToFullName(typeURL)))
+}
+
+// anyUnpack returns the message contained in an Any message.
+// The message type is resolved via the global type registry.
+func anyUnpack(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	rmsg := readableUserData(t, ud)
+	typeURL, value := anyFields(rmsg)
+	if typeURL == "" {
+		return nil, fmt.Errorf("%s has no type URL", rmsg.Descriptor().FullName())
+	}
+	mt, err := findMessageType(typeURL)
+	if err != nil {
+		return nil, err
+	}
+	msg := mt.New().Interface()
+	if err = proto.Unmarshal(value, msg); err != nil {
+		return nil, err
+	}
+	return c.PushingNext1(t.Runtime, Wrap(msg)), nil
+}
+
+// protoPack packs a message into a new google.protobuf.Any message.
+func protoPack(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	if err := c.Check1Arg(); err != nil {
+		return nil, err
+	}
+	msg, ok := unwrapReadable(runtimeOptions(t.Runtime), c.Arg(0))
+	if !ok {
+		return nil, fmt.Errorf("expected message, got %s", c.Arg(0).TypeName())
+	}
+	packed, err := anypb.New(msg)
+	if err != nil {
+		return nil, err
+	}
+	return c.PushingNext1(t.Runtime, Wrap(packed)), nil
+}
+
+// typeURLToFullName returns the full message name from the given type URL.
+func typeURLToFullName(typeURL string) pr.FullName {
+	if i := strings.LastIndexByte(typeURL, '/'); i >= 0 {
+		return pr.FullName(typeURL[i+1:])
+	}
+	return pr.FullName(typeURL)
+}
@@ -0,0 +1,185 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	rt "github.com/arnodel/golua/runtime"
+)
+
+var (
+	// bytesTable is the metatable for bytes field values.
+	bytesTable *rt.Table
+
+	// bytesMethods are the methods for bytes field values.
+	bytesMethods map[string]rt.Value
+)
+
+// init initializes bytesTable and bytesMethods.
+func init() {
+	bytesTable = rt.NewTable()
+	bytesTable.Set(rt.StringValue("__name"), rt.StringValue("bytes"))
+	bytesMethods = make(map[string]rt.Value)
+	setMapFunc(bytesMethods, "Base64", bytesBase64, 1, false, cpuIOTimeSafe)
+	setMapFunc(bytesMethods, "Equal", bytesEqual, 2, false, cpuIOMemTimeSafe)
+	setMapFunc(bytesMethods, "Hex", bytesHex, 1, false, cpuIOTimeSafe)
+	setMapFunc(bytesMethods, "Len", bytesLen, 1, false, cpuIOMemTimeSafe)
+	setMapFunc(bytesMethods, "Sub", bytesSub, 3, false, cpuIOMemTimeSafe)
+	setMapFunc(bytesMethods, "ToString", bytesToString, 1, false, cpuIOTimeSafe)
+	setTableFunc("__concat", bytesConcat, 2, false, cpuIOTimeSafe, bytesTable)
+	setTableFunc("__eq", bytesEqual, 2, false, cpuIOMemTimeSafe, bytesTable)
+	setTableFunc("__index", bytesIndex, 2, false, cpuIOMemTimeSafe, bytesTable)
+	setTableFunc("__len", bytesLen, 1, false, cpuIOMemTimeSafe, bytesTable)
+	setTableFunc(
+		"__tostring", bytesToString, 1, false, cpuIOTimeSafe, bytesTable)
+}
+
+// bytesBase64 returns the standard base64 encoding of a bytes value.
+func bytesBase64(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	b := ud.Value().([]byte)
+	return pushingString(t, c, base64.StdEncoding.EncodeToString(b))
+}
+
+// bytesConcat implements the __concat metamethod for bytes values.
+// The result is a string.
+func bytesConcat(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	var s [2]string
+	for i := range s {
+		arg := c.Arg(i)
+		if b, ok := tryBytes(arg); ok {
+			s[i] = string(b)
+			continue
+		}
+		if _, ok := arg.TryBool(); ok {
+			return nil, fmt.Errorf("cannot concatenate a boolean value")
+		}
+		str, ok := arg.ToString()
+		if !ok {
+			return nil, fmt.Errorf(
+				"cannot concatenate a %s value", arg.CustomTypeName())
+		}
+		s[i] = str
+	}
+	return pushingString(t, c, s[0]+s[1])
+}
+
+// bytesEqual checks a bytes value for equality with another bytes value
+// or a string.
+func bytesEqual(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	lhs, ok := luaToBytes(c.Arg(0))
+	if !ok {
+		return pushingFalse(t, c)
+	}
+	rhs, ok := luaToBytes(c.Arg(1))
+	if !ok {
+		return pushingFalse(t, c)
+	}
+	return pushingBool(t, c, bytes.Equal(lhs, rhs))
+}
+
+// bytesHex returns the lowercase hexadecimal encoding of a bytes value.
+func bytesHex(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	return pushingString(t, c, hex.EncodeToString(ud.Value().([]byte)))
+}
+
+// bytesIndex implements the index operation for bytes values.
+// Only methods can be indexed.
+func bytesIndex(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	s, ok := c.Arg(1).TryString()
+	if !ok {
+		return c.Next(), nil
+	}
+	if ret, ok := bytesMethods[s]; ok {
+		return c.PushingNext1(t.Runtime, ret), nil
+	}
+	return c.Next(), nil
+}
+
+// bytesLen returns the length of a bytes value.
+func bytesLen(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	return pushingInt(t, c, len(ud.Value().([]byte)))
+}
+
+// bytesSub returns a slice of a bytes value without copying.
+// The indices are interpreted as in string.sub.
+func bytesSub(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	b := ud.Value().([]byte)
+	i, err := c.IntArg(1)
+	if err != nil {
+		return nil, err
+	}
+	j := int64(-1)
+	if c.NArgs() > 2 && !c.Arg(2).IsNil() {
+		if j, err = c.IntArg(2); err != nil {
+			return nil, err
+		}
+	}
+	n := int64(len(b))
+	if i < 0 {
+		i += n + 1
+	}
+	if i < 1 {
+		i = 1
+	}
+	if j < 0 {
+		j += n + 1
+	}
+	if j > n {
+		j = n
+	}
+	if i > j {
+		return c.PushingNext1(t.Runtime, wrapBytes(nil)), nil
+	}
+	return c.PushingNext1(t.Runtime, wrapBytes(b[i-1:j:j])), nil
+}
+
+// bytesToString converts a bytes value to a string.
+func bytesToString(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	return pushingString(t, c, string(ud.Value().([]byte)))
+}
+
+// luaToBytes converts a bytes value or a string to a byte slice.
+func luaToBytes(v rt.Value) ([]byte, bool) {
+	if b, ok := tryBytes(v); ok {
+		return b, true
+	}
+	if s, ok := v.TryString(); ok {
+		return []byte(s), true
+	}
+	return nil, false
+}
+
+// protoBytes creates a bytes value from a string.
+func protoBytes(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	if err := c.Check1Arg(); err != nil {
+		return nil, err
+	}
+	s, err := c.StringArg(0)
+	if err != nil {
+		return nil, err
+	}
+	return c.PushingNext1(t.Runtime, wrapBytes([]byte(s))), nil
+}
+
+// tryBytes returns the byte slice wrapped in v, if any.
+func tryBytes(v rt.Value) ([]byte, bool) {
+	ud, ok := v.TryUserData()
+	if !ok {
+		return nil, false
+	}
+	b, ok := ud.Value().([]byte)
+	return b, ok
+}
+
+// wrapBytes wraps the given byte slice as a Lua value.
+// The slice must not be modified afterwards.
+func wrapBytes(b []byte) rt.Value {
+	return rt.UserDataValue(rt.NewUserData(b, bytesTable))
+}
@@ -0,0 +1,204 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+
+	rt "github.com/arnodel/golua/runtime"
+	"google.golang.org/protobuf/proto"
+	pr "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Transport carries unary calls from Lua RPC clients to their servers.
+// Implementations may use gRPC, HTTP, an in-process Dispatcher, or fakes.
+type Transport interface {
+	// Invoke calls the method with the given full name, such as
+	// "pkg.Service.Method", with the request in the wire format, and returns
+	// the response in the wire format.
+	Invoke(method string, request []byte) ([]byte, error)
+}
+
+// TransportFunc is an adapter to use ordinary functions as Transport.
+type TransportFunc func(method string, request []byte) ([]byte, error)
+
+// Invoke implements Transport.
+func (f TransportFunc) Invoke(method string, request []byte) ([]byte, error) {
+	return f(method, request)
+}
+
+var (
+	// transportTable is the metatable for transport userdata values.
+	transportTable *rt.Table
+
+	// clientTable is the metatable for client userdata values.
+	clientTable *rt.Table
+)
+
+// client is an RPC client for a service.
+type client struct {
+	// service is the called service.
+	service pr.ServiceDescriptor
+
+	// transport carries the calls.
+	transport Transport
+
+	// methods caches the Lua functions calling the methods of service.
+	methods map[pr.Name]rt.Value
+}
+
+// init initializes transportTable and clientTable.
+func init() {
+	transportTable = rt.NewTable()
+	transportTable.Set(rt.StringValue("__name"), rt.StringValue("transport"))
+	clientTable = rt.NewTable()
+	clientTable.Set(rt.StringValue("__name"), rt.StringValue("client"))
+	setTableFunc("__index", clientIndex, 2, false, cpuIOMemTimeSafe, clientTable)
+}
+
+// WrapTransport returns the given transport as a Lua value, which can be
+// passed to proto.client.
+func WrapTransport(tr Transport) rt.Value {
+	return rt.UserDataValue(rt.NewUserData(tr, transportTable))
+}
+
+// protoClient creates an RPC client for a service, given by full name or
+// descriptor, calling the service over a transport.
+func protoClient(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	if err := c.CheckNArgs(2); err != nil {
+		return nil, err
+	}
+	var sd pr.ServiceDescriptor
+	if name, ok := c.Arg(0).TryString(); ok {
+		var err error
+		if sd, err = findService(name); err != nil {
+			return nil, err
+		}
+	} else if ud, ok := c.Arg(0).TryUserData(); ok {
+		if sd, ok = ud.Value().(pr.ServiceDescriptor); !ok {
+			return nil, fmt.Errorf("cannot create client from %T", ud.Value())
+		}
+	} else {
+		return nil, fmt.Errorf("invalid argument type %s", c.Arg(0).TypeName())
+	}
+	ud, err := c.UserDataArg(1)
+	if err != nil {
+		return nil, err
+	}
+	tr, ok := ud.Value().(Transport)
+	if !ok {
+		return nil, errors.New("transport expected")
+	}
+	cl := &client{
+		service:   sd,
+		transport: tr,
+		methods:   make(map[pr.Name]rt.Value),
+	}
+	return c.PushingNext1(t.Runtime,
+		rt.UserDataValue(rt.NewUserData(cl, clientTable))), nil
+}
+
+// clientIndex implements the index operation for clients.
+// Indexing a client with the name of a unary method of its service yields
+// a function calling that method.
+func clientIndex(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	cl := ud.Value().(*client)
+	name, ok := c.Arg(1).TryString()
+	if !ok {
+		return c.Next(), nil
+	}
+	md := cl.service.Methods().ByName(pr.Name(name))
+	if md == nil {
+		return c.Next(), nil
+	}
+	method, ok := cl.methods[md.Name()]
+	if !ok {
+		method = cl.newMethod(md)
+		cl.methods[md.Name()] = method
+	}
+	return c.PushingNext1(t.Runtime, method), nil
+}
+
+// newMethod returns a Lua function calling the method md. The function
+// takes the client and the request, which is a message or a table to
+// initialize a new message with, and returns the response message.
+// Calls involve I/O by the transport, so no compliance is declared.
+func (cl *client) newMethod(md pr.MethodDescriptor) rt.Value {
+	f := func(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+		if err := c.CheckNArgs(2); err != nil {
+			return nil, err
+		}
+		if md.IsStreamingClient() || md.IsStreamingServer() {
+			return nil, fmt.Errorf(
+				"%s is a streaming method, which clients do not support",
+				md.FullName())
+		}
+		var req proto.Message
+		if tbl, ok := c.Arg(1).TryTable(); ok {
+			var err error
+			if req, err = messageFromTable(t, md.Input(), tbl); err != nil {
+				return nil, fmt.Errorf("%s: bad request: %w", md.FullName(), err)
+			}
+		} else if req, ok = unwrapReadable(
+			runtimeOptions(t.Runtime), c.Arg(1)); !ok {
+			return nil, fmt.Errorf("message or table expected, got %s",
+				c.Arg(1).TypeName())
+		}
+		resp, err := cl.call(md, req)
+		if err != nil {
+			return nil, err
+		}
+		return c.PushingNext1(t.Runtime, Wrap(resp)), nil
+	}
+	return rt.FunctionValue(rt.NewGoFunction(f, string(md.Name()), 2, false))
+}
+
+// call calls the method md with the request req over the transport of cl.
+func (cl *client) call(
+	md pr.MethodDescriptor, req proto.Message,
+) (proto.Message, error) {
+	if err := checkMessageType(req, md.Input()); err != nil {
+		return nil, fmt.Errorf("%s: bad request: %w", md.FullName(), err)
+	}
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: bad request: %w", md.FullName(), err)
+	}
+	b, err = cl.transport.Invoke(string(md.FullName()), b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", md.FullName(), err)
+	}
+	resp := messageTypeOf(md.Output()).New().Interface()
+	if err = proto.Unmarshal(b, resp); err != nil {
+		return nil, fmt.Errorf("%s: bad response: %w", md.FullName(), err)
+	}
+	return resp, nil
+}
+
+// messageFromTable creates a message of type md and initializes its fields
+// from tbl, which maps field names to values. Nested tables initialize
+// singular message fields.
+func messageFromTable(
+	t *rt.Thread, md pr.MessageDescriptor, tbl *rt.Table,
+) (proto.Message, error) {
+	msg := messageTypeOf(md).New().Interface()
+	msgValue := Wrap(msg)
+	k, v, _ := tbl.Next(rt.NilValue)
+	for ; !k.IsNil(); k, v, _ = tbl.Next(k) {
+		if nested, ok := v.TryTable(); ok {
+			name, _ := k.TryString()
+			fd := md.Fields().ByName(pr.Name(name))
+			if fd != nil && fd.Message() != nil && !fd.IsList() && !fd.IsMap() {
+				sub, err := messageFromTable(t, fd.Message(), nested)
+				if err != nil {
+					return nil, fmt.Errorf("field '%s': %w", name, err)
+				}
+				v = Wrap(sub)
+			}
+		}
+		if err := rt.SetIndex(t, msgValue, k, v); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
@@ -0,0 +1,480 @@
+package proto
+
+import (
+	"errors"
+
+	rt "github.com/arnodel/golua/runtime"
+	"google.golang.org/protobuf/proto"
+	pr "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/runtime/protoiface"
+)
+
+// CopyOnWrite tracks a message wrapped with WrapCopyOnWrite.
+type CopyOnWrite struct {
+	// orig is the original message.
+	orig proto.Message
+
+	// copies maps messages viewed from Lua to their owned copies, which may
+	// be modified. Owned copies map to themselves.
+	copies map[proto.Message]pr.Message
+}
+
+// cowStep is a step from a message to a message contained in it.
+type cowStep struct {
+	// field is the field containing the next message.
+	field pr.FieldDescriptor
+
+	// index is the list index of the next message, if field is a list.
+	index int
+
+	// key is the map key of the next message, if field is a map.
+	key pr.MapKey
+}
+
+// cowMessage is a copy-on-write view of a message instance.
+type cowMessage struct {
+	// state is the copy-on-write state of the root message.
+	state *CopyOnWrite
+
+	// src is the viewed message instance. Once it is copied, the view shows
+	// the copy instead.
+	src pr.Message
+
+	// parent is the view of the message containing src, or nil if src is
+	// the root message.
+	parent *cowMessage
+
+	// step leads from the parent message to src.
+	step cowStep
+}
+
+// cowList is a copy-on-write view of a repeated field of a message.
+type cowList struct {
+	// parent is the message containing the list.
+	parent *cowMessage
+
+	// field is the repeated field.
+	field pr.FieldDescriptor
+}
+
+// cowMap is a copy-on-write view of a map field of a message.
+type cowMap struct {
+	// parent is the message containing the map.
+	parent *cowMessage
+
+	// field is the map field.
+	field pr.FieldDescriptor
+}
+
+// errDetached is returned when a message which is no longer part of its
+// copy-on-write root message is to be modified.
+var errDetached = errors.New(
+	"attempt to modify message removed from copy-on-write message")
+
+// WrapCopyOnWrite returns the given protobuf message as a Lua value.
+// Reads from Lua see msg, but the first write to a part of msg copies that
+// part and its ancestors, leaving msg itself unchanged. The returned
+// CopyOnWrite yields the resulting message.
+// Views of nested messages stay bound to the message they were obtained
+// from. Once such a message is replaced or removed from its parent, the view
+// can still be read, but writing to it is an error.
+func WrapCopyOnWrite(msg proto.Message) (rt.Value, *CopyOnWrite) {
+	state := &CopyOnWrite{
+		orig:   msg,
+		copies: make(map[proto.Message]pr.Message),
+	}
+	return Wrap(&cowMessage{state: state, src: msg.ProtoReflect()}), state
+}
+
+// Message returns the message as modified from Lua. If it was not modified,
+// the original message is returned. Otherwise, the result shares the
+// unmodified parts with the original message, so neither should be changed
+// afterwards without cloning.
+func (c *CopyOnWrite) Message() proto.Message {
+	return c.current(c.orig.ProtoReflect()).Interface()
+}
+
+// Modified reports whether the message was modified from Lua.
+func (c *CopyOnWrite) Modified() bool {
+	return len(c.copies) > 0
+}
+
+// current returns the owned copy of rmsg, if any, or else rmsg.
+func (c *CopyOnWrite) current(rmsg pr.Message) pr.Message {
+	if owned, ok := c.copies[rmsg.Interface()]; ok {
+		return owned
+	}
+	return rmsg
+}
+
+// own returns an owned copy of rmsg, copying it if necessary.
+func (c *CopyOnWrite) own(rmsg pr.Message) pr.Message {
+	if owned, ok := c.copies[rmsg.Interface()]; ok {
+		return owned
+	}
+	dst := rmsg.Type().New()
+	rmsg.Range(func(fd pr.FieldDescriptor, v pr.Value) bool {
+		switch {
+		case fd.IsList():
+			src, list := v.List(), dst.Mutable(fd).List()
+			for i := 0; i < src.Len(); i++ {
+				list.Append(src.Get(i))
+			}
+		case fd.IsMap():
+			m := dst.Mutable(fd).Map()
+			v.Map().Range(func(k pr.MapKey, v pr.Value) bool {
+				m.Set(k, v)
+				return true
+			})
+		default:
+			dst.Set(fd, v)
+		}
+		return true
+	})
+	if unknown := rmsg.GetUnknown(); len(unknown) > 0 {
+		dst.SetUnknown(append(pr.RawFields(nil), unknown...))
+	}
+	c.copies[rmsg.Interface()] = dst
+	c.copies[dst.Interface()] = dst
+	return dst
+}
+
+// child returns a copy-on-write view of the message src reached from m by
+// step.
+func (m *cowMessage) child(src pr.Message, step cowStep) *cowMessage {
+	return &cowMessage{
+		state:  m.state,
+		src:    src,
+		parent: m,
+		step:   step,
+	}
+}
+
+// resolve returns the message currently viewed by m.
+func (m *cowMessage) resolve() pr.Message {
+	return m.state.current(m.src)
+}
+
+// checkAttached checks that the message viewed by m is still part of the
+// root message.
+func (m *cowMessage) checkAttached() error {
+	if m.parent == nil {
+		return nil
+	}
+	if err := m.parent.checkAttached(); err != nil {
+		return err
+	}
+	v, ok := followStep(m.parent.resolve(), m.step)
+	if !ok || v.Message().Interface() != m.resolve().Interface() {
+		return errDetached
+	}
+	return nil
+}
+
+// checkWritable checks that rmsg may be written to from Lua.
+// Only detached copy-on-write views may not be written to.
+func checkWritable(rmsg pr.Message) error {
+	if m, ok := rmsg.(*cowMessage); ok {
+		return m.checkAttached()
+	}
+	return nil
+}
+
+// followStep follows step from rmsg and returns the message value reached.
+func followStep(rmsg pr.Message, step cowStep) (pr.Value, bool) {
+	fd := step.field
+	switch {
+	case fd.IsList():
+		list := rmsg.Get(fd).List()
+		if step.index >= list.Len() {
+			return pr.Value{}, false
+		}
+		return list.Get(step.index), true
+	case fd.IsMap():
+		m := rmsg.Get(fd).Map()
+		if !m.Has(step.key) {
+			return pr.Value{}, false
+		}
+		return m.Get(step.key), true
+	default:
+		return rmsg.Get(fd), true
+	}
+}
+
+// ensureOwned copies the message viewed by m and its ancestors as necessary,
+// and returns the owned message.
+// Writes from Lua are checked with checkWritable first. Should m be detached
+// anyway, a copy is returned which is not part of the root message.
+func (m *cowMessage) ensureOwned() pr.Message {
+	if m.checkAttached() != nil {
+		return proto.Clone(m.resolve().Interface()).ProtoReflect()
+	}
+	if m.parent == nil {
+		return m.state.own(m.src)
+	}
+	parent := m.parent.ensureOwned()
+	cur := m.resolve()
+	owned := m.state.own(cur)
+	if owned != cur {
+		setStep(parent, m.step, pr.ValueOfMessage(owned))
+	}
+	return owned
+}
+
+// setStep sets the message reached from the owned message rmsg by step.
+func setStep(rmsg pr.Message, step cowStep, v pr.Value) {
+	fd := step.field
+	switch {
+	case fd.IsList():
+		rmsg.Mutable(fd).List().Set(step.index, v)
+	case fd.IsMap():
+		rmsg.Mutable(fd).Map().Set(step.key, v)
+	default:
+		rmsg.Set(fd, v)
+	}
+}
+
+// wrapValue returns a copy-on-write view of the value v of the field fd
+// of m, if v is composite and set.
+func (m *cowMessage) wrapValue(fd pr.FieldDescriptor, v pr.Value) pr.Value {
+	switch {
+	case fd.IsList():
+		if v.List().Len() == 0 && !v.List().IsValid() {
+			return v
+		}
+		return pr.ValueOfList(&cowList{parent: m, field: fd})
+	case fd.IsMap():
+		if v.Map().Len() == 0 && !v.Map().IsValid() {
+			return v
+		}
+		return pr.ValueOfMap(&cowMap{parent: m, field: fd})
+	case fd.Kind() == pr.MessageKind || fd.Kind() == pr.GroupKind:
+		if !v.Message().IsValid() {
+			return v
+		}
+		return pr.ValueOfMessage(m.child(v.Message(), cowStep{field: fd}))
+	default:
+		return v
+	}
+}
+
+// ProtoReflect implements proto.Message.
+func (m *cowMessage) ProtoReflect() pr.Message {
+	return m
+}
+
+// Descriptor implements pr.Message.
+func (m *cowMessage) Descriptor() pr.MessageDescriptor {
+	return m.resolve().Descriptor()
+}
+
+// Type implements pr.Message.
+func (m *cowMessage) Type() pr.MessageType {
+	return m.resolve().Type()
+}
+
+// New implements pr.Message.
+func (m *cowMessage) New() pr.Message {
+	return m.resolve().New()
+}
+
+// Interface implements pr.Message.
+func (m *cowMessage) Interface() pr.ProtoMessage {
+	return m
+}
+
+// Range implements pr.Message.
+func (m *cowMessage) Range(f func(pr.FieldDescriptor, pr.Value) bool) {
+	m.resolve().Range(func(fd pr.FieldDescriptor, v pr.Value) bool {
+		return f(fd, m.wrapValue(fd, v))
+	})
+}
+
+// Has implements pr.Message.
+func (m *cowMessage) Has(fd pr.FieldDescriptor) bool {
+	return m.resolve().Has(fd)
+}
+
+// Clear implements pr.Message.
+func (m *cowMessage) Clear(fd pr.FieldDescriptor) {
+	if m.resolve().Has(fd) {
+		m.ensureOwned().Clear(fd)
+	}
+}
+
+// Get implements pr.Message.
+func (m *cowMessage) Get(fd pr.FieldDescriptor) pr.Value {
+	return m.wrapValue(fd, m.resolve().Get(fd))
+}
+
+// Set implements pr.Message.
+func (m *cowMessage) Set(fd pr.FieldDescriptor, v pr.Value) {
+	m.ensureOwned().Set(fd, v)
+}
+
+// Mutable implements pr.Message.
+func (m *cowMessage) Mutable(fd pr.FieldDescriptor) pr.Value {
+	return m.wrapValue(fd, m.ensureOwned().Mutable(fd))
+}
+
+// NewField implements pr.Message.
+func (m *cowMessage) NewField(fd pr.FieldDescriptor) pr.Value {
+	return m.resolve().NewField(fd)
+}
+
+// WhichOneof implements pr.Message.
+func (m *cowMessage) WhichOneof(od pr.OneofDescriptor) pr.FieldDescriptor {
+	return m.resolve().WhichOneof(od)
+}
+
+// GetUnknown implements pr.Message.
+func (m *cowMessage) GetUnknown() pr.RawFields {
+	return m.resolve().GetUnknown()
+}
+
+// SetUnknown implements pr.Message.
+func (m *cowMessage) SetUnknown(raw pr.RawFields) {
+	m.ensureOwned().SetUnknown(raw)
+}
+
+// IsValid implements pr.Message.
+func (m *cowMessage) IsValid() bool {
+	return m.resolve().IsValid()
+}
+
+// ProtoMethods implements pr.Message.
+// No fast-path methods are provided.
+func (m *cowMessage) ProtoMethods() *protoiface.Methods {
+	return nil
+}
+
+// resolve returns the list currently viewed by l.
+func (l *cowList) resolve() pr.List {
+	return l.parent.resolve().Get(l.field).List()
+}
+
+// owned returns the owned list viewed by l.
+func (l *cowList) owned() pr.List {
+	return l.parent.ensureOwned().Mutable(l.field).List()
+}
+
+// Len implements pr.List.
+func (l *cowList) Len() int {
+	return l.resolve().Len()
+}
+
+// Get implements pr.List.
+func (l *cowList) Get(i int) pr.Value {
+	v := l.resolve().Get(i)
+	if l.field.Kind() != pr.MessageKind && l.field.Kind() != pr.GroupKind {
+		return v
+	}
+	step := cowStep{field: l.field, index: i}
+	return pr.ValueOfMessage(l.parent.child(v.Message(), step))
+}
+
+// Set implements pr.List.
+func (l *cowList) Set(i int, v pr.Value) {
+	l.owned().Set(i, v)
+}
+
+// Append implements pr.List.
+func (l *cowList) Append(v pr.Value) {
+	l.owned().Append(v)
+}
+
+// AppendMutable implements pr.List.
+func (l *cowList) AppendMutable() pr.Value {
+	list := l.owned()
+	list.AppendMutable()
+	return l.Get(list.Len() - 1)
+}
+
+// Truncate implements pr.List.
+func (l *cowList) Truncate(n int) {
+	l.owned().Truncate(n)
+}
+
+// NewElement implements pr.List.
+func (l *cowList) NewElement() pr.Value {
+	return l.resolve().NewElement()
+}
+
+// IsValid implements pr.List.
+func (l *cowList) IsValid() bool {
+	return true
+}
+
+// resolve returns the map currently viewed by m.
+func (m *cowMap) resolve() pr.Map {
+	return m.parent.resolve().Get(m.field).Map()
+}
+
+// owned returns the owned map viewed by m.
+func (m *cowMap) owned() pr.Map {
+	return m.parent.ensureOwned().Mutable(m.field).Map()
+}
+
+// wrapValue returns a copy-on-write view of the value of key k, if it is
+// a message.
+func (m *cowMap) wrapValue(k pr.MapKey, v pr.Value) pr.Value {
+	if m.field.MapValue().Kind() != pr.MessageKind {
+		return v
+	}
+	step := cowStep{field: m.field, key: k}
+	return pr.ValueOfMessage(m.parent.child(v.Message(), step))
+}
+
+// Len implements pr.Map.
+func (m *cowMap) Len() int {
+	return m.resolve().Len()
+}
+
+// Range implements pr.Map.
+func (m *cowMap) Range(f func(pr.MapKey, pr.Value) bool) {
+	m.resolve().Range(func(k pr.MapKey, v pr.Value) bool {
+		return f(k, m.wrapValue(k, v))
+	})
+}
+
+// Has implements pr.Map.
+func (m *cowMap) Has(k pr.MapKey) bool {
+	return m.resolve().Has(k)
+}
+
+// Clear implements pr.Map.
+func (m *cowMap) Clear(k pr.MapKey) {
+	if m.resolve().Has(k) {
+		m.owned().Clear(k)
+	}
+}
+
+// Get implements pr.Map.
+func (m *cowMap) Get(k pr.MapKey) pr.Value {
+	v := m.resolve().Get(k)
+	if !v.IsValid() {
+		return v
+	}
+	return m.wrapValue(k, v)
+}
+
+// Set implements pr.Map.
+func (m *cowMap) Set(k pr.MapKey, v pr.Value) {
+	m.owned().Set(k, v)
+}
+
+// Mutable implements pr.Map.
+func (m *cowMap) Mutable(k pr.MapKey) pr.Value {
+	m.owned().Mutable(k)
+	return m.wrapValue(k, m.resolve().Get(k))
+}
+
+// NewValue implements pr.Map.
+func (m *cowMap) NewValue() pr.Value {
+	return m.resolve().NewValue()
+}
+
+// IsValid implements pr.Map.
+func (m *cowMap) IsValid() bool {
+	return true
+}
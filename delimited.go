@@ -0,0 +1,302 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"unsafe"
+
+	rt "github.com/arnodel/golua/runtime"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	pr "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// defaultMaxDelimitedSize is the maximum size of a length-delimited message
+// in runtimes without memory quota. It matches the default of protodelim.
+const defaultMaxDelimitedSize = 4 << 20
+
+// messageOverhead is a rough estimate of the memory allocated for a decoded
+// message in addition to its field values.
+const messageOverhead = 128
+
+// valueSize is the memory needed for a field value, list element, map key or
+// map value in a decoded message, in addition to the wire size of its
+// contents.
+const valueSize = uint64(unsafe.Sizeof(pr.Value{}))
+
+// delimitedReader reads length-delimited messages from a string or from a
+// Lua object with a read method, such as a file handle.
+type delimitedReader struct {
+	// mt is the type of the read messages.
+	mt pr.MessageType
+
+	// data is the source string, if the source is a string.
+	data string
+
+	// source is the source object, if the source is not a string.
+	source rt.Value
+}
+
+// init initializes the delimited encoding methods of messages.
+func init() {
+	setMapFunc(msgMethods, "MarshalDelimited", msgMarshalDelimited, 1, false,
+		cpuIOTimeSafe)
+}
+
+// maxDelimitedSize returns the maximum size of a length-delimited message
+// read in r. If r has a memory quota, the size is limited to the unused
+// memory.
+func maxDelimitedSize(r *rt.Runtime) uint64 {
+	limit := uint64(defaultMaxDelimitedSize)
+	if r.HardLimits().Memory > 0 && r.UnusedMem() < limit {
+		limit = r.UnusedMem()
+	}
+	return limit
+}
+
+// messageTypeArg returns the message type given by v, which is a full name,
+// a message type, or a message descriptor.
+func messageTypeArg(v rt.Value) (pr.MessageType, error) {
+	if s, ok := v.TryString(); ok {
+		return findMessageType(s)
+	}
+	if ud, ok := v.TryUserData(); ok {
+		switch x := ud.Value().(type) {
+		case pr.MessageType:
+			return x, nil
+		case pr.MessageDescriptor:
+			return messageTypeOf(x), nil
+		}
+	}
+	return nil, fmt.Errorf("message type expected, got %s", v.TypeName())
+}
+
+// msgMarshalDelimited marshals a protobuf message to wire-format encoding
+// prefixed with its length as varint.
+func msgMarshalDelimited(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	buf, err := marshalDelimited(nil, readableUserData(t, ud).Interface())
+	if err != nil {
+		return nil, err
+	}
+	return pushingString(t, c, string(buf))
+}
+
+// marshalDelimited appends the length-delimited encoding of msg to buf.
+func marshalDelimited(buf []byte, msg proto.Message) ([]byte, error) {
+	opts := proto.MarshalOptions{}
+	buf = protowire.AppendVarint(buf, uint64(opts.Size(msg)))
+	return opts.MarshalAppend(buf, msg)
+}
+
+// protoReadDelimited returns an iterator over the length-delimited messages
+// of the given type read from a string or from an object with a read
+// method, such as a file handle. The iterator returns nil after the last
+// message. The memory needed for the decoded messages is estimated and
+// accounted for, so the iterator can be used under a memory quota.
+func protoReadDelimited(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	if err := c.CheckNArgs(2); err != nil {
+		return nil, err
+	}
+	mt, err := messageTypeArg(c.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+	r := &delimitedReader{mt: mt}
+	if s, ok := c.Arg(1).TryString(); ok {
+		r.data = s
+	} else {
+		r.source = c.Arg(1)
+	}
+	iteratorFunction := rt.NewGoFunction(
+		func(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+			msg, err := r.next(t)
+			if err != nil {
+				return nil, err
+			}
+			if msg == nil {
+				return c.PushingNext1(t.Runtime, rt.NilValue), nil
+			}
+			return c.PushingNext1(t.Runtime, Wrap(msg)), nil
+		}, "iterator", 2, false)
+	rt.SolemnlyDeclareCompliance(cpuIOMemTimeSafe, iteratorFunction)
+	return c.PushingNext1(t.Runtime, rt.FunctionValue(iteratorFunction)), nil
+}
+
+// next reads the next message, or returns nil at the end of the source.
+func (r *delimitedReader) next(t *rt.Thread) (proto.Message, error) {
+	size, ok, err := r.readSize(t)
+	if err != nil || !ok {
+		return nil, err
+	}
+	if limit := maxDelimitedSize(t.Runtime); size > limit {
+		return nil, fmt.Errorf(
+			"message size %d exceeds maximum size %d", size, limit)
+	}
+	t.Runtime.RequireBytes(int(size))
+	msg, err := r.decode(t, size)
+	t.Runtime.ReleaseMem(size)
+	if err != nil {
+		return nil, err
+	}
+	t.Runtime.RequireMem(size + decodedOverhead(msg.ProtoReflect()))
+	return msg, nil
+}
+
+// decode reads and decodes a message of the given size.
+func (r *delimitedReader) decode(
+	t *rt.Thread, size uint64,
+) (proto.Message, error) {
+	buf, err := r.read(t, int(size))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(buf)) < size {
+		return nil, errors.New("unexpected end of delimited message stream")
+	}
+	msg := r.mt.New().Interface()
+	if err = proto.Unmarshal(buf, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// decodedOverhead estimates the memory needed for the decoded message rmsg
+// in addition to its wire size.
+func decodedOverhead(rmsg pr.Message) uint64 {
+	overhead := uint64(messageOverhead)
+	rmsg.Range(func(fd pr.FieldDescriptor, v pr.Value) bool {
+		switch {
+		case fd.IsList():
+			overhead += uint64(v.List().Len()) * valueSize
+		case fd.IsMap():
+			overhead += uint64(v.Map().Len()) * 2 * valueSize
+		default:
+			overhead += valueSize
+		}
+		return true
+	})
+	rangeSubMessages(rmsg, func(sub pr.Message) bool {
+		overhead += decodedOverhead(sub)
+		return true
+	})
+	return overhead
+}
+
+// readSize reads the varint size prefix of the next message. It returns
+// false at the end of the source.
+func (r *delimitedReader) readSize(t *rt.Thread) (uint64, bool, error) {
+	var prefix []byte
+	for {
+		b, err := r.read(t, 1)
+		if err != nil {
+			return 0, false, err
+		}
+		if len(b) == 0 {
+			if len(prefix) == 0 {
+				return 0, false, nil
+			}
+			return 0, false, errors.New(
+				"unexpected end of delimited message stream")
+		}
+		prefix = append(prefix, b[0])
+		if b[0] < 0x80 {
+			break
+		}
+		if len(prefix) == protowire.SizeVarint(math.MaxUint64) {
+			return 0, false, errors.New("invalid message size prefix")
+		}
+	}
+	size, n := protowire.ConsumeVarint(prefix)
+	if n < 0 {
+		return 0, false, protowire.ParseError(n)
+	}
+	return size, true, nil
+}
+
+// read reads up to n bytes from the source. Fewer bytes are returned only
+// at the end of the source.
+func (r *delimitedReader) read(t *rt.Thread, n int) ([]byte, error) {
+	if r.source.IsNil() {
+		if n > len(r.data) {
+			n = len(r.data)
+		}
+		buf := []byte(r.data[:n])
+		r.data = r.data[n:]
+		return buf, nil
+	}
+	read, err := rt.Index(t, r.source, rt.StringValue("read"))
+	if err != nil {
+		return nil, err
+	}
+	var buf []byte
+	for len(buf) < n {
+		chunk, err := rt.Call1(
+			t, read, r.source, rt.IntValue(int64(n-len(buf))))
+		if err != nil {
+			return nil, err
+		}
+		if chunk.IsNil() {
+			break
+		}
+		s, ok := chunk.TryString()
+		if !ok {
+			return nil, fmt.Errorf("read returned %s instead of a string",
+				chunk.TypeName())
+		}
+		if s == "" {
+			break
+		}
+		buf = append(buf, s...)
+	}
+	return buf, nil
+}
+
+// protoWriteDelimited writes a list of messages with length-delimited
+// encoding. Without a sink, the encoding is returned as string. Otherwise,
+// the encoding of each message is passed to the write method of the sink,
+// such as a file handle, and the sink is returned.
+func protoWriteDelimited(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	if err := c.Check1Arg(); err != nil {
+		return nil, err
+	}
+	msgs, err := c.TableArg(0)
+	if err != nil {
+		return nil, err
+	}
+	sink := c.Arg(1)
+	var write rt.Value
+	if !sink.IsNil() {
+		if write, err = rt.Index(t, sink, rt.StringValue("write")); err != nil {
+			return nil, err
+		}
+	}
+	var buf []byte
+	for i := int64(1); ; i++ {
+		v := msgs.Get(rt.IntValue(i))
+		if v.IsNil() {
+			break
+		}
+		msg, ok := unwrapReadable(runtimeOptions(t.Runtime), v)
+		if !ok {
+			return nil, fmt.Errorf("message expected at index %d, got %s",
+				i, v.TypeName())
+		}
+		if buf, err = marshalDelimited(buf, msg); err != nil {
+			return nil, err
+		}
+		if write.IsNil() {
+			continue
+		}
+		_, err = rt.Call1(t, write, sink, rt.StringValue(string(buf)))
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[:0]
+	}
+	if write.IsNil() {
+		return pushingString(t, c, string(buf))
+	}
+	return c.PushingNext1(t.Runtime, sink), nil
+}
@@ -0,0 +1,157 @@
+package proto
+
+import (
+	"fmt"
+
+	rt "github.com/arnodel/golua/runtime"
+	"google.golang.org/protobuf/proto"
+	pr "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+var (
+	// descriptorTable is the metatable for protobuf descriptor userdata
+	// values.
+	descriptorTable *rt.Table
+
+	// descriptorMethods are the methods for protobuf descriptors.
+	descriptorMethods map[string]rt.Value
+)
+
+// init initializes descriptorTable and descriptorMethods.
+func init() {
+	descriptorTable = rt.NewTable()
+	descriptorTable.Set(rt.StringValue("__name"), rt.StringValue("descriptor"))
+	descriptorMethods = make(map[string]rt.Value)
+	setMapFunc(descriptorMethods, "FullName", descriptorFullName, 1, false,
+		cpuIOMemTimeSafe)
+	setMapFunc(descriptorMethods, "Name", descriptorName, 1, false,
+		cpuIOMemTimeSafe)
+	setMapFunc(descriptorMethods, "Options", descriptorOptions, 1, false,
+		cpuIOTimeSafe)
+	setTableFunc(
+		"__eq", descriptorEqual, 2, false, cpuIOMemTimeSafe, descriptorTable)
+	setTableFunc(
+		"__index", descriptorIndex, 2, false, cpuIOMemTimeSafe, descriptorTable)
+	setTableFunc("__tostring", descriptorFullName, 1, false, cpuIOMemTimeSafe,
+		descriptorTable)
+	setMapFunc(msgMethods, "Descriptor", msgDescriptor, 1, false,
+		cpuIOMemTimeSafe)
+}
+
+// descriptorEqual checks two protobuf descriptors for equality.
+func descriptorEqual(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	lhs, _ := c.UserDataArg(0)
+	lhsDesc, ok := lhs.Value().(pr.Descriptor)
+	if !ok {
+		return pushingFalse(t, c)
+	}
+	rhs, _ := c.UserDataArg(1)
+	rhsDesc, ok := rhs.Value().(pr.Descriptor)
+	if !ok {
+		return pushingFalse(t, c)
+	}
+	return pushingBool(t, c, lhsDesc.FullName() == rhsDesc.FullName())
+}
+
+// descriptorFullName returns the full name of a protobuf descriptor.
+func descriptorFullName(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	return pushingString(
+		t, c, string(ud.Value().(pr.Descriptor).FullName()))
+}
+
+// descriptorIndex implements the index operation for protobuf descriptors.
+// Only methods can be indexed.
+func descriptorIndex(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	s, ok := c.Arg(1).TryString()
+	if !ok {
+		return c.Next(), nil
+	}
+	if ret, ok := descriptorMethods[s]; ok {
+		return c.PushingNext1(t.Runtime, ret), nil
+	}
+	ud, _ := c.UserDataArg(0)
+	var methods map[string]rt.Value
+	switch ud.Value().(type) {
+	case pr.ServiceDescriptor:
+		methods = serviceMethods
+	case pr.MethodDescriptor:
+		methods = methodMethods
+	}
+	if ret, ok := methods[s]; ok {
+		return c.PushingNext1(t.Runtime, ret), nil
+	}
+	return c.Next(), nil
+}
+
+// descriptorName returns the short name of a protobuf descriptor.
+func descriptorName(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	return pushingString(t, c, string(ud.Value().(pr.Descriptor).Name()))
+}
+
+// descriptorOptions returns the options of a protobuf descriptor as
+// a read-only message.
+func descriptorOptions(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	opts, err := resolvedOptions(ud.Value().(pr.Descriptor))
+	if err != nil {
+		return nil, err
+	}
+	return c.PushingNext1(t.Runtime, WrapReadOnly(opts)), nil
+}
+
+// msgDescriptor returns the descriptor of a protobuf message.
+func msgDescriptor(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	md := ud.Value().(proto.Message).ProtoReflect().Descriptor()
+	return c.PushingNext1(t.Runtime, wrapDescriptor(md)), nil
+}
+
+// protoDescriptor looks up a descriptor by full name.
+func protoDescriptor(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	if err := c.Check1Arg(); err != nil {
+		return nil, err
+	}
+	name, err := c.StringArg(0)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName(
+		pr.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("no such descriptor: %s", name)
+	}
+	return c.PushingNext1(t.Runtime, wrapDescriptor(desc)), nil
+}
+
+// resolvedOptions returns the options of the given descriptor.
+// Custom options which were not known when the options were parsed are
+// resolved against the global type registry.
+func resolvedOptions(desc pr.Descriptor) (proto.Message, error) {
+	opts := desc.Options()
+	if opts == nil || len(opts.ProtoReflect().GetUnknown()) == 0 {
+		return opts, nil
+	}
+	buf, err := proto.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+	resolved := opts.ProtoReflect().New().Interface()
+	err = proto.UnmarshalOptions{
+		Resolver: protoregistry.GlobalTypes,
+	}.Unmarshal(buf, resolved)
+	if err != nil {
+		return nil, err
+	}
+	return resolved, nil
+}
+
+// wrapDescriptor wraps the given descriptor in a Lua value.
+func wrapDescriptor(desc pr.Descriptor) rt.Value {
+	if desc == nil {
+		return rt.NilValue
+	}
+	return rt.UserDataValue(rt.NewUserData(desc, descriptorTable))
+}
@@ -0,0 +1,594 @@
+package proto
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	rt "github.com/arnodel/golua/runtime"
+	"google.golang.org/protobuf/proto"
+	pr "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// DiffKind is the kind of a difference between two messages.
+type DiffKind string
+
+// Difference kinds.
+const (
+	// DiffAdded means a value is present only in the new message.
+	DiffAdded DiffKind = "added"
+
+	// DiffRemoved means a value is present only in the old message.
+	DiffRemoved DiffKind = "removed"
+
+	// DiffChanged means a value is present in both messages but differs.
+	DiffChanged DiffKind = "changed"
+)
+
+// Difference is a single difference between two messages.
+type Difference struct {
+	// Path is the path to the differing value.
+	Path string
+
+	// Kind is the kind of difference.
+	Kind DiffKind
+
+	// Field is the field containing the differing value.
+	Field pr.FieldDescriptor
+
+	// Old and New are the old and new values. For added and removed values,
+	// Old and New, respectively, are invalid.
+	Old, New pr.Value
+}
+
+// DiffOptions configures the comparison of messages.
+type DiffOptions struct {
+	// ListKeys maps the full names of repeated message fields to the name of
+	// a field in the element messages. Elements of such lists are matched by
+	// the value of that field instead of by their index. Keys must be unique
+	// within each list.
+	ListKeys map[pr.FullName]pr.Name
+
+	// IgnoreFields contains the full names of fields to be ignored.
+	IgnoreFields map[pr.FullName]bool
+
+	// UnorderedLists causes repeated fields without list keys to be compared
+	// as multisets, disregarding the order of their elements.
+	UnorderedLists bool
+
+	// FloatEpsilon is the maximum absolute difference for which floating
+	// point values are considered equal.
+	FloatEpsilon float64
+
+	// IgnoreUnknown causes unknown fields to be ignored. Otherwise, unknown
+	// fields are compared in their wire-format encoding.
+	IgnoreUnknown bool
+}
+
+// String renders the difference as a line of text.
+func (d *Difference) String() string {
+	switch d.Kind {
+	case DiffAdded:
+		return fmt.Sprintf("+ %s: %s", d.Path, formatValue(d.Field, d.New))
+	case DiffRemoved:
+		return fmt.Sprintf("- %s: %s", d.Path, formatValue(d.Field, d.Old))
+	default:
+		return fmt.Sprintf("~ %s: %s -> %s", d.Path,
+			formatValue(d.Field, d.Old), formatValue(d.Field, d.New))
+	}
+}
+
+// Diff returns the differences between the messages a and b, which must be
+// of the same type. Differences in unknown fields are reported at the
+// pseudo-field "[unknown]" of the containing message, unless
+// opts.IgnoreUnknown is set.
+// If opts is nil, default options are used.
+func Diff(a, b proto.Message, opts *DiffOptions) ([]Difference, error) {
+	if opts == nil {
+		opts = &DiffOptions{}
+	}
+	d := differ{
+		opts: opts,
+	}
+	err := d.diffMessages("", a.ProtoReflect(), b.ProtoReflect())
+	if err != nil {
+		return nil, err
+	}
+	return d.diffs, nil
+}
+
+// Equal checks the messages a and b for equality under the given options.
+// If opts is nil, Equal is like proto.Equal, except that messages of
+// different types cause an error.
+func Equal(a, b proto.Message, opts *DiffOptions) (bool, error) {
+	diffs, err := Diff(a, b, opts)
+	if err != nil {
+		return false, err
+	}
+	return len(diffs) == 0, nil
+}
+
+// init initializes the Equal method of messages.
+func init() {
+	setMapFunc(msgMethods, "Equal", msgEqualOpts, 3, false, cpuIOTimeSafe)
+}
+
+// differ computes the differences between messages.
+type differ struct {
+	// opts are the diff options.
+	opts *DiffOptions
+
+	// diffs are the differences found so far.
+	diffs []Difference
+}
+
+// add records a difference.
+func (d *differ) add(
+	path string, kind DiffKind, fd pr.FieldDescriptor, before, after pr.Value,
+) {
+	d.diffs = append(d.diffs, Difference{
+		Path:  path,
+		Kind:  kind,
+		Field: fd,
+		Old:   before,
+		New:   after,
+	})
+}
+
+// diffField records the differences in the field fd of a and b.
+func (d *differ) diffField(
+	path string, fd pr.FieldDescriptor, a, b pr.Message,
+) error {
+	hasA, hasB := a.Has(fd), b.Has(fd)
+	switch {
+	case !hasA && !hasB:
+		return nil
+	case fd.IsList():
+		return d.diffLists(path, fd, a.Get(fd).List(), b.Get(fd).List())
+	case fd.IsMap():
+		return d.diffMaps(path, fd, a.Get(fd).Map(), b.Get(fd).Map())
+	case !fd.HasPresence() && d.floatsWithinEpsilon(fd, a.Get(fd), b.Get(fd)):
+		// unset fields without presence have the default value
+		return nil
+	case !hasB:
+		d.add(path, DiffRemoved, fd, a.Get(fd), pr.Value{})
+		return nil
+	case !hasA:
+		d.add(path, DiffAdded, fd, pr.Value{}, b.Get(fd))
+		return nil
+	}
+	return d.diffValues(path, fd, a.Get(fd), b.Get(fd))
+}
+
+// diffLists records the differences between the lists a and b of the
+// field fd.
+func (d *differ) diffLists(
+	path string, fd pr.FieldDescriptor, a, b pr.List,
+) error {
+	key, ok := d.opts.ListKeys[fd.FullName()]
+	if ok && (fd.Kind() == pr.MessageKind || fd.Kind() == pr.GroupKind) {
+		return d.diffKeyedLists(path, fd, key, a, b)
+	}
+	if d.opts.UnorderedLists {
+		return d.diffUnorderedLists(path, fd, a, b)
+	}
+	for i := 0; i < a.Len() || i < b.Len(); i++ {
+		elemPath := listIndexPath(path, i)
+		switch {
+		case i >= b.Len():
+			d.add(elemPath, DiffRemoved, fd, a.Get(i), pr.Value{})
+		case i >= a.Len():
+			d.add(elemPath, DiffAdded, fd, pr.Value{}, b.Get(i))
+		default:
+			err := d.diffValues(elemPath, fd, a.Get(i), b.Get(i))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// diffKeyedLists records the differences between the message lists a and b
+// of the field fd, matching elements by the value of their key field.
+func (d *differ) diffKeyedLists(
+	path string, fd pr.FieldDescriptor, key pr.Name, a, b pr.List,
+) error {
+	keyFD := fd.Message().Fields().ByName(key)
+	if keyFD == nil || keyFD.IsList() || keyFD.IsMap() ||
+		keyFD.Kind() == pr.MessageKind || keyFD.Kind() == pr.GroupKind {
+		return fmt.Errorf("invalid key field '%s' for list '%s'",
+			key, fd.FullName())
+	}
+	elemPath := func(v pr.Value) string {
+		return fmt.Sprintf("%s[%s=%s]", path, key,
+			formatValue(keyFD, v.Message().Get(keyFD)))
+	}
+	keys := func(list pr.List) (map[string]int, error) {
+		indices := make(map[string]int, list.Len())
+		for i := 0; i < list.Len(); i++ {
+			k := valueKeys(keyFD, list.Get(i).Message().Get(keyFD))[0]
+			if _, ok := indices[k]; ok {
+				return nil, fmt.Errorf("duplicate key %s in list '%s'",
+					elemPath(list.Get(i)), fd.FullName())
+			}
+			indices[k] = i
+		}
+		return indices, nil
+	}
+	keysA, err := keys(a)
+	if err != nil {
+		return err
+	}
+	keysB, err := keys(b)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < a.Len(); i++ {
+		k := valueKeys(keyFD, a.Get(i).Message().Get(keyFD))[0]
+		j, ok := keysB[k]
+		if !ok {
+			d.add(elemPath(a.Get(i)), DiffRemoved, fd, a.Get(i), pr.Value{})
+			continue
+		}
+		err := d.diffValues(elemPath(a.Get(i)), fd, a.Get(i), b.Get(j))
+		if err != nil {
+			return err
+		}
+	}
+	for i := 0; i < b.Len(); i++ {
+		k := valueKeys(keyFD, b.Get(i).Message().Get(keyFD))[0]
+		if _, ok := keysA[k]; !ok {
+			d.add(elemPath(b.Get(i)), DiffAdded, fd, pr.Value{}, b.Get(i))
+		}
+	}
+	return nil
+}
+
+// diffUnorderedLists records the differences between the lists a and b of
+// the field fd, matching each element of a with the first equal unmatched
+// element of b.
+func (d *differ) diffUnorderedLists(
+	path string, fd pr.FieldDescriptor, a, b pr.List,
+) error {
+	matched := make([]bool, b.Len())
+	for i := 0; i < a.Len(); i++ {
+		found := false
+		for j := 0; j < b.Len() && !found; j++ {
+			if matched[j] {
+				continue
+			}
+			sub := differ{
+				opts: d.opts,
+			}
+			if err := sub.diffValues(path, fd, a.Get(i), b.Get(j)); err != nil {
+				return err
+			}
+			found = len(sub.diffs) == 0
+			matched[j] = found
+		}
+		if !found {
+			d.add(listIndexPath(path, i), DiffRemoved, fd, a.Get(i), pr.Value{})
+		}
+	}
+	for j := 0; j < b.Len(); j++ {
+		if !matched[j] {
+			d.add(listIndexPath(path, j), DiffAdded, fd, pr.Value{}, b.Get(j))
+		}
+	}
+	return nil
+}
+
+// diffMaps records the differences between the maps a and b of the
+// field fd.
+func (d *differ) diffMaps(
+	path string, fd pr.FieldDescriptor, a, b pr.Map,
+) error {
+	valueFD := fd.MapValue()
+	for _, k := range sortedMapKeys(a) {
+		keyPath := mapKeyPath(path, k)
+		if !b.Has(k) {
+			d.add(keyPath, DiffRemoved, valueFD, a.Get(k), pr.Value{})
+			continue
+		}
+		err := d.diffValues(keyPath, valueFD, a.Get(k), b.Get(k))
+		if err != nil {
+			return err
+		}
+	}
+	for _, k := range sortedMapKeys(b) {
+		if !a.Has(k) {
+			d.add(mapKeyPath(path, k), DiffAdded, valueFD, pr.Value{}, b.Get(k))
+		}
+	}
+	return nil
+}
+
+// diffMessages records the differences between the messages a and b.
+func (d *differ) diffMessages(path string, a, b pr.Message) error {
+	if a.Descriptor().FullName() != b.Descriptor().FullName() {
+		return fmt.Errorf("cannot diff %s and %s",
+			a.Descriptor().FullName(), b.Descriptor().FullName())
+	}
+	fields := a.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if d.opts.IgnoreFields[fd.FullName()] {
+			continue
+		}
+		if err := d.diffField(fieldPath(path, fd), fd, a, b); err != nil {
+			return err
+		}
+	}
+	if err := d.diffExtensions(path, a, b); err != nil {
+		return err
+	}
+	if d.opts.IgnoreUnknown {
+		return nil
+	}
+	unknownA, unknownB := a.GetUnknown(), b.GetUnknown()
+	if !bytes.Equal(unknownA, unknownB) {
+		d.add(unknownPath(path), DiffChanged, nil,
+			pr.ValueOfBytes(unknownA), pr.ValueOfBytes(unknownB))
+	}
+	return nil
+}
+
+// diffExtensions records the differences between the extension fields of
+// the messages a and b.
+func (d *differ) diffExtensions(path string, a, b pr.Message) error {
+	var xds []pr.FieldDescriptor
+	seen := make(map[pr.FullName]bool)
+	collect := func(fd pr.FieldDescriptor, _ pr.Value) bool {
+		if fd.IsExtension() && !seen[fd.FullName()] &&
+			!d.opts.IgnoreFields[fd.FullName()] {
+			seen[fd.FullName()] = true
+			xds = append(xds, fd)
+		}
+		return true
+	}
+	rangeFieldsOrdered(a, collect)
+	rangeFieldsOrdered(b, collect)
+	for _, xd := range xds {
+		if err := d.diffField(fieldPath(path, xd), xd, a, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffValues records the differences between the singular values, list
+// elements or map values a and b of the field fd.
+func (d *differ) diffValues(
+	path string, fd pr.FieldDescriptor, a, b pr.Value,
+) error {
+	if fd.Kind() == pr.MessageKind || fd.Kind() == pr.GroupKind {
+		return d.diffMessages(path, a.Message(), b.Message())
+	}
+	if d.floatsWithinEpsilon(fd, a, b) {
+		return nil
+	}
+	if !scalarEqual(a, b) {
+		d.add(path, DiffChanged, fd, a, b)
+	}
+	return nil
+}
+
+// floatsWithinEpsilon checks whether fd is a floating point field and its
+// values a and b differ by at most the epsilon of the diff options.
+// Like in proto.Equal, NaN values are equal to each other.
+func (d *differ) floatsWithinEpsilon(
+	fd pr.FieldDescriptor, a, b pr.Value,
+) bool {
+	if fd.Kind() != pr.FloatKind && fd.Kind() != pr.DoubleKind {
+		return false
+	}
+	x, y := a.Float(), b.Float()
+	if math.IsNaN(x) || math.IsNaN(y) {
+		return math.IsNaN(x) && math.IsNaN(y)
+	}
+	return math.Abs(x-y) <= d.opts.FloatEpsilon
+}
+
+// formatValue formats the value v of the field fd as text.
+// Invalid values are formatted as nil.
+func formatValue(fd pr.FieldDescriptor, v pr.Value) string {
+	if !v.IsValid() {
+		return "nil"
+	}
+	switch x := v.Interface().(type) {
+	case string:
+		return strconv.Quote(x)
+	case []byte:
+		return strconv.Quote(string(x))
+	case pr.EnumNumber:
+		if evd := fd.Enum().Values().ByNumber(x); evd != nil {
+			return string(evd.Name())
+		}
+		return strconv.FormatInt(int64(x), 10)
+	case pr.Message:
+		return formatMessage(x)
+	case pr.List:
+		elems := make([]string, x.Len())
+		for i := range elems {
+			elems[i] = formatValue(fd, x.Get(i))
+		}
+		return "[" + strings.Join(elems, ", ") + "]"
+	case pr.Map:
+		var entries []string
+		for _, k := range sortedMapKeys(x) {
+			entries = append(entries, formatValue(fd.MapKey(), k.Value())+": "+
+				formatValue(fd.MapValue(), x.Get(k)))
+		}
+		return "{" + strings.Join(entries, ", ") + "}"
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+// formatMessage formats the populated fields of rmsg as text.
+func formatMessage(rmsg pr.Message) string {
+	var fields []string
+	rangeFieldsOrdered(rmsg, func(fd pr.FieldDescriptor, v pr.Value) bool {
+		fields = append(fields, fieldPath("", fd)+": "+formatValue(fd, v))
+		return true
+	})
+	return "{" + strings.Join(fields, ", ") + "}"
+}
+
+// msgEqualOpts checks a message for equality with another message under the
+// given options. Values other than messages of the same type are not equal.
+func msgEqualOpts(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	if err := c.CheckNArgs(2); err != nil {
+		return nil, err
+	}
+	ud, _ := c.UserDataArg(0)
+	a := readableUserData(t, ud).Interface()
+	b, ok := unwrapReadable(runtimeOptions(t.Runtime), c.Arg(1))
+	if !ok || a.ProtoReflect().Descriptor().FullName() !=
+		b.ProtoReflect().Descriptor().FullName() {
+		return pushingFalse(t, c)
+	}
+	var opts DiffOptions
+	if c.NArgs() > 2 && !c.Arg(2).IsNil() {
+		optsTable, err := c.TableArg(2)
+		if err != nil {
+			return nil, err
+		}
+		if err = parseDiffOptions(&opts, optsTable); err != nil {
+			return nil, err
+		}
+	}
+	equal, err := Equal(a, b, &opts)
+	if err != nil {
+		return nil, err
+	}
+	return pushingBool(t, c, equal)
+}
+
+// protoDiff computes the differences between two messages of the same type
+// and returns them as a list of tables with path, kind, old and new entries.
+// The list can be converted to text with tostring, yielding one line per
+// difference. Unknown fields are compared as well, unless the ignore_unknown
+// option is set.
+func protoDiff(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	if err := c.CheckNArgs(2); err != nil {
+		return nil, err
+	}
+	var msgs [2]proto.Message
+	for i := range msgs {
+		ud, ok := c.Arg(i).TryUserData()
+		if ok {
+			msgs[i], ok = ud.Value().(proto.Message)
+		}
+		if !ok {
+			return nil, fmt.Errorf("cannot diff %s", c.Arg(i).TypeName())
+		}
+		msgs[i] = readableMessage(runtimeOptions(t.Runtime), msgs[i]).Interface()
+	}
+	var opts DiffOptions
+	if c.NArgs() > 2 && !c.Arg(2).IsNil() {
+		optsTable, err := c.TableArg(2)
+		if err != nil {
+			return nil, err
+		}
+		if err = parseDiffOptions(&opts, optsTable); err != nil {
+			return nil, err
+		}
+	}
+	diffs, err := Diff(msgs[0], msgs[1], &opts)
+	if err != nil {
+		return nil, err
+	}
+	return c.PushingNext1(t.Runtime, diffsToLua(t.Runtime, diffs)), nil
+}
+
+// diffsToLua converts the given differences to a Lua list of tables.
+func diffsToLua(r *rt.Runtime, diffs []Difference) rt.Value {
+	opts := runtimeOptions(r)
+	tbl := rt.NewTable()
+	var text strings.Builder
+	for i := range diffs {
+		diff := &diffs[i]
+		entry := rt.NewTable()
+		r.SetTable(entry, rt.StringValue("path"), rt.StringValue(diff.Path))
+		r.SetTable(
+			entry, rt.StringValue("kind"), rt.StringValue(string(diff.Kind)))
+		if diff.Old.IsValid() {
+			r.SetTable(entry, rt.StringValue("old"),
+				protoValueToLua(opts, diff.Field, diff.Old, true))
+		}
+		if diff.New.IsValid() {
+			r.SetTable(entry, rt.StringValue("new"),
+				protoValueToLua(opts, diff.Field, diff.New, true))
+		}
+		r.SetTable(tbl, rt.IntValue(int64(i)+1), rt.TableValue(entry))
+		if i > 0 {
+			text.WriteByte('\n')
+		}
+		text.WriteString(diff.String())
+	}
+	rendered := text.String()
+	toString := rt.NewGoFunction(
+		func(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+			return pushingString(t, c, rendered)
+		}, "__tostring", 1, false)
+	rt.SolemnlyDeclareCompliance(cpuIOMemTimeSafe, toString)
+	meta := rt.NewTable()
+	meta.Set(rt.StringValue("__tostring"), rt.FunctionValue(toString))
+	tbl.SetMetatable(meta)
+	return rt.TableValue(tbl)
+}
+
+// parseDiffOptions parses a Lua options table into opts.
+// The keys entry maps full names of repeated message fields to key field
+// names, the ignore entry lists the full names of fields to be ignored,
+// and the unordered, epsilon and ignore_unknown entries correspond to the
+// UnorderedLists, FloatEpsilon and IgnoreUnknown options.
+func parseDiffOptions(opts *DiffOptions, tbl *rt.Table) error {
+	if keys, ok := tbl.Get(rt.StringValue("keys")).TryTable(); ok {
+		opts.ListKeys = make(map[pr.FullName]pr.Name)
+		k, v, _ := keys.Next(rt.NilValue)
+		for ; !k.IsNil(); k, v, _ = keys.Next(k) {
+			field, ok1 := k.TryString()
+			key, ok2 := v.TryString()
+			if !ok1 || !ok2 {
+				return fmt.Errorf("invalid list key entry %s = %s",
+					k.TypeName(), v.TypeName())
+			}
+			opts.ListKeys[pr.FullName(field)] = pr.Name(key)
+		}
+	}
+	if ignore, ok := tbl.Get(rt.StringValue("ignore")).TryTable(); ok {
+		opts.IgnoreFields = make(map[pr.FullName]bool)
+		k, v, _ := ignore.Next(rt.NilValue)
+		for ; !k.IsNil(); k, v, _ = ignore.Next(k) {
+			field, ok := v.TryString()
+			if !ok {
+				return fmt.Errorf("invalid ignored field type %s", v.TypeName())
+			}
+			opts.IgnoreFields[pr.FullName(field)] = true
+		}
+	}
+	opts.UnorderedLists = rt.Truth(tbl.Get(rt.StringValue("unordered")))
+	opts.IgnoreUnknown = rt.Truth(tbl.Get(rt.StringValue("ignore_unknown")))
+	if epsilon := tbl.Get(rt.StringValue("epsilon")); !epsilon.IsNil() {
+		f, ok := rt.ToFloat(epsilon)
+		if !ok {
+			return fmt.Errorf("invalid epsilon type %s", epsilon.TypeName())
+		}
+		opts.FloatEpsilon = f
+	}
+	return nil
+}
+
+// scalarEqual checks the scalar values a and b for equality.
+func scalarEqual(a, b pr.Value) bool {
+	if x, ok := a.Interface().([]byte); ok {
+		y, ok := b.Interface().([]byte)
+		return ok && bytes.Equal(x, y)
+	}
+	return a.Interface() == b.Interface()
+}
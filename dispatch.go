@@ -0,0 +1,158 @@
+package proto
+
+import (
+	"fmt"
+	"strings"
+
+	rt "github.com/arnodel/golua/runtime"
+	"google.golang.org/protobuf/proto"
+	pr "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Dispatcher dispatches calls of the methods of a protobuf service to
+// handler functions implemented in Lua. It works in-process, so it can back
+// test doubles and plugin hosts.
+type Dispatcher struct {
+	// runtime is the Lua runtime in which the handlers are called.
+	runtime *rt.Runtime
+
+	// service is the dispatched service.
+	service pr.ServiceDescriptor
+
+	// handlers are the handler functions, keyed by method name.
+	handlers map[pr.Name]rt.Value
+}
+
+// NewDispatcher returns a dispatcher for the service sd. The table handlers
+// maps method names to Lua functions, which are called in the runtime r.
+// A unary handler is called with the request message and must return the
+// response message. Methods without handler are reported as unimplemented
+// when called.
+func NewDispatcher(
+	r *rt.Runtime, sd pr.ServiceDescriptor, handlers *rt.Table,
+) (*Dispatcher, error) {
+	d := &Dispatcher{
+		runtime:  r,
+		service:  sd,
+		handlers: make(map[pr.Name]rt.Value),
+	}
+	k, v, _ := handlers.Next(rt.NilValue)
+	for ; !k.IsNil(); k, v, _ = handlers.Next(k) {
+		name, ok := k.TryString()
+		if !ok {
+			return nil, fmt.Errorf("invalid method name type '%s'", k.TypeName())
+		}
+		if sd.Methods().ByName(pr.Name(name)) == nil {
+			return nil, fmt.Errorf(
+				"no method '%s' in service '%s'", name, sd.FullName())
+		}
+		if _, ok = v.TryCallable(); !ok {
+			return nil, fmt.Errorf("handler for method '%s' is not callable", name)
+		}
+		d.handlers[pr.Name(name)] = v
+	}
+	return d, nil
+}
+
+// Service returns the descriptor of the dispatched service.
+func (d *Dispatcher) Service() pr.ServiceDescriptor {
+	return d.service
+}
+
+// method returns the descriptor and handler of the method with the given
+// name. Besides the plain method name, the full name and the gRPC style
+// "/package.Service/Method" name are accepted.
+func (d *Dispatcher) method(
+	name string,
+) (pr.MethodDescriptor, rt.Value, error) {
+	short := name
+	if i := strings.LastIndexAny(name, "./"); i >= 0 {
+		prefix := strings.Trim(name[:i], "/")
+		if prefix != string(d.service.FullName()) {
+			return nil, rt.NilValue, fmt.Errorf(
+				"method '%s' does not belong to service '%s'",
+				name, d.service.FullName())
+		}
+		short = name[i+1:]
+	}
+	md := d.service.Methods().ByName(pr.Name(short))
+	if md == nil {
+		return nil, rt.NilValue, fmt.Errorf(
+			"no method '%s' in service '%s'", short, d.service.FullName())
+	}
+	handler, ok := d.handlers[md.Name()]
+	if !ok {
+		return nil, rt.NilValue, fmt.Errorf(
+			"method '%s' not implemented", md.FullName())
+	}
+	return md, handler, nil
+}
+
+// Dispatch calls the handler of the unary method with the given name with
+// the request decoded from the wire format, and returns the response in the
+// wire format.
+func (d *Dispatcher) Dispatch(method string, request []byte) ([]byte, error) {
+	md, _, err := d.method(method)
+	if err != nil {
+		return nil, err
+	}
+	req := messageTypeOf(md.Input()).New().Interface()
+	if err = proto.Unmarshal(request, req); err != nil {
+		return nil, fmt.Errorf("%s: bad request: %w", md.FullName(), err)
+	}
+	resp, err := d.DispatchMessage(method, req)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(resp)
+}
+
+// DispatchMessage calls the handler of the unary method with the given name
+// with the request message req, and returns the response message.
+func (d *Dispatcher) DispatchMessage(
+	method string, req proto.Message,
+) (proto.Message, error) {
+	md, handler, err := d.method(method)
+	if err != nil {
+		return nil, err
+	}
+	if md.IsStreamingClient() || md.IsStreamingServer() {
+		return nil, fmt.Errorf(
+			"%s is a streaming method, use DispatchStream", md.FullName())
+	}
+	if err = checkMessageType(req, md.Input()); err != nil {
+		return nil, fmt.Errorf("%s: bad request: %w", md.FullName(), err)
+	}
+	ret, err := rt.Call1(d.runtime.MainThread(), handler, Wrap(req))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", md.FullName(), err)
+	}
+	return checkResponse(md, ret)
+}
+
+// checkMessageType checks that msg is a message of type md.
+func checkMessageType(msg proto.Message, md pr.MessageDescriptor) error {
+	if got := msg.ProtoReflect().Descriptor().FullName(); got != md.FullName() {
+		return fmt.Errorf("message type '%s' instead of '%s'", got, md.FullName())
+	}
+	return nil
+}
+
+// checkResponse checks the value returned by the handler of the method md
+// and returns the response message.
+func checkResponse(
+	md pr.MethodDescriptor, ret rt.Value,
+) (proto.Message, error) {
+	resp, ok := Unwrap(ret)
+	if !ok {
+		return nil, fmt.Errorf("%s: handler returned %s instead of a message",
+			md.FullName(), ret.TypeName())
+	}
+	if err := checkMessageType(resp, md.Output()); err != nil {
+		return nil, fmt.Errorf("%s: bad response: %w", md.FullName(), err)
+	}
+	if err := proto.CheckInitialized(resp); err != nil {
+		return nil, fmt.Errorf("%s: bad response: %w", md.FullName(), err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,248 @@
+package proto
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	rt "github.com/arnodel/golua/runtime"
+	"google.golang.org/protobuf/proto"
+	pr "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+var (
+	// extensionTable is the metatable for protobuf extension type userdata
+	// values.
+	extensionTable *rt.Table
+)
+
+// init initializes extensionTable and the extension methods of messages.
+func init() {
+	extensionTable = rt.NewTable()
+	extensionTable.Set(rt.StringValue("__name"), rt.StringValue("extension"))
+	setTableFunc(
+		"__eq", extensionEqual, 2, false, cpuIOMemTimeSafe, extensionTable)
+	setTableFunc(
+		"__tostring", extensionToString, 1, false, cpuIOTimeSafe, extensionTable)
+	setMapFunc(msgMethods, "ClearExtension", msgClearExtension, 2, false,
+		cpuIOMemTimeSafe)
+	setMapFunc(msgMethods, "GetExtension", msgGetExtension, 2, false,
+		cpuIOMemTimeSafe)
+	setMapFunc(msgMethods, "HasExtension", msgHasExtension, 2, false,
+		cpuIOMemTimeSafe)
+	setMapFunc(msgMethods, "RangeExtensions", msgRangeExtensions, 1, false,
+		cpuIOTimeSafe)
+	setMapFunc(msgMethods, "SetExtension", msgSetExtension, 3, false,
+		cpuIOTimeSafe)
+}
+
+// extensionEqual checks two protobuf extension types for equality.
+func extensionEqual(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	lhs, _ := c.UserDataArg(0)
+	lhsXT, ok := lhs.Value().(pr.ExtensionType)
+	if !ok {
+		return pushingFalse(t, c)
+	}
+	rhs, _ := c.UserDataArg(1)
+	rhsXT, ok := rhs.Value().(pr.ExtensionType)
+	if !ok {
+		return pushingFalse(t, c)
+	}
+	return pushingBool(t, c, lhsXT.TypeDescriptor().FullName() ==
+		rhsXT.TypeDescriptor().FullName())
+}
+
+// extensionToString returns the full name of a protobuf extension type.
+func extensionToString(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	xt := ud.Value().(pr.ExtensionType)
+	return pushingString(t, c, string(xt.TypeDescriptor().FullName()))
+}
+
+// msgClearExtension clears the specified extension field.
+func msgClearExtension(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	if ud.Metatable() == msgTableReadOnly {
+		return nil, errReadOnly
+	}
+	msg := ud.Value().(proto.Message)
+	rmsg := msg.ProtoReflect()
+	xt, err := resolveExtension(rmsg.Descriptor(), c.Arg(1))
+	if err != nil {
+		return nil, err
+	}
+	if err = checkWritable(rmsg); err != nil {
+		return nil, err
+	}
+	err = checkFieldWrite(
+		runtimeOptions(t.Runtime), msg, xt.TypeDescriptor(), pr.Value{})
+	if err != nil {
+		return nil, err
+	}
+	rmsg.Clear(xt.TypeDescriptor())
+	return c.Next(), nil
+}
+
+// msgGetExtension returns the value of the specified extension field.
+// If the message is read-only, composite values are returned read-only.
+func msgGetExtension(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	msg := ud.Value().(proto.Message)
+	xt, err := resolveExtension(msg.ProtoReflect().Descriptor(), c.Arg(1))
+	if err != nil {
+		return nil, err
+	}
+	readOnly := ud.Metatable() == msgTableReadOnly
+	value, err := msgFieldToLua(
+		runtimeOptions(t.Runtime), msg, xt.TypeDescriptor(), readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return c.PushingNext1(t.Runtime, value), nil
+}
+
+// msgHasExtension checks whether the specified extension field is populated.
+func msgHasExtension(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	rmsg := ud.Value().(proto.Message).ProtoReflect()
+	xt, err := resolveExtension(rmsg.Descriptor(), c.Arg(1))
+	if err != nil {
+		return nil, err
+	}
+	return pushingBool(t, c, rmsg.Has(xt.TypeDescriptor()))
+}
+
+// msgRangeExtensions allows ranging over the populated extension fields of
+// a message in field number order. The iterator yields the extension type
+// and the value of each extension field.
+func msgRangeExtensions(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	msg := ud.Value().(proto.Message)
+	rmsg := msg.ProtoReflect()
+	readOnly := ud.Metatable() == msgTableReadOnly
+	opts := runtimeOptions(t.Runtime)
+	var xds []pr.ExtensionTypeDescriptor
+	rmsg.Range(func(fd pr.FieldDescriptor, _ pr.Value) bool {
+		if xd, ok := fd.(pr.ExtensionTypeDescriptor); ok {
+			xds = append(xds, xd)
+		}
+		return true
+	})
+	sort.Slice(xds, func(i, j int) bool {
+		return xds[i].Number() < xds[j].Number()
+	})
+	iteratorFunction := rt.NewGoFunction(
+		func(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+			if len(xds) == 0 {
+				return c.PushingNext(t.Runtime, rt.NilValue, rt.NilValue), nil
+			}
+			xd := xds[0]
+			xds = xds[1:]
+			value, err := msgFieldToLua(opts, msg, xd, readOnly)
+			if err != nil {
+				return nil, err
+			}
+			return c.PushingNext(t.Runtime, wrapExtension(xd.Type()), value), nil
+		}, "iterator", 2, false)
+	rt.SolemnlyDeclareCompliance(cpuIOMemTimeSafe, iteratorFunction)
+	return c.PushingNext1(t.Runtime, rt.FunctionValue(iteratorFunction)), nil
+}
+
+// msgSetExtension sets the specified extension field.
+// Setting an extension field to nil clears it.
+func msgSetExtension(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	if ud.Metatable() == msgTableReadOnly {
+		return nil, errReadOnly
+	}
+	msg := ud.Value().(proto.Message)
+	xt, err := resolveExtension(msg.ProtoReflect().Descriptor(), c.Arg(1))
+	if err != nil {
+		return nil, err
+	}
+	return msgNewIndexFD(t, c, msg, xt.TypeDescriptor())
+}
+
+// protoExtension looks up an extension type by full name.
+func protoExtension(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	if err := c.Check1Arg(); err != nil {
+		return nil, err
+	}
+	name, err := c.StringArg(0)
+	if err != nil {
+		return nil, err
+	}
+	xt, err := findExtensionType(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.PushingNext1(t.Runtime, wrapExtension(xt)), nil
+}
+
+// extensionByName returns the descriptor of the extension field of md with
+// the given full name, or nil if there is no such extension.
+func extensionByName(md pr.MessageDescriptor, name string) pr.FieldDescriptor {
+	if !strings.ContainsRune(name, '.') {
+		return nil
+	}
+	xt, err := protoregistry.GlobalTypes.FindExtensionByName(pr.FullName(name))
+	if err != nil {
+		return nil
+	}
+	xd := xt.TypeDescriptor()
+	if xd.ContainingMessage().FullName() != md.FullName() {
+		return nil
+	}
+	return xd
+}
+
+// findExtensionType looks up the extension type with the given full name
+// in the global type registry.
+func findExtensionType(name string) (pr.ExtensionType, error) {
+	xt, err := protoregistry.GlobalTypes.FindExtensionByName(pr.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("no such extension: %s", name)
+	}
+	return xt, nil
+}
+
+// resolveExtension returns the extension type specified by v, which must be
+// a full name or an extension type, and checks that it extends messages of
+// type md.
+func resolveExtension(
+	md pr.MessageDescriptor, v rt.Value,
+) (pr.ExtensionType, error) {
+	var xt pr.ExtensionType
+	if s, ok := v.TryString(); ok {
+		var err error
+		if xt, err = findExtensionType(s); err != nil {
+			return nil, err
+		}
+	} else if ud, ok := v.TryUserData(); ok {
+		switch x := ud.Value().(type) {
+		case pr.ExtensionType:
+			xt = x
+		case pr.ExtensionTypeDescriptor:
+			xt = x.Type()
+		default:
+			return nil, fmt.Errorf("%T does not describe an extension", x)
+		}
+	} else {
+		return nil, fmt.Errorf("invalid extension spec type '%s'", v.TypeName())
+	}
+	xd := xt.TypeDescriptor()
+	if xd.ContainingMessage().FullName() != md.FullName() {
+		return nil, fmt.Errorf("extension '%s' does not extend message type '%s'",
+			xd.FullName(), md.FullName())
+	}
+	return xt, nil
+}
+
+// wrapExtension wraps the given extension type in a Lua value.
+func wrapExtension(xt pr.ExtensionType) rt.Value {
+	if xt == nil {
+		return rt.NilValue
+	}
+	return rt.UserDataValue(rt.NewUserData(xt, extensionTable))
+}
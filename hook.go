@@ -0,0 +1,290 @@
+package proto
+
+import (
+	rt "github.com/arnodel/golua/runtime"
+	"google.golang.org/protobuf/proto"
+	pr "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// FieldHook intercepts accesses to message fields from Lua.
+// Paths are relative to the message passed to Lua, and use the syntax of
+// the paths returned by the MissingFields method.
+//
+// Reads are intercepted when fields are indexed and when lists and maps are
+// iterated. Operations on whole messages, such as tostring, Marshal, Equal,
+// Validate or assignments to other messages, see a copy of the message in
+// which denied values are omitted. Unknown fields cannot be checked and are
+// omitted from such copies as well.
+type FieldHook interface {
+	// ReadField is called when the value v at the given path is about to be
+	// read from Lua. The value belongs to the field fd, and is a list
+	// element or map value if the path ends in an index. ReadField returns
+	// the value to be read instead, such as v itself or a redacted value,
+	// or an error to deny the read.
+	ReadField(fd pr.FieldDescriptor, path string, v pr.Value) (pr.Value, error)
+
+	// WriteField is called before the field fd at the given path is set to
+	// v from Lua. If the field is to be cleared, v is invalid. WriteField
+	// returns an error to veto the write.
+	WriteField(fd pr.FieldDescriptor, path string, v pr.Value) error
+}
+
+// FieldHookFuncs implements FieldHook with functions.
+// A nil function permits all corresponding accesses.
+type FieldHookFuncs struct {
+	// Read implements FieldHook.ReadField.
+	Read func(fd pr.FieldDescriptor, path string, v pr.Value) (pr.Value, error)
+
+	// Write implements FieldHook.WriteField.
+	Write func(fd pr.FieldDescriptor, path string, v pr.Value) error
+}
+
+// pathMessage is a message together with its path. If a field hook is
+// configured, messages obtained from fields are passed to Lua as
+// pathMessage so the paths of their fields can be determined.
+type pathMessage struct {
+	proto.Message
+
+	// path is the path of the message.
+	path string
+}
+
+// ReadField implements FieldHook.ReadField.
+func (f FieldHookFuncs) ReadField(
+	fd pr.FieldDescriptor, path string, v pr.Value,
+) (pr.Value, error) {
+	if f.Read == nil {
+		return v, nil
+	}
+	return f.Read(fd, path, v)
+}
+
+// WriteField implements FieldHook.WriteField.
+func (f FieldHookFuncs) WriteField(
+	fd pr.FieldDescriptor, path string, v pr.Value,
+) error {
+	if f.Write == nil {
+		return nil
+	}
+	return f.Write(fd, path, v)
+}
+
+// messagePath returns the path of msg, which is empty unless msg was
+// obtained from a field.
+func messagePath(msg proto.Message) string {
+	if pm, ok := msg.(*pathMessage); ok {
+		return pm.path
+	}
+	return ""
+}
+
+// hookedValueToLua converts the value v at path to a Lua value after
+// passing it through the field hook of opts. Composite values remember
+// their path.
+func hookedValueToLua(
+	opts *Options, fd, vfd pr.FieldDescriptor, path string, v pr.Value,
+	readOnly bool,
+) (rt.Value, error) {
+	v, err := opts.FieldHook.ReadField(fd, path, v)
+	if err != nil {
+		return rt.NilValue, err
+	}
+	luaValue := protoValueToLua(opts, vfd, v, readOnly)
+	ud, ok := luaValue.TryUserData()
+	if !ok {
+		return luaValue, nil
+	}
+	switch x := ud.Value().(type) {
+	case proto.Message:
+		return rt.UserDataValue(rt.NewUserData(
+			&pathMessage{Message: x, path: path}, ud.Metatable())), nil
+	case *listWrapper:
+		x.path = path
+	case *mapWrapper:
+		x.path = path
+	}
+	return luaValue, nil
+}
+
+// msgFieldToLua returns the value of the field fd of msg as a Lua value,
+// subject to the field hook of opts.
+// If readOnly is true, a composite value will be returned as a read-only value.
+func msgFieldToLua(
+	opts *Options, msg proto.Message, fd pr.FieldDescriptor, readOnly bool,
+) (rt.Value, error) {
+	rmsg := msg.ProtoReflect()
+	if opts.FieldHook == nil {
+		return protoFieldToLua(opts, rmsg, fd, readOnly), nil
+	}
+	return hookedValueToLua(opts, fd, fd, fieldPath(messagePath(msg), fd),
+		rmsg.Get(fd), readOnly)
+}
+
+// listItemToLua returns the list item with the given zero-based index as a
+// Lua value, subject to the field hook of opts.
+// If readOnly is true, a composite value will be returned as a read-only value.
+func listItemToLua(
+	opts *Options, lw *listWrapper, idx int, readOnly bool,
+) (rt.Value, error) {
+	v := lw.list.Get(idx)
+	if opts.FieldHook == nil {
+		return protoValueToLua(opts, lw.field, v, readOnly), nil
+	}
+	return hookedValueToLua(opts, lw.field, lw.field,
+		listIndexPath(lw.path, idx), v, readOnly)
+}
+
+// mapValueToLua returns the map value v with key k as a Lua value, subject
+// to the field hook of opts.
+// If readOnly is true, a composite value will be returned as a read-only value.
+func mapValueToLua(
+	opts *Options, mw *mapWrapper, k pr.MapKey, v pr.Value, readOnly bool,
+) (rt.Value, error) {
+	if opts.FieldHook == nil {
+		return protoValueToLua(opts, mw.field.MapValue(), v, readOnly), nil
+	}
+	return hookedValueToLua(opts, mw.field, mw.field.MapValue(),
+		mapKeyPath(mw.path, k), v, readOnly)
+}
+
+// hasOptions returns the options for the values traversed by the Has
+// methods of messages and maps. These are the default options, so wrapper
+// messages are not unwrapped, with the field hook of the runtime r.
+func hasOptions(r *rt.Runtime) *Options {
+	opts := defaultOptions
+	opts.FieldHook = runtimeOptions(r).FieldHook
+	return &opts
+}
+
+// checkFieldWrite checks with the field hook of opts whether the field fd
+// of msg may be set to v, or cleared if v is invalid.
+func checkFieldWrite(
+	opts *Options, msg proto.Message, fd pr.FieldDescriptor, v pr.Value,
+) error {
+	if opts.FieldHook == nil {
+		return nil
+	}
+	return opts.FieldHook.WriteField(fd, fieldPath(messagePath(msg), fd), v)
+}
+
+// readableMessage returns the message msg as seen through the field hook
+// of opts: if there is a field hook, a copy of msg is returned in which
+// the fields, list elements and map values denied by the hook are omitted,
+// and the values replaced by the hook are substituted.
+func readableMessage(opts *Options, msg proto.Message) pr.Message {
+	if opts.FieldHook == nil {
+		return msg.ProtoReflect()
+	}
+	return readableCopy(opts.FieldHook, msg.ProtoReflect(), messagePath(msg))
+}
+
+// readableUserData returns the message wrapped in ud as seen through the
+// field hook of the runtime of t, see readableMessage.
+func readableUserData(t *rt.Thread, ud *rt.UserData) pr.Message {
+	return readableMessage(runtimeOptions(t.Runtime), ud.Value().(proto.Message))
+}
+
+// unwrapReadable unwraps the protobuf message from the Lua value v as seen
+// through the field hook of opts, see readableMessage. Unlike Unwrap, it
+// keeps the path of messages obtained from fields.
+func unwrapReadable(opts *Options, v rt.Value) (proto.Message, bool) {
+	ud, ok := v.TryUserData()
+	if !ok {
+		return nil, false
+	}
+	msg, ok := ud.Value().(proto.Message)
+	if !ok {
+		return nil, false
+	}
+	return readableMessage(opts, msg).Interface(), true
+}
+
+// readableValue returns the value v converted from the Lua value luaValue
+// for the field fd of rmsg, as seen through the field hook of opts.
+// If luaValue is a list or map, v is replaced with a copy in which the
+// values denied by the hook are omitted. Messages are copied by
+// luaToProtoValue already.
+func readableValue(
+	opts *Options, rmsg pr.Message, fd pr.FieldDescriptor, luaValue rt.Value,
+	v pr.Value,
+) pr.Value {
+	ud, ok := luaValue.TryUserData()
+	if opts.FieldHook == nil || !ok {
+		return v
+	}
+	hook := opts.FieldHook
+	switch x := ud.Value().(type) {
+	case *listWrapper:
+		dst := rmsg.NewField(fd).List()
+		readableList(hook, x.field, x.path, v.List(), dst)
+		return pr.ValueOfList(dst)
+	case *mapWrapper:
+		dst := rmsg.NewField(fd).Map()
+		readableMap(hook, x.field, x.path, v.Map(), dst)
+		return pr.ValueOfMap(dst)
+	default:
+		return v
+	}
+}
+
+// readableCopy returns a copy of src at path with the fields readable
+// through hook.
+func readableCopy(hook FieldHook, src pr.Message, path string) pr.Message {
+	dst := src.New()
+	src.Range(func(fd pr.FieldDescriptor, v pr.Value) bool {
+		fdPath := fieldPath(path, fd)
+		v, err := hook.ReadField(fd, fdPath, v)
+		if err != nil {
+			return true
+		}
+		switch {
+		case fd.IsList():
+			readableList(hook, fd, fdPath, v.List(), dst.Mutable(fd).List())
+		case fd.IsMap():
+			readableMap(hook, fd, fdPath, v.Map(), dst.Mutable(fd).Map())
+		case fd.Message() != nil:
+			dst.Set(fd, pr.ValueOfMessage(readableCopy(hook, v.Message(), fdPath)))
+		default:
+			dst.Set(fd, v)
+		}
+		return true
+	})
+	return dst
+}
+
+// readableList appends the elements of the list src of the field fd at
+// path which are readable through hook to dst.
+func readableList(
+	hook FieldHook, fd pr.FieldDescriptor, path string, src, dst pr.List,
+) {
+	for i := 0; i < src.Len(); i++ {
+		elemPath := listIndexPath(path, i)
+		elem, err := hook.ReadField(fd, elemPath, src.Get(i))
+		if err != nil {
+			continue
+		}
+		if fd.Message() != nil {
+			elem = pr.ValueOfMessage(readableCopy(hook, elem.Message(), elemPath))
+		}
+		dst.Append(elem)
+	}
+}
+
+// readableMap sets the values of the map src of the field fd at path which
+// are readable through hook in dst.
+func readableMap(
+	hook FieldHook, fd pr.FieldDescriptor, path string, src, dst pr.Map,
+) {
+	src.Range(func(k pr.MapKey, v pr.Value) bool {
+		vPath := mapKeyPath(path, k)
+		v, err := hook.ReadField(fd, vPath, v)
+		if err != nil {
+			return true
+		}
+		if fd.MapValue().Message() != nil {
+			v = pr.ValueOfMessage(readableCopy(hook, v.Message(), vPath))
+		}
+		dst.Set(k, v)
+		return true
+	})
+}
@@ -0,0 +1,70 @@
+package proto
+
+import (
+	rt "github.com/arnodel/golua/runtime"
+	"google.golang.org/protobuf/proto"
+	pr "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// init initializes the initialization check methods of messages.
+func init() {
+	setMapFunc(msgMethods, "IsInitialized", msgIsInitialized, 1, false,
+		cpuIOMemTimeSafe)
+	setMapFunc(msgMethods, "MissingFields", msgMissingFields, 1, false,
+		cpuIOTimeSafe)
+}
+
+// missingFields appends the paths of the unset required fields of rmsg and
+// all messages it contains to missing, using prefix as the path of rmsg.
+func missingFields(rmsg pr.Message, prefix string, missing []string) []string {
+	fields := rmsg.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if fd.Cardinality() == pr.Required && !rmsg.Has(fd) {
+			missing = append(missing, fieldPath(prefix, fd))
+		}
+	}
+	rangeFieldsOrdered(rmsg, func(fd pr.FieldDescriptor, v pr.Value) bool {
+		path := fieldPath(prefix, fd)
+		switch {
+		case fd.IsList() &&
+			(fd.Kind() == pr.MessageKind || fd.Kind() == pr.GroupKind):
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				missing = missingFields(
+					list.Get(i).Message(), listIndexPath(path, i), missing)
+			}
+		case fd.IsMap() && fd.MapValue().Kind() == pr.MessageKind:
+			m := v.Map()
+			for _, k := range sortedMapKeys(m) {
+				missing = missingFields(
+					m.Get(k).Message(), mapKeyPath(path, k), missing)
+			}
+		case !fd.IsList() && !fd.IsMap() &&
+			(fd.Kind() == pr.MessageKind || fd.Kind() == pr.GroupKind):
+			missing = missingFields(v.Message(), path, missing)
+		}
+		return true
+	})
+	return missing
+}
+
+// msgIsInitialized checks whether all required fields of a message and all
+// messages it contains are set.
+func msgIsInitialized(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	err := proto.CheckInitialized(readableUserData(t, ud).Interface())
+	return pushingBool(t, c, err == nil)
+}
+
+// msgMissingFields returns the list of paths to the unset required fields
+// of a message and all messages it contains.
+func msgMissingFields(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	rmsg := readableUserData(t, ud)
+	tbl := rt.NewTable()
+	for i, path := range missingFields(rmsg, "", nil) {
+		t.Runtime.SetTable(tbl, rt.IntValue(int64(i)+1), rt.StringValue(path))
+	}
+	return c.PushingNext1(t.Runtime, rt.TableValue(tbl)), nil
+}
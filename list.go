@@ -1,6 +1,8 @@
 package proto
 
 import (
+	"errors"
+
 	rt "github.com/arnodel/golua/runtime"
 	pr "google.golang.org/protobuf/reflect/protoreflect"
 )
@@ -12,6 +14,9 @@ type listWrapper struct {
 
 	// list is the wrapped list.
 	list pr.List
+
+	// path is the path of list, if a field hook is configured.
+	path string
 }
 
 var (
@@ -40,10 +45,17 @@ func init() {
 		"__index", listIndexReadOnly, 2, false, cpuIOMemTimeSafe, listTableReadOnly)
 	setTableFunc(
 		"__len", listLen, 1, false, cpuIOMemTimeSafe, listTable, listTableReadOnly)
+	setTableFunc("__newindex", listNewIndexReadOnly, 3, false,
+		cpuIOMemTimeSafe, listTableReadOnly)
 	setTableFunc("__pairs", listPairs, 1, false, cpuIOMemTimeSafe,
 		listTable, listTableReadOnly)
 }
 
+// listNewIndexReadOnly rejects the list[k] = v operation on read-only lists.
+func listNewIndexReadOnly(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	return nil, errors.New("attempt to modify read-only list")
+}
+
 // listIndex performs the index operation on a list in Lua.
 func listIndex(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
 	ud, _ := c.UserDataArg(0)
@@ -81,7 +93,11 @@ func listIndexInt(
 	if idx <= 0 || idx > int64(lw.list.Len()) {
 		return c.Next(), nil
 	}
-	ret := protoValueToLua(lw.field, lw.list.Get(int(idx-1)), readOnly)
+	ret, err := listItemToLua(
+		runtimeOptions(t.Runtime), lw, int(idx-1), readOnly)
+	if err != nil {
+		return nil, err
+	}
 	return c.PushingNext1(t.Runtime, ret), nil
 }
 
@@ -115,22 +131,22 @@ func listPairs(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
 	ud, _ := c.UserDataArg(0)
 	lw := ud.Value().(*listWrapper)
 	readOnly := ud.Metatable() == listTableReadOnly
+	opts := runtimeOptions(t.Runtime)
 	iteratorFunction := rt.NewGoFunction(
 		func(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
-			if lw.list.Len() == 0 {
-				return c.PushingNext(t.Runtime, rt.NilValue, rt.NilValue), nil
-			}
 			ctrl := c.Arg(1)
-			if ctrl.IsNil() {
-				return c.PushingNext(t.Runtime, rt.IntValue(1),
-					protoValueToLua(lw.field, lw.list.Get(0), readOnly)), nil
+			idx := 0
+			if !ctrl.IsNil() {
+				idx = int(ctrl.AsInt())
 			}
-			idx := int(ctrl.AsInt())
 			if idx == lw.list.Len() {
 				return c.PushingNext(t.Runtime, rt.NilValue, rt.NilValue), nil
 			}
-			return c.PushingNext(t.Runtime, rt.IntValue(int64(idx)+1),
-				protoValueToLua(lw.field, lw.list.Get(idx), readOnly)), nil
+			item, err := listItemToLua(opts, lw, idx, readOnly)
+			if err != nil {
+				return nil, err
+			}
+			return c.PushingNext(t.Runtime, rt.IntValue(int64(idx)+1), item), nil
 		}, "iterator", 2, false)
 	rt.SolemnlyDeclareCompliance(cpuIOMemTimeSafe, iteratorFunction)
 	return c.PushingNext(t.Runtime, rt.FunctionValue(iteratorFunction),
@@ -5,18 +5,44 @@ import (
 	rt "github.com/arnodel/golua/runtime"
 )
 
-// LibLoader can load the proto package.
-var LibLoader = packagelib.Loader{
-	Load: load,
-	Name: "proto",
+// LibLoader can load the proto package with default options.
+var LibLoader = NewLibLoader(Options{})
+
+// NewLibLoader returns a loader for the proto package configured with the
+// given options.
+func NewLibLoader(opts Options) packagelib.Loader {
+	return packagelib.Loader{
+		Load: func(r *rt.Runtime) (rt.Value, func()) {
+			return load(r, opts)
+		},
+		Name: "proto",
+	}
 }
 
 // load builds the proto package and returns it.
-func load(r *rt.Runtime) (rt.Value, func()) {
+func load(r *rt.Runtime, opts Options) (rt.Value, func()) {
+	setRuntimeOptions(r, &opts)
 	pkg := rt.NewTable()
 	rt.SolemnlyDeclareCompliance(
 		rt.ComplyCpuSafe|rt.ComplyIoSafe|rt.ComplyTimeSafe,
+		r.SetEnvGoFunc(pkg, "bytes", protoBytes, 1, false),
+		r.SetEnvGoFunc(pkg, "client", protoClient, 2, false),
+		r.SetEnvGoFunc(pkg, "descriptor", protoDescriptor, 1, false),
+		r.SetEnvGoFunc(pkg, "diff", protoDiff, 3, false),
+		r.SetEnvGoFunc(pkg, "duration", protoDuration, 1, false),
+		r.SetEnvGoFunc(pkg, "extension", protoExtension, 1, false),
 		r.SetEnvGoFunc(pkg, "new", protoNew, 1, false),
+		r.SetEnvGoFunc(pkg, "pack", protoPack, 1, false),
+		r.SetEnvGoFunc(pkg, "service", protoService, 1, false),
+		r.SetEnvGoFunc(pkg, "timestamp", protoTimestamp, 1, false),
+		r.SetEnvGoFunc(pkg, "to_value", protoToValue, 2, false),
+		r.SetEnvGoFunc(pkg, "uint64", protoUint64, 1, false),
+		r.SetEnvGoFunc(pkg, "write_delimited", protoWriteDelimited, 2, false),
+	)
+	rt.SolemnlyDeclareCompliance(
+		rt.ComplyCpuSafe|rt.ComplyIoSafe|rt.ComplyMemSafe|rt.ComplyTimeSafe,
+		r.SetEnvGoFunc(pkg, "read_delimited", protoReadDelimited, 2, false),
 	)
+	r.SetEnv(pkg, "wire", rt.TableValue(newWireTable(r)))
 	return rt.TableValue(pkg), func() {}
 }
@@ -0,0 +1,48 @@
+-- test proto.pack and Any methods
+do
+  local msg = proto.new("google.protobuf.Duration")
+  msg.seconds = 42
+  local any = proto.pack(msg)
+
+  print(any:FullName())
+  --> =google.protobuf.Any
+  print(any.type_url)
+  --> =type.googleapis.com/google.protobuf.Duration
+  print(any:TypeName())
+  --> =google.protobuf.Duration
+  print(any:Is("google.protobuf.Duration"))
+  --> =true
+  print(any:Is("google.protobuf.Timestamp"))
+  --> =false
+  print(any:Is(msg:Type()))
+  --> =true
+  print(any:Is("type.googleapis.com/google.protobuf.Duration"))
+  --> =true
+
+  local unpacked = any:Unpack()
+  print(unpacked:FullName(), unpacked.seconds)
+  --> =google.protobuf.Duration	42
+  print(unpacked == msg)
+  --> =true
+end
+
+-- test Any error cases
+do
+  local any = proto.new("google.protobuf.Any")
+  print(pcall(any.Unpack, any))
+  --> ~false\t.*has no type URL
+  any.type_url = "type.googleapis.com/no.such.Type"
+  print(pcall(any.Unpack, any))
+  --> ~false\t.*no such message type
+  print(pcall(any.Is, any, "no.such.Type"))
+  --> ~false\t.*no such message type
+  print(pcall(proto.pack, 1))
+  --> ~false\t.*expected message, got number
+end
+
+-- Any methods are not available on other messages
+do
+  local msg = proto.new("google.protobuf.Duration")
+  print(msg.Unpack)
+  --> =nil
+end
@@ -0,0 +1,7 @@
+-- proto.bytes values can be assigned to bytes fields
+do
+  local msg = proto.new("google.protobuf.BytesValue")
+  msg.value = proto.bytes("abc")
+  print(type(msg.value), msg.value)
+  --> =string	abc
+end
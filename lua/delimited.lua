@@ -0,0 +1,94 @@
+-- messages can be marshalled with a length prefix
+do
+  local req = proto.new("golua.test.EchoRequest")
+  req.message = "hi"
+  local s = req:MarshalDelimited()
+  print(#s, #req:Marshal())
+  --> =5	4
+  print(proto.new("golua.test.EchoRequest"):MarshalDelimited() == "\0")
+  --> =true
+end
+
+-- lists of messages can be written and read back
+do
+  local msgs = {}
+  for i = 1, 3 do
+    local req = proto.new("golua.test.EchoRequest")
+    req.message = "m" .. i
+    req.count = i
+    msgs[i] = req
+  end
+  msgs[4] = proto.new("golua.test.EchoRequest")
+  local s = proto.write_delimited(msgs)
+  local concat = ""
+  for _, msg in ipairs(msgs) do
+    concat = concat .. msg:MarshalDelimited()
+  end
+  print(#s == #concat, #s)
+  --> =true	22
+  for msg in proto.read_delimited("golua.test.EchoRequest", s) do
+    print(msg.message, msg.count)
+  end
+  --> =m1	1
+  --> =m2	2
+  --> =m3	3
+  --> =	0
+  print(proto.write_delimited({}) == "")
+  --> =true
+  print(proto.read_delimited(msgs[1]:Type(), "")())
+  --> =nil
+end
+
+-- sources and sinks can be objects with read and write methods
+do
+  local buffer = {data = "", pos = 1}
+  function buffer:write(s)
+    self.data = self.data .. s
+    return self
+  end
+  function buffer:read(n)
+    if self.pos > #self.data then
+      return nil
+    end
+    local s = proto.bytes(self.data):Sub(self.pos, self.pos + n - 1)
+    self.pos = self.pos + #s
+    return s:ToString()
+  end
+  local req = proto.new("golua.test.EchoRequest")
+  req.message = "hello"
+  print(proto.write_delimited({req, req}, buffer) == buffer)
+  --> =true
+  local n = 0
+  local desc = proto.descriptor("golua.test.EchoRequest")
+  for msg in proto.read_delimited(desc, buffer) do
+    print(msg.message)
+    n = n + 1
+  end
+  --> =hello
+  --> =hello
+  print(n)
+  --> =2
+end
+
+-- malformed streams
+do
+  local req = proto.new("golua.test.EchoRequest")
+  req.message = "hello"
+  local s = req:MarshalDelimited()
+  local next = proto.read_delimited("golua.test.EchoRequest", s .. "\7")
+  print(next().message)
+  --> =hello
+  print(pcall(next))
+  --> ~false\t.*unexpected end of delimited message stream
+  print(pcall(proto.read_delimited("golua.test.EchoRequest", "\128")))
+  --> ~false\t.*unexpected end of delimited message stream
+  local long = "\255\255\255\255\255\255\255\255\255\255\1"
+  print(pcall(proto.read_delimited("golua.test.EchoRequest", long)))
+  --> ~false\t.*invalid message size prefix
+  print(pcall(proto.read_delimited("golua.test.EchoRequest", "\128\128\128\4")))
+  --> ~false\t.*message size 8388608 exceeds maximum size 4194304
+  print(pcall(proto.read_delimited, "golua.test.Nope", s))
+  --> ~false\t.*no such message type: golua.test.Nope
+  print(pcall(proto.write_delimited, {req, 42}))
+  --> ~false\t.*message expected at index 2, got number
+end
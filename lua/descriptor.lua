@@ -0,0 +1,57 @@
+-- descriptors can be looked up by full name
+do
+  local md = proto.descriptor("golua.test.Annotated")
+  print(md, md:Name(), md:FullName())
+  --> =golua.test.Annotated	Annotated	golua.test.Annotated
+  print(md == proto.new("golua.test.Annotated"):Descriptor())
+  --> =true
+  print(proto.new(md):FullName())
+  --> =golua.test.Annotated
+  print(pcall(proto.descriptor, "golua.test.Nope"))
+  --> ~false\t.*no such descriptor: golua.test.Nope
+end
+
+-- field descriptors can be used as keys
+do
+  local fd = proto.descriptor("golua.test.Annotated.secret")
+  local msg = proto.new("golua.test.Annotated")
+  msg[fd] = "hush"
+  print(fd:Name(), msg[fd], msg.secret)
+  --> =secret	hush	hush
+end
+
+-- options of all kinds of descriptors
+do
+  local opts = proto.descriptor("golua.test.Annotated"):Options()
+  print(opts:FullName(), opts:IsReadOnly(), opts["golua.test.table"])
+  --> =google.protobuf.MessageOptions	true	annotated
+  print(opts:GetExtension("golua.test.table"))
+  --> =annotated
+  local secret = proto.descriptor("golua.test.Annotated.secret"):Options()
+  local plain = proto.descriptor("golua.test.Annotated.plain"):Options()
+  print(secret["golua.test.sensitive"], plain["golua.test.sensitive"])
+  --> =true	false
+  print(secret.deprecated, plain.deprecated)
+  --> =false	true
+  print(proto.descriptor("golua.test.Annotated.choice"):Options()
+    ["golua.test.choice_hint"])
+  --> =pick one
+  print(proto.descriptor("golua.test.Level"):Options()["golua.test.enum_hint"])
+  --> =levels
+  print(proto.descriptor("golua.test.LEVEL_HIGH"):Options()
+    ["golua.test.display"])
+  --> =High
+  print(proto.descriptor("golua.test.AnnotatedService"):Options()
+    ["golua.test.owner"])
+  --> =team
+  print(proto.descriptor("golua.test.AnnotatedService.Get"):Options()
+    ["golua.test.cacheable"])
+  --> =true
+end
+
+-- options are read-only
+do
+  local opts = proto.descriptor("golua.test.Annotated"):Options()
+  print(pcall(opts.SetExtension, opts, "golua.test.table", "other"))
+  --> ~false\t.*attempt to modify read-only message
+end
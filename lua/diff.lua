@@ -0,0 +1,109 @@
+-- identical messages have no differences
+do
+  local a = proto.new("golua.test.Scalars")
+  a.i32 = 1
+  local b = proto.new("golua.test.Scalars")
+  b.i32 = 1
+  print(#proto.diff(a, b), tostring(proto.diff(a, b)) == "")
+  --> =0	true
+end
+
+-- scalar differences
+do
+  local a = proto.new("golua.test.Scalars")
+  a.i32 = 1
+  a.s = "old"
+  a.e = 1
+  local b = proto.new("golua.test.Scalars")
+  b.i32 = 2
+  b.bs = "new"
+  b.e = 1
+  for _, d in ipairs(proto.diff(a, b)) do
+    print(d.path, d.kind, d.old, d.new)
+  end
+  --> =i32	changed	1	2
+  --> =s	removed	old	nil
+  --> =bs	added	nil	new
+  print(tostring(proto.diff(a, b)))
+  --> =~ i32: 1 -> 2
+  --> =- s: "old"
+  --> =+ bs: "new"
+end
+
+-- nested message differences
+do
+  local a = proto.new("golua.test.Validated")
+  local b = proto.new("golua.test.Validated")
+  local child = proto.new("golua.test.Validated")
+  child.name = "kid"
+  child.color = 1
+  b.child = child
+  print(tostring(proto.diff(a, b)))
+  --> =+ child: {name: "kid", color: RED}
+  a.child = proto.new("golua.test.Validated")
+  a.child.name = "old"
+  local diffs = proto.diff(a, b)
+  print(tostring(diffs))
+  --> =~ child.name: "old" -> "kid"
+  --> =+ child.color: RED
+  print(diffs[2].new)
+  --> =1
+end
+
+-- only messages of the same type can be diffed
+do
+  local a = proto.new("golua.test.Scalars")
+  local b = proto.new("golua.test.Validated")
+  print(pcall(proto.diff, a, b))
+  --> ~false\t.*cannot diff golua.test.Scalars and golua.test.Validated
+  print(pcall(proto.diff, a, 1))
+  --> ~false\t.*cannot diff number
+end
+
+-- lists and maps
+do
+  local a = parse("golua.test.Required", [[
+    id: "root"
+    children: [{id: "x"}, {id: "y"}, {id: "z"}]
+    by_name: [
+      {key: "x" value {id: "xx"}},
+      {key: "y" value {id: "yy"}},
+      {key: "z" value {id: "zz"}}
+    ]
+  ]])
+  local b = parse("golua.test.Required", [[
+    id: "root"
+    children: [{id: "y"}, {id: "z"}, {id: "w"}]
+    by_name: [
+      {key: "y" value {id: "yy"}},
+      {key: "z" value {id: "zz"}},
+      {key: "w" value {id: "ww"}}
+    ]
+  ]])
+  print(tostring(proto.diff(a, b)))
+  --> =~ children[1].id: "x" -> "y"
+  --> =~ children[2].id: "y" -> "z"
+  --> =~ children[3].id: "z" -> "w"
+  --> =- by_name["x"]: {id: "xx"}
+  --> =+ by_name["w"]: {id: "ww"}
+  local keys = {["golua.test.Required.children"] = "id"}
+  local diffs = proto.diff(a, b, {keys = keys})
+  print(tostring(diffs))
+  --> =- children[id="x"]: {id: "x"}
+  --> =+ children[id="w"]: {id: "w"}
+  --> =- by_name["x"]: {id: "xx"}
+  --> =+ by_name["w"]: {id: "ww"}
+  print(diffs[1].old.id, diffs[1].old:IsReadOnly())
+  --> =x	true
+  keys["golua.test.Required.children"] = "nope"
+  print(pcall(proto.diff, a, b, {keys = keys}))
+  --> ~false\t.*invalid key field 'nope'
+  keys["golua.test.Required.children"] = "id"
+  local dup = parse("golua.test.Required", [[
+    id: "root" children: [{id: "x"}, {id: "y"}, {id: "x"}]
+  ]])
+  print(pcall(proto.diff, a, dup, {keys = keys}))
+  --> ~false\t.*duplicate key children\[id="x"\] in list 'golua.test.Required.children'
+  print(pcall(proto.diff, dup, a, {keys = keys}))
+  --> ~false\t.*duplicate key children\[id="x"\]
+end
@@ -0,0 +1,76 @@
+-- msg:Equal without options is exact equality
+do
+  local a = proto.new("golua.test.Scalars")
+  a.i32 = 1
+  a.db = 0.1 + 0.2
+  local b = proto.new("golua.test.Scalars")
+  b.i32 = 1
+  b.db = 0.3
+  print(a:Equal(a), a:Equal(b), a:Equal(proto.new("golua.test.Validated")))
+  --> =true	false	false
+  print(a:Equal(1), a:Equal(nil))
+  --> =false	false
+end
+
+-- floats can be compared within an epsilon
+do
+  local a = proto.new("golua.test.Scalars")
+  a.db = 0.1 + 0.2
+  a.fl = 1.0
+  local b = proto.new("golua.test.Scalars")
+  b.db = 0.3
+  b.fl = 1.001
+  print(a:Equal(b, {epsilon = 1e-9}), a:Equal(b, {epsilon = 0.01}))
+  --> =false	true
+  a.db = 0
+  b.db = 0.0001
+  print(a:Equal(b, {epsilon = 0.01}), #proto.diff(a, b, {epsilon = 0.01}))
+  --> =true	0
+  print(tostring(proto.diff(a, b)))
+  --> =~ fl: 1 -> 1.001
+  --> =+ db: 0.0001
+end
+
+-- NaN values are equal to each other
+do
+  local a = proto.new("golua.test.Scalars")
+  a.db = 0 / 0
+  a.fl = 0 / 0
+  local b = proto.new("golua.test.Scalars")
+  b.db = 0 / 0
+  b.fl = 1
+  print(a:Equal(a), a == a, #proto.diff(a, a), a:Equal(b), a == b)
+  --> =true	true	0	false	false
+  print(tostring(proto.diff(a, b)))
+  --> ~^~ fl: \S*NaN -> 1$
+  print(proto.to_value(0 / 0):Equal(proto.to_value(0 / 0)))
+  --> =true
+end
+
+-- fields can be ignored
+do
+  local a = proto.new("golua.test.Scalars")
+  a.i32 = 1
+  a.s = "a"
+  local b = proto.new("golua.test.Scalars")
+  b.i32 = 1
+  b.s = "b"
+  print(a:Equal(b, {ignore = {"golua.test.Scalars.s"}}))
+  --> =true
+  print(#proto.diff(a, b, {ignore = {"golua.test.Scalars.s"}}))
+  --> =0
+  print(pcall(a.Equal, a, b, {ignore = {1}}))
+  --> ~false\t.*invalid ignored field type number
+end
+
+-- lists can be compared in any order
+do
+  local a = proto.to_value({1, "x", 1}).list_value
+  local b = proto.to_value({"x", 1.0001, 1}).list_value
+  local approx = {unordered = true, epsilon = 0.01}
+  print(a:Equal(b, {unordered = true}), a:Equal(b, approx))
+  --> =false	true
+  print(tostring(proto.diff(a, b, {unordered = true})))
+  --> =- values[3]: {number_value: 1}
+  --> =+ values[2]: {number_value: 1.0001}
+end
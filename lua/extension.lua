@@ -0,0 +1,74 @@
+-- extension fields can be set, read, checked and cleared by name
+do
+  local msg = proto.new("golua.test.Extendable")
+  print(msg:HasExtension("golua.test.ext_i32"),
+    msg:GetExtension("golua.test.ext_i32"))
+  --> =false	0
+  msg:SetExtension("golua.test.ext_i32", 42)
+  msg:SetExtension("golua.test.ext_s", "foo")
+  print(msg:HasExtension("golua.test.ext_i32"),
+    msg:GetExtension("golua.test.ext_i32"))
+  --> =true	42
+  print(msg:GetExtension("golua.test.ext_s"))
+  --> =foo
+  msg:ClearExtension("golua.test.ext_i32")
+  print(msg:HasExtension("golua.test.ext_i32"))
+  --> =false
+  msg:SetExtension("golua.test.ext_s", nil)
+  print(msg:HasExtension("golua.test.ext_s"))
+  --> =false
+end
+
+-- extension types can be looked up and used as keys
+do
+  local xt = proto.extension("golua.test.ext_s")
+  print(xt, xt == proto.extension("golua.test.ext_s"))
+  --> =golua.test.ext_s	true
+  local msg = proto.new("golua.test.Extendable")
+  msg[xt] = "bar"
+  print(msg[xt], msg:GetExtension(xt), msg:HasExtension(xt))
+  --> =bar	bar	true
+  print(pcall(proto.extension, "golua.test.nope"))
+  --> ~false\t.*no such extension: golua.test.nope
+end
+
+-- message extensions
+do
+  local msg = proto.new("golua.test.Extendable")
+  local sub = proto.new("golua.test.Extendable")
+  sub.name = "sub"
+  msg:SetExtension("golua.test.ext_msg", sub)
+  print(msg:GetExtension("golua.test.ext_msg").name)
+  --> =sub
+  local ro = msg:ReadOnly()
+  print(ro:GetExtension("golua.test.ext_msg"):IsReadOnly())
+  --> =true
+  print(pcall(ro.SetExtension, ro, "golua.test.ext_i32", 1))
+  --> ~false\t.*attempt to modify read-only message
+  print(pcall(ro.ClearExtension, ro, "golua.test.ext_msg"))
+  --> ~false\t.*attempt to modify read-only message
+end
+
+-- ranging over populated extensions
+do
+  local msg = proto.new("golua.test.Extendable")
+  msg.name = "not an extension"
+  msg:SetExtension("golua.test.ext_s", "s")
+  msg:SetExtension("golua.test.ext_i32", 7)
+  for xt, v in msg:RangeExtensions() do
+    print(xt, v)
+  end
+  --> =golua.test.ext_i32	7
+  --> =golua.test.ext_s	s
+end
+
+-- extensions must extend the message type
+do
+  local msg = proto.new("golua.test.Scalars")
+  print(pcall(msg.GetExtension, msg, "golua.test.ext_s"))
+  --> ~false\t.*does not extend message type 'golua.test.Scalars'
+  print(pcall(msg.SetExtension, msg, "golua.test.ext_s", "x"))
+  --> ~false\t.*does not extend message type 'golua.test.Scalars'
+  print(msg[proto.extension("golua.test.ext_s")])
+  --> =nil
+end
@@ -73,4 +73,15 @@ do
   --> =true
   print(msg:Has("list_value", "values"))
   --> =false
-end
\ No newline at end of file
+end
+
+-- chained Has test through map values
+do
+  local msg = proto.to_value({a = "foo"}).struct_value
+  print(msg:Has("fields", "a"), msg:Has("fields", "b"))
+  --> =true	false
+  print(msg:Has("fields", "a", "string_value"))
+  --> =true
+  print(msg:Has("fields", "a", "bool_value"))
+  --> =false
+end
@@ -0,0 +1,34 @@
+-- required fields
+do
+  local root = parse("golua.test.Required", [[
+    child {}
+    children {id: "first"}
+    children {}
+    by_name {key: "b" value {}}
+    by_name {key: "a" value {}}
+  ]])
+  local complete = parse("golua.test.Required", [[id: "x"]])
+  print(root:IsInitialized(), complete:IsInitialized())
+  --> =false	true
+  for _, path in ipairs(root:MissingFields()) do
+    print(path)
+  end
+  --> =id
+  --> =child.id
+  --> =children[2].id
+  --> =by_name["a"].id
+  --> =by_name["b"].id
+  print(#complete:MissingFields())
+  --> =0
+end
+
+do -- required fields in groups are checked
+  local grouped = parse("golua.test.Grouped", "Item {} Items {}")
+  print(grouped:IsInitialized())
+  --> =false
+  for _, path in ipairs(grouped:MissingFields()) do
+    print(path)
+  end
+  --> =item.id
+  --> =items[1].id
+end
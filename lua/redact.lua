@@ -0,0 +1,89 @@
+local function person(name)
+  return 'name: "' .. name .. '" email: "' .. name .. '@example.com" ' ..
+    'note: "note" age: 42'
+end
+
+local root = parse("golua.test.Redacted", person("root") ..
+  " child {" .. person("child") .. "}" ..
+  " children {" .. person("first") .. "}" ..
+  ' by_name {key: "a" value {' .. person("a") .. "}}" ..
+  " payload {[type.googleapis.com/golua.test.Redacted] {" ..
+  person("payload") .. "}}")
+
+-- debug_redact fields are cleared
+do
+  local redacted = root:Redacted()
+  print(redacted.name, redacted.email, redacted.note)
+  --> =root		note
+  print(redacted.child.email, redacted.children[1].email)
+  --> =	
+  print(redacted.by_name.a.email, redacted.payload:Unpack().email)
+  --> =	
+  print(root.email, root.children[1].email)
+  --> =root@example.com	first@example.com
+end
+
+-- fields with a custom option are replaced
+do
+  local redacted = root:Redacted({
+    option = "golua.test.sensitive",
+    replacement = "***",
+  })
+  print(redacted.email, redacted.note, redacted.child.note)
+  --> =***	***	***
+  print(pcall(root.Redacted, root, {option = "golua.test.table"}))
+  --> ~false\t.*does not extend message type 'google.protobuf.FieldOptions'
+end
+
+-- fields selected by a predicate are redacted
+do
+  local redacted = root:Redacted({
+    debug_redact = false,
+    predicate = function(fd)
+      if fd:Name() == "age" then
+        return 0
+      end
+      return fd:Name() == "child"
+    end,
+  })
+  print(redacted.email, redacted.age, redacted:Has("child"))
+  --> =root@example.com	0	false
+  print(redacted.children[1].age)
+  --> =0
+end
+
+-- payloads of unknown type are cleared unless kept explicitly
+do
+  local any = proto.new("google.protobuf.Any")
+  any.type_url = "type.googleapis.com/golua.test.Unknown"
+  any.value = "secret"
+  local msg = proto.new("golua.test.Redacted")
+  msg.payload = any
+  local redacted = msg:Redacted()
+  print(redacted.payload.type_url, redacted.payload:Has("value"))
+  --> =type.googleapis.com/golua.test.Unknown	false
+  redacted = msg:Redacted({keep_unresolved_any = true})
+  print(redacted.payload.value)
+  --> =secret
+end
+
+-- tostring shows all fields by default
+do
+  local msg = proto.new("golua.test.Redacted")
+  msg.name, msg.email = "n", "e"
+  print(tostring(msg))
+  --> =golua.test.Redacted{name: "n", email: "e"}
+end
+
+-- fields in groups are redacted
+do
+  local grouped = parse("golua.test.Grouped",
+    [[Item {note: "note"} Items {note: "note"}]])
+  local redacted = grouped:Redacted({
+    predicate = function(fd) return fd:Name() == "note" end,
+  })
+  print(redacted.item:Has("note"), redacted.items[1]:Has("note"))
+  --> =false	false
+  print(grouped.item.note, grouped.items[1].note)
+  --> =note	note
+end
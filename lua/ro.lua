@@ -11,14 +11,16 @@ do
   msg = msg:ReadOnly()
   print(msg:IsReadOnly())
   --> =true
-  setField(msg)
+  print(pcall(setField, msg))
+  --> ~false\t.*attempt to modify read-only message
   print(msg.seconds)
   --> =1
 
   msg = msg:ReadOnly()
   print(msg:IsReadOnly())
   --> =true
-  setField(msg)
+  print(pcall(setField, msg))
+  --> ~false\t.*attempt to modify read-only message
   print(msg.seconds)
   --> =1
 end
@@ -37,4 +39,36 @@ do
 
   print(fields:IsReadOnly())
   --> =true
-end
\ No newline at end of file
+end
+-- writes to read-only lists and maps are errors
+do
+  local msg = proto.new("google.protobuf.Struct")
+  print(pcall(function() msg.fields.x = 1 end))
+  --> ~false\t.*attempt to modify read-only map
+  local list = proto.new("google.protobuf.ListValue")
+  print(pcall(function() list.values[1] = 1 end))
+  --> ~false\t.*attempt to modify read-only list
+end
+
+-- read-only values are copied on assignment
+do
+  local frozen = proto.new("golua.test.Validated")
+  frozen.child = proto.new("golua.test.Validated")
+  frozen.child.name = "frozen"
+  frozen = frozen:ReadOnly()
+  local msg = proto.new("golua.test.Validated")
+  msg.child = frozen.child
+  msg.child.name = "changed"
+  print(frozen.child.name, msg.child.name, msg.child:IsReadOnly())
+  --> =frozen	changed	false
+
+  local ext = proto.new("golua.test.Extendable")
+  ext:SetExtension("golua.test.ext_msg", proto.new("golua.test.Extendable"))
+  ext = ext:ReadOnly()
+  local other = proto.new("golua.test.Extendable")
+  local sub = ext:GetExtension("golua.test.ext_msg")
+  other:SetExtension("golua.test.ext_msg", sub)
+  other:GetExtension("golua.test.ext_msg").name = "x"
+  print(ext:GetExtension("golua.test.ext_msg").name)
+  --> =
+end
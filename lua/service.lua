@@ -0,0 +1,40 @@
+-- services can be looked up by full name
+do
+  local svc = proto.service("golua.test.Echo")
+  print(svc, svc:Name(), svc:FullName())
+  --> =golua.test.Echo	Echo	golua.test.Echo
+  print(svc == proto.descriptor("golua.test.Echo"))
+  --> =true
+  print(svc:Options()["golua.test.owner"])
+  --> =echo team
+  print(pcall(proto.service, "golua.test.Nope"))
+  --> ~false\t.*no such service: golua.test.Nope
+  print(pcall(proto.service, "golua.test.EchoRequest"))
+  --> ~false\t.*no such service: golua.test.EchoRequest
+end
+
+-- methods of services
+do
+  local svc = proto.service("golua.test.Echo")
+  for _, method in ipairs(svc:Methods()) do
+    print(method:Name(), method:IsClientStreaming(), method:IsServerStreaming())
+  end
+  --> =Say	false	false
+  --> =Repeat	false	true
+  --> =Collect	true	false
+  --> =Chat	true	true
+  local say = svc:Method("Say")
+  print(say, say:Service() == svc, svc:Method("Nope"))
+  --> =golua.test.Echo.Say	true	nil
+  print(say:Options()["golua.test.cacheable"])
+  --> =true
+end
+
+-- input and output types of methods
+do
+  local say = proto.service("golua.test.Echo"):Method("Say")
+  print(say:Input() == proto.new("golua.test.EchoRequest"):Type())
+  --> =true
+  print(proto.new(say:Output()):FullName())
+  --> =golua.test.EchoResponse
+end
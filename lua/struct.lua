@@ -0,0 +1,82 @@
+-- test proto.to_value with scalars
+do
+  print(proto.to_value(nil):Has("null_value"))
+  --> =true
+  print(proto.to_value(true).bool_value)
+  --> =true
+  print(proto.to_value(3).number_value)
+  --> =3
+  print(proto.to_value(2.5).number_value)
+  --> =2.5
+  print(proto.to_value("foo").string_value)
+  --> =foo
+  print(pcall(proto.to_value, print))
+  --> ~false\t.*cannot convert function to google.protobuf.Value
+end
+
+-- test proto.to_value with tables
+do
+  local v = proto.to_value({1, "two", {three = 3}})
+  print(v:Has("list_value"), #v.list_value.values)
+  --> =true	3
+  print(v.list_value.values[2].string_value)
+  --> =two
+  print(v.list_value.values[3].struct_value.fields.three.number_value)
+  --> =3
+
+  v = proto.to_value({})
+  print(v:Has("struct_value"))
+  --> =true
+  v = proto.to_value({}, {empty = "array"})
+  print(v:Has("list_value"))
+  --> =true
+
+  print(pcall(proto.to_value, {1, 2, x = 3}))
+  --> ~false\t.*neither an array nor an object
+  print(pcall(proto.to_value, {[1] = 1, [3] = 3}))
+  --> ~false\t.*neither an array nor an object
+  v = proto.to_value({1, 2, x = 3}, {mixed = "object"})
+  print(v.struct_value.fields["1"].number_value, v.struct_value.fields.x.number_value)
+  --> =1	3
+  print(pcall(proto.to_value, {[true] = 1}))
+  --> ~false\t.*cannot convert table with boolean key
+  print(pcall(proto.to_value, {}, {mixed = "maybe"}))
+  --> ~false\t.*invalid mixed table policy 'maybe'
+
+  local cyclic = {}
+  cyclic.self = cyclic
+  print(pcall(proto.to_value, cyclic))
+  --> ~false\t.*cannot convert table with cycles
+  local shared = {1}
+  v = proto.to_value({a = shared, b = shared})
+  print(#v.struct_value.fields.a.list_value.values)
+  --> =1
+end
+
+-- test ToLua
+do
+  local t = proto.to_value({name = "x", tags = {"a", "b"}, n = 1.5, ok = false}):ToLua()
+  print(t.name, t.tags[1], t.tags[2], #t.tags, t.n, t.ok)
+  --> =x	a	b	2	1.5	false
+
+  local v = proto.to_value({1, proto.to_value(nil), 3})
+  local null = {}
+  local l = v.list_value:ToLua(null)
+  print(l[1], l[2] == null, l[3])
+  --> =1	true	3
+  print(v.list_value:ToLua()[2])
+  --> =nil
+
+  print(proto.new("google.protobuf.Value"):ToLua())
+  --> =nil
+  print(proto.new("google.protobuf.Struct"):ToLua() ~= nil)
+  --> =true
+end
+
+-- messages nest into values
+do
+  local inner = proto.to_value({x = 1}).struct_value
+  local v = proto.to_value({inner = inner})
+  print(v.struct_value.fields.inner.struct_value.fields.x.number_value)
+  --> =1
+end
@@ -0,0 +1,137 @@
+-- test timestamp conversions
+do
+  local ts = proto.timestamp(86400)
+  print(ts:FullName(), ts.seconds, ts.nanos)
+  --> =google.protobuf.Timestamp	86400	0
+  print(ts:Unix())
+  --> =86400
+  local d = ts:Date()
+  print(d.year, d.month, d.day, d.hour, d.min, d.sec, d.wday, d.yday, d.isdst)
+  --> =1970	1	2	0	0	0	6	2	false
+
+  ts = proto.timestamp({year = 2023, month = 1, day = 31})
+  print(ts.seconds)
+  --> =1675166400
+  ts = proto.timestamp({year = 2023, month = 1, day = 31, hour = 0})
+  print(ts.seconds)
+  --> =1675123200
+
+  ts = proto.timestamp(1.5)
+  print(ts.seconds, ts.nanos, ts:Unix())
+  --> =1	500000000	1.5
+  ts = proto.timestamp(-1.5)
+  print(ts.seconds, ts.nanos)
+  --> =-2	500000000
+
+  ts = proto.timestamp("2023-01-31T12:00:00.25Z")
+  print(ts.seconds, ts.nanos)
+  --> =1675166400	250000000
+
+  print(pcall(proto.timestamp, {year = 2023}))
+  --> ~false\t.*required field 'month' missing
+  print(pcall(proto.timestamp, 1e300))
+  --> ~false\t.*out of range
+  ts = proto.timestamp(253402300799.5)
+  print(ts.seconds, ts.nanos)
+  --> =253402300799	500000000
+  print(pcall(proto.timestamp, 253402300800))
+  --> ~false\t.*timestamp out of range
+end
+
+-- test duration conversions
+do
+  local d = proto.duration("1h30m")
+  print(d:FullName(), d.seconds, d.nanos)
+  --> =google.protobuf.Duration	5400	0
+  print(d:Seconds(), d:String())
+  --> =5400	1h30m0s
+  d = proto.duration(-1.25)
+  print(d.seconds, d.nanos, d:Seconds(), d:String())
+  --> =-1	-250000000	-1.25	-1.25s
+  print(pcall(proto.duration, "soon"))
+  --> ~false\t.*invalid duration
+  d = proto.duration(-315576000000.0)
+  print(d.seconds, d.nanos, d:String())
+  --> =-315576000000	0	-315576000000s
+  d = proto.duration(315576000000.25)
+  print(d.seconds, d.nanos, d:String())
+  --> =315576000000	250000000	315576000000.25s
+  print(pcall(proto.duration, 315576000001.0))
+  --> ~false\t.*out of range
+end
+
+-- test arithmetic
+do
+  local ts = proto.timestamp(100.75)
+  local d = proto.duration(0.5)
+
+  local later = ts + d
+  print(later:FullName(), later.seconds, later.nanos)
+  --> =google.protobuf.Timestamp	101	250000000
+  later = d + ts
+  print(later.seconds, later.nanos)
+  --> =101	250000000
+  later = ts + 3600
+  print(later.seconds, later.nanos)
+  --> =3700	750000000
+
+  local earlier = ts - d
+  print(earlier.seconds, earlier.nanos)
+  --> =100	250000000
+  earlier = ts - 101
+  print(earlier.seconds, earlier.nanos)
+  --> =-1	750000000
+
+  local diff = later - ts
+  print(diff:FullName(), diff:Seconds())
+  --> =google.protobuf.Duration	3600
+  diff = ts - later
+  print(diff.seconds, diff.nanos)
+  --> =-3600	0
+
+  local sum = d + d + 1
+  print(sum:FullName(), sum.seconds, sum.nanos)
+  --> =google.protobuf.Duration	2	0
+  local neg = d - proto.duration(0.75)
+  print(neg.seconds, neg.nanos)
+  --> =0	-250000000
+  neg = 1 - proto.duration(1.75)
+  print(neg.seconds, neg.nanos)
+  --> =0	-750000000
+
+  print(pcall(function() return ts + ts end))
+  --> ~false\t.*cannot add two timestamps
+  print(pcall(function() return d - ts end))
+  --> ~false\t.*cannot subtract google.protobuf.Timestamp from google.protobuf.Duration
+  print(pcall(function() return ts + proto.new("google.protobuf.Any") end))
+  --> ~false\t.*cannot add google.protobuf.Timestamp and google.protobuf.Any
+end
+
+-- test comparisons
+do
+  local ts1 = proto.timestamp(100)
+  local ts2 = proto.timestamp(100.5)
+  print(ts1 < ts2, ts1 <= ts2, ts2 < ts1, ts2 <= ts1, ts1 <= ts1)
+  --> =true	true	false	false	true
+
+  local d1 = proto.duration(-0.5)
+  local d2 = proto.duration(1)
+  print(d1 < d2, d2 < d1, d1 < 0, d2 <= 1, 2 < d2)
+  --> =true	false	true	true	false
+
+  print(pcall(function() return ts1 < d1 end))
+  --> ~false\t.*cannot compare google.protobuf.Timestamp with google.protobuf.Duration
+end
+
+-- other messages keep the standard arithmetic and comparison errors
+do
+  local any = proto.new("google.protobuf.Any")
+  print(pcall(function() return any + 1 end))
+  --> ~false\t.*attempt to perform arithmetic on a userdata value
+  print(pcall(function() return any - any end))
+  --> ~false\t.*attempt to sub a 'userdata' with a 'userdata'
+  print(pcall(function() return any < any end))
+  --> ~false\t.*attempt to compare a userdata value with a userdata value
+  print(pcall(function() return 1 <= any end))
+  --> ~false\t.*attempt to compare a number value with a userdata value
+end
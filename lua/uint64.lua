@@ -0,0 +1,83 @@
+-- uint64 values beyond the int64 range are preserved
+do
+  local msg = proto.new("google.protobuf.UInt64Value")
+  msg.value = proto.uint64("18446744073709551615")
+  print(msg.value)
+  --> =18446744073709551615
+  local max = msg.value
+  print(max == proto.uint64("18446744073709551615"))
+  --> =true
+  print(max > 0, max > -1, max < 1, max > 9223372036854775807, max >= max)
+  --> =true	true	false	true	true
+  print(max + 1, max + 2, max - max, max // 2, max % 10, max * 1)
+  --> =0	1	0	9223372036854775807	5	18446744073709551615
+  print(max - 1)
+  --> =18446744073709551614
+  print(max / 2 > 9e18, max + 0.0 > 1.8e19)
+  --> =true	true
+  print("id:" .. max, max .. "!")
+  --> =id:18446744073709551615	18446744073709551615!
+
+  local big = proto.uint64("9223372036854775808")
+  print(big, big - 1, big - 1 == 9223372036854775807)
+  --> =9223372036854775808	9223372036854775807	true
+  msg.value = big
+  print(msg.value == big, msg.value)
+  --> =true	9223372036854775808
+
+  print(pcall(function() return max // 0 end))
+  --> ~false\t.*attempt to perform 'n//0'
+  print(pcall(function() return max + {} end))
+  --> ~false\t.*cannot add uint64 and table
+  print(pcall(function() return max < "1" end))
+  --> ~false\t.*cannot compare uint64 with string
+end
+
+-- assignment is range checked
+do
+  local msg = proto.new("golua.test.Scalars")
+  print(pcall(function() msg.u64 = -1 end))
+  --> ~false\t.*uint64 field out of bounds: -1
+  print(pcall(function() msg.fx64 = -1 end))
+  --> ~false\t.*fixed64 field out of bounds: -1
+  print(pcall(function() msg.i64 = proto.uint64("18446744073709551615") end))
+  --> ~false\t.*int64 field out of bounds: 18446744073709551615
+  msg.fx64 = proto.uint64("18446744073709551615")
+  print(msg.fx64)
+  --> =18446744073709551615
+  msg.db = proto.uint64("9223372036854775808")
+  print(msg.db)
+  --> =9.223372036854776e+18
+end
+
+-- proto.uint64 argument checks
+do
+  print(proto.uint64(5), proto.uint64("5"))
+  --> =5	5
+  print(pcall(proto.uint64, -1))
+  --> ~false\t.*out of bounds
+  print(pcall(proto.uint64, "18446744073709551616"))
+  --> ~false\t.*value out of range
+  print(pcall(proto.uint64, "0x10"))
+  --> ~false\t.*invalid syntax
+  print(pcall(proto.uint64, "1_000"))
+  --> ~false\t.*invalid syntax
+end
+
+-- map keys beyond the int64 range
+do
+  local msg = parse("golua.test.Scalars", [[
+    u64map {key: 1 value: "one"}
+    u64map {key: 18446744073709551615 value: "max"}
+  ]])
+  local m = msg.u64map
+  local max = proto.uint64("18446744073709551615")
+  print(m[1], m[max], m[-1], m:Has(max), m:Has(-1))
+  --> =one	max	nil	true	false
+  local keys = {}
+  for k, v in m:Range() do
+    keys[v] = k
+  end
+  print(keys.one, keys.max, keys.max == max)
+  --> =1	18446744073709551615	true
+end
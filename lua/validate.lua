@@ -0,0 +1,65 @@
+-- valid messages have no violations
+do
+  local msg = proto.new("golua.test.Validated")
+  msg.name = "bob"
+  msg.age = 42
+  msg.email = "bob@example.com"
+  msg.color = 1
+  print(#msg:Validate())
+  --> =0
+end
+
+-- violated field rules are reported with their paths
+do
+  local msg = proto.new("golua.test.Validated")
+  msg.name = "Bobby Tables"
+  msg.age = 200
+  msg.color = 0
+  for _, v in ipairs(msg:Validate()) do
+    print(v.path, v.rule, v.message)
+  end
+  --> =name	max_len	12 characters is more than maximum 5
+  --> =name	pattern	value does not match pattern '^[a-z]+$'
+  --> =age	max	value 200 is more than maximum 150
+  --> =email	required	field is required
+  --> =color	not_in	value 'COLOR_UNSPECIFIED' is not allowed
+end
+
+-- nested messages and message constraints are validated
+do
+  local msg = proto.new("golua.test.Validated")
+  msg.email = "a@b"
+  msg.age = 30
+  msg.color = 1
+  local child = proto.new("golua.test.Validated")
+  child.email = "kid@example.com"
+  child.age = 10
+  child.color = 1
+  child.name = "x"
+  msg.child = child
+  for _, v in ipairs(msg:Validate()) do
+    print(v.path, v.rule, v.message)
+  end
+  --> =child.name	min_len	1 characters is less than minimum 2
+  --> =child	expr	minors must not have an email address
+end
+
+-- list constraints are validated
+do
+  local msg = parse("golua.test.Validated", [[
+    email: "x@y" age: 20 color: RED tags: ["a", "d", "a", "b"]
+  ]])
+  for _, v in ipairs(msg:Validate()) do
+    print(v.path, v.rule, v.message)
+  end
+  --> =tags	max_len	4 items is more than maximum 3
+  --> =tags[2]	in	value 'd' is not in the allowed set
+  --> =tags[3]	unique	duplicate item
+end
+
+-- constraints only see msg and safe builtins
+do
+  local msg = proto.new("golua.test.Sandboxed")
+  print(#msg:Validate(), #msg:Validate(), leaked)
+  --> =0	0	nil
+end
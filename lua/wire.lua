@@ -0,0 +1,111 @@
+-- wire-format bytes can be decoded field by field
+do
+  local req = proto.new("golua.test.EchoRequest")
+  req.count = 150
+  for num, typ, value in proto.wire.decode(req:Marshal()) do
+    print(num, typ, value)
+  end
+  --> =2	varint	150
+  req.count = -1
+  for num, typ, value in proto.wire.decode(req:Marshal()) do
+    print(num, typ, value)
+  end
+  --> =2	varint	18446744073709551615
+  print(proto.wire.decode("")())
+  --> =nil
+end
+
+-- fields can be encoded and decoded again
+do
+  local b = proto.wire.encode({
+    {number = 1, type = "varint", value = 1},
+    {number = 2, type = "fixed32", value = -1},
+    {number = 3, type = "fixed64", value = proto.uint64("18446744073709551615")},
+    {number = 4, type = "bytes", value = "abc"},
+    {number = 5, type = "fixed32", value = 1.5},
+    {number = 6, type = "varint", value = true},
+  })
+  for num, typ, value in proto.wire.decode(b) do
+    print(num, typ, value)
+  end
+  --> =1	varint	1
+  --> =2	fixed32	4294967295
+  --> =3	fixed64	18446744073709551615
+  --> =4	bytes	abc
+  --> =5	fixed32	1069547520
+  --> =6	varint	1
+end
+
+-- length-delimited values and groups can be nested
+do
+  local b = proto.wire.encode({
+    {number = 1, type = "bytes", value = {
+      {number = 1, type = "bytes", value = "hello"},
+      {number = 2, type = "varint", value = 3},
+    }},
+    {number = 2, type = "group", value = {
+      {number = 3, type = "varint", value = 4},
+    }},
+  })
+  for num, typ, value in proto.wire.decode(b) do
+    print(num, typ)
+    for num, typ, value in proto.wire.decode(value) do
+      print("", num, typ, value)
+    end
+  end
+  --> =1	bytes
+  --> =	1	bytes	hello
+  --> =	2	varint	3
+  --> =2	group
+  --> =	3	varint	4
+  local next = proto.wire.decode(b)
+  local _, _, value = next()
+  print(proto.bytes(value) == proto.bytes(proto.wire.encode({
+    {number = 1, type = "bytes", value = "hello"},
+    {number = 2, type = "varint", value = 3},
+  })))
+  --> =true
+end
+
+-- malformed input
+do
+  print(pcall(proto.wire.decode("\8")))
+  --> ~false\t.*unexpected EOF
+  print(pcall(proto.wire.decode("\15")))
+  --> ~false\t.*unexpected wire type 7 for field 1
+  print(pcall(proto.wire.decode, 42))
+  --> ~false\t.*string expected, got number
+  print(pcall(proto.wire.encode, {{number = 0, type = "varint", value = 1}}))
+  --> ~false\t.*field 1: invalid field number 0
+  print(pcall(proto.wire.encode, {{number = 1, type = "nope", value = 1}}))
+  --> ~false\t.*field 1: invalid wire type 'nope'
+  local big = {number = 1, type = "fixed32", value = 4294967296}
+  print(pcall(proto.wire.encode, {big}))
+  --> ~false\t.*fixed32 value out of bounds
+  print(pcall(proto.wire.encode, {{number = 1, type = "varint", value = "x"}}))
+  --> ~false\t.*integer expected, got string
+  print(pcall(proto.wire.encode, {{number = 1, type = "bytes", value = 1}}))
+  --> ~false\t.*string or list of fields expected, got number
+  print(pcall(proto.wire.encode, {1}))
+  --> ~false\t.*field 1: table expected, got number
+end
+
+-- nested lists of fields must not contain cycles or nest too deeply
+do
+  local f = {number = 1, type = "bytes"}
+  f.value = {f}
+  print(pcall(proto.wire.encode, {f}))
+  --> ~false\t.*cannot encode list of fields with cycles
+  local fields = {}
+  for i = 1, 10001 do
+    fields = {{number = 1, type = "bytes", value = fields}}
+  end
+  print(pcall(proto.wire.encode, fields))
+  --> ~false\t.*list of fields nested too deeply
+  fields = {}
+  for i = 1, 9999 do
+    fields = {{number = 1, type = "bytes", value = fields}}
+  end
+  print(#proto.wire.encode(fields) > 0)
+  --> =true
+end
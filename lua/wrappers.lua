@@ -0,0 +1,8 @@
+-- without UnwrapWrappers, wrapper fields are messages
+do
+  local msg = proto.new("golua.test.Wrappers")
+  print(msg.i64:FullName(), msg.i64.value)
+  --> =google.protobuf.Int64Value	0
+  print(pcall(function() msg.i64 = 1 end))
+  --> ~false\t.*expected userdata, got number
+end
@@ -1,23 +1,1085 @@
 package proto_test
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	proto "github.com/TheCount/golua-proto"
 	"github.com/arnodel/golua/lib"
 	"github.com/arnodel/golua/lib/base"
+	"github.com/arnodel/golua/lib/coroutine"
+	"github.com/arnodel/golua/lib/iolib"
 	"github.com/arnodel/golua/lib/packagelib"
 	"github.com/arnodel/golua/luatesting"
 	rt "github.com/arnodel/golua/runtime"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/encoding/protowire"
+	gproto "google.golang.org/protobuf/proto"
+	pr "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/anypb"
 	_ "google.golang.org/protobuf/types/known/durationpb"
-	_ "google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/structpb"
 	_ "google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 // TestProtoLib runs all Lua tests in the proto library.
 func TestProtoLib(t *testing.T) {
 	luatesting.RunLuaTestsInDir(t, "lua", func(r *rt.Runtime) func() {
-		return lib.LoadLibs(r,
-			base.LibLoader, packagelib.LibLoader, proto.LibLoader)
+		return loadTestLibs(r, proto.Options{})
 	})
 }
+
+// TestProtoLibOptions runs the Lua tests for non-default options.
+func TestProtoLibOptions(t *testing.T) {
+	for dir, opts := range map[string]proto.Options{
+		"luaopts/bytes":   {BytesUserData: true},
+		"luaopts/lenient": {NumberConversion: proto.NumberConversionLenient},
+		"luaopts/redact":  {RedactToString: true},
+		"luaopts/strict":  {NumberConversion: proto.NumberConversionStrict},
+		"luaopts/unwrap":  {UnwrapWrappers: true},
+	} {
+		opts := opts
+		luatesting.RunLuaTestsInDir(t, dir, func(r *rt.Runtime) func() {
+			return loadTestLibs(r, opts)
+		})
+	}
+}
+
+// loadTestLibs loads the libraries needed by the Lua tests into r, with the
+// proto package configured with opts. It also sets the global function
+// parse, which returns a message of the type given by full name, parsed from
+// protobuf text format.
+func loadTestLibs(r *rt.Runtime, opts proto.Options) func() {
+	cleanup := lib.LoadLibs(r,
+		base.LibLoader, packagelib.LibLoader, proto.NewLibLoader(opts))
+	r.SetEnvGoFunc(r.GlobalEnv(), "parse", luaParse, 2, false)
+	return cleanup
+}
+
+// luaParse implements the parse function of the Lua tests.
+func luaParse(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	if err := c.CheckNArgs(2); err != nil {
+		return nil, err
+	}
+	name, err := c.StringArg(0)
+	if err != nil {
+		return nil, err
+	}
+	text, err := c.StringArg(1)
+	if err != nil {
+		return nil, err
+	}
+	rmsg, err := unmarshalText(name, text)
+	if err != nil {
+		return nil, err
+	}
+	return c.PushingNext1(t.Runtime, proto.Wrap(rmsg.Interface())), nil
+}
+
+// unmarshalText returns a message of the type with the given full name,
+// parsed from protobuf text format. Required fields may be missing.
+func unmarshalText(name, text string) (pr.Message, error) {
+	mt, err := protoregistry.GlobalTypes.FindMessageByName(pr.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	rmsg := mt.New()
+	err = prototext.UnmarshalOptions{AllowPartial: true}.Unmarshal(
+		[]byte(text), rmsg.Interface())
+	if err != nil {
+		return nil, err
+	}
+	return rmsg, nil
+}
+
+// requiredTree is a golua.test.Required message in protobuf text format with
+// a child, a list element and a map value.
+const requiredTree = `
+	id: "root"
+	child {id: "child"}
+	children {id: "first"}
+	by_name {key: "a" value {id: "a"}}
+`
+
+// parseMessage returns a message of the type with the given full name,
+// parsed from protobuf text format.
+func parseMessage(t *testing.T, name, text string) pr.Message {
+	rmsg, err := unmarshalText(name, text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rmsg
+}
+
+// runLuaTest runs the Lua test source with the given global variables set.
+func runLuaTest(t *testing.T, source string, globals map[string]rt.Value) {
+	runLuaTestOptions(t, proto.Options{}, source, globals)
+}
+
+// runLuaTestOptions runs the Lua test source with the given global variables
+// set and the proto package configured with opts.
+func runLuaTestOptions(
+	t *testing.T, opts proto.Options, source string, globals map[string]rt.Value,
+) {
+	err := luatesting.RunLuaTest([]byte(source), func(r *rt.Runtime) func() {
+		cleanup := loadTestLibs(r, opts)
+		for name, value := range globals {
+			r.SetEnv(r.GlobalEnv(), name, value)
+		}
+		return cleanup
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// newTestRuntime returns a new Lua runtime with the proto package loaded.
+func newTestRuntime(t *testing.T) *rt.Runtime {
+	r := rt.New(io.Discard)
+	t.Cleanup(loadTestLibs(r, proto.Options{}))
+	return r
+}
+
+// evalLua runs the Lua chunk source in r and returns its result.
+func evalLua(t *testing.T, r *rt.Runtime, source string) rt.Value {
+	chunk, err := r.CompileAndLoadLuaChunk(
+		"test", []byte(source), rt.TableValue(r.GlobalEnv()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret, err := rt.Call1(r.MainThread(), rt.FunctionValue(chunk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+// echoService returns the golua.test.Echo service descriptor.
+func echoService(t *testing.T) pr.ServiceDescriptor {
+	sd, err := protoregistry.GlobalFiles.FindDescriptorByName("golua.test.Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sd.(pr.ServiceDescriptor)
+}
+
+// TestBytesUserDataCopy tests that assigning bytes user data copies the
+// bytes.
+func TestBytesUserDataCopy(t *testing.T) {
+	src := wrapperspb.Bytes([]byte("abc"))
+	dst := new(wrapperspb.BytesValue)
+	runLuaTestOptions(t, proto.Options{BytesUserData: true}, `
+dst.value = src.value
+print(dst.value)
+--> =abc
+`, map[string]rt.Value{
+		"dst": proto.Wrap(dst),
+		"src": proto.Wrap(src),
+	})
+	src.Value[0] = 'x'
+	if string(dst.Value) != "abc" {
+		t.Errorf("bytes shared with the source: %q", dst.Value)
+	}
+}
+
+// TestUnknownFields tests the inspection and removal of unknown fields.
+func TestUnknownFields(t *testing.T) {
+	var unknown []byte
+	unknown = protowire.AppendTag(unknown, 100, protowire.VarintType)
+	unknown = protowire.AppendVarint(unknown, math.MaxUint64)
+	unknown = protowire.AppendTag(unknown, 101, protowire.Fixed32Type)
+	unknown = protowire.AppendFixed32(unknown, 32)
+	unknown = protowire.AppendTag(unknown, 102, protowire.Fixed64Type)
+	unknown = protowire.AppendFixed64(unknown, 64)
+	unknown = protowire.AppendTag(unknown, 103, protowire.BytesType)
+	unknown = protowire.AppendString(unknown, "raw")
+	unknown = protowire.AppendTag(unknown, 104, protowire.StartGroupType)
+	unknown = protowire.AppendTag(unknown, 1, protowire.VarintType)
+	unknown = protowire.AppendVarint(unknown, 1)
+	unknown = protowire.AppendTag(unknown, 104, protowire.EndGroupType)
+	outer := &wrapperspb.Int64Value{Value: 1}
+	outer.ProtoReflect().SetUnknown(unknown)
+	any, err := anypb.New(outer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nested := &structpb.ListValue{Values: []*structpb.Value{
+		structpb.NewNullValue(),
+		structpb.NewStringValue("x"),
+	}}
+	nested.Values[1].ProtoReflect().SetUnknown(unknown[:3])
+	grouped := parseMessage(t, "golua.test.Grouped", "Item {} Items {}")
+	grouped.Range(func(fd pr.FieldDescriptor, v pr.Value) bool {
+		if fd.IsList() {
+			v.List().Get(0).Message().SetUnknown(unknown[:3])
+		} else {
+			v.Message().SetUnknown(unknown[:3])
+		}
+		return true
+	})
+	runLuaTest(t, `
+for _, f in ipairs(outer:UnknownFields()) do
+  print(f.number, f.type, f.value)
+end
+--> =100	varint	18446744073709551615
+--> =101	fixed32	32
+--> =102	fixed64	64
+--> =103	bytes	raw
+--> =104	group	`+"\b\x01"+`
+print(outer:HasUnknown(), any:HasUnknown(), #any:UnknownFields())
+--> =true	false	0
+print(nested:HasUnknown(), #nested:UnknownFields())
+--> =true	0
+print(pcall(nested:ReadOnly().DiscardUnknown, nested:ReadOnly()))
+--> ~false\t.*attempt to modify read-only message
+nested:DiscardUnknown()
+print(nested:HasUnknown(), nested.values[2].string_value)
+--> =false	x
+outer:DiscardUnknown()
+print(outer:HasUnknown(), #outer:UnknownFields(), outer.value)
+--> =false	0	1
+print(grouped:HasUnknown(), grouped.items[1]:HasUnknown())
+--> =true	true
+grouped.item:DiscardUnknown()
+print(grouped:HasUnknown())
+--> =true
+grouped:DiscardUnknown()
+print(grouped:HasUnknown(), grouped.items[1]:HasUnknown())
+--> =false	false
+`, map[string]rt.Value{
+		"any":     proto.Wrap(any),
+		"grouped": proto.Wrap(grouped.Interface()),
+		"nested":  proto.Wrap(nested),
+		"outer":   proto.Wrap(outer),
+	})
+}
+
+// TestValidate tests validation from Go.
+func TestValidate(t *testing.T) {
+	rmsg := parseMessage(t, "golua.test.Validated", `
+		email: "x@y" age: 20 color: RED tags: ["a", "d", "a", "b"]
+	`)
+	th := rt.New(nil).MainThread()
+	violations, err := proto.Validate(th, proto.Wrap(rmsg.Interface()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 3 || violations[2].Path != "tags[3]" ||
+		violations[2].Rule != "unique" {
+		t.Errorf("unexpected violations: %v", violations)
+	}
+	if _, err = proto.Validate(th, rt.IntValue(1)); err == nil {
+		t.Error("expected error validating a non-message")
+	}
+	if err = proto.RegisterValidateSchema(); err == nil {
+		t.Error("expected error registering the validation schema twice")
+	}
+}
+
+// TestDiff tests diffing from Go.
+func TestDiff(t *testing.T) {
+	a := parseMessage(t, "golua.test.Required", `
+		id: "root" children: [{id: "x"}, {id: "y"}, {id: "z"}]
+	`)
+	b := parseMessage(t, "golua.test.Required", `
+		id: "root" children: [{id: "y"}, {id: "z"}, {id: "w"}]
+	`)
+	diffs, err := proto.Diff(a.Interface(), b.Interface(), &proto.DiffOptions{
+		ListKeys: map[pr.FullName]pr.Name{"golua.test.Required.children": "id"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 2 || diffs[0].Kind != proto.DiffRemoved ||
+		diffs[1].String() != `+ children[id="w"]: {id: "w"}` {
+		t.Errorf("unexpected differences: %v", diffs)
+	}
+	a = parseMessage(t, "golua.test.Grouped", `Items {id: "x"} Items {id: "y"}`)
+	b = parseMessage(t, "golua.test.Grouped", `Items {id: "y"} Items {id: "z"}`)
+	diffs, err = proto.Diff(a.Interface(), b.Interface(),
+		&proto.DiffOptions{
+			ListKeys: map[pr.FullName]pr.Name{"golua.test.Grouped.items": "id"},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 2 || diffs[0].Path != `items[id="x"]` ||
+		diffs[1].Path != `items[id="z"]` {
+		t.Errorf("unexpected group differences: %v", diffs)
+	}
+}
+
+// TestEqual tests equality from Go and the comparison of unknown fields.
+func TestEqual(t *testing.T) {
+	a := &structpb.ListValue{Values: []*structpb.Value{
+		structpb.NewNumberValue(1),
+		structpb.NewStringValue("x"),
+		structpb.NewNumberValue(1),
+	}}
+	b := &structpb.ListValue{Values: []*structpb.Value{
+		structpb.NewStringValue("x"),
+		structpb.NewNumberValue(1.0001),
+		structpb.NewNumberValue(1),
+	}}
+	c := &structpb.ListValue{Values: []*structpb.Value{
+		structpb.NewStringValue("x"),
+		structpb.NewNumberValue(1),
+		structpb.NewNumberValue(1),
+	}}
+	c.ProtoReflect().SetUnknown(protowire.AppendVarint(
+		protowire.AppendTag(nil, 99, protowire.VarintType), 1))
+	runLuaTest(t, `
+local known = {unordered = true, ignore_unknown = true}
+print(a:Equal(c, {unordered = true}), a:Equal(c, known))
+--> =false	true
+print(tostring(proto.diff(a, c, {unordered = true})))
+--> =~ [unknown]: "" -> "\x98\x06\x01"
+print(#proto.diff(a, c, known))
+--> =0
+`, map[string]rt.Value{
+		"a": proto.Wrap(a),
+		"c": proto.Wrap(c),
+	})
+	for _, test := range []struct {
+		opts  *proto.DiffOptions
+		equal bool
+	}{
+		{nil, false},
+		{&proto.DiffOptions{UnorderedLists: true}, false},
+		{&proto.DiffOptions{UnorderedLists: true, FloatEpsilon: 0.01}, true},
+	} {
+		equal, err := proto.Equal(a, b, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if equal != test.equal {
+			t.Errorf("Equal with options %+v = %t", test.opts, equal)
+		}
+	}
+}
+
+// TestFreeze tests that messages wrapped read-only cannot be modified from
+// Lua, even through copies of their parts.
+func TestFreeze(t *testing.T) {
+	frozen := &structpb.Struct{Fields: map[string]*structpb.Value{
+		"list": structpb.NewListValue(&structpb.ListValue{
+			Values: []*structpb.Value{structpb.NewStringValue("a")},
+		}),
+		"struct": structpb.NewStructValue(&structpb.Struct{
+			Fields: map[string]*structpb.Value{"b": structpb.NewBoolValue(true)},
+		}),
+	}}
+	orig := gproto.Clone(frozen)
+	runLuaTest(t, `
+local copy = proto.new("google.protobuf.Struct")
+copy.fields = frozen.fields
+local list = proto.new("google.protobuf.ListValue")
+list.values = frozen.fields.list.list_value.values
+list.values[1].string_value = "changed"
+local value = proto.new("google.protobuf.Value")
+value.struct_value = frozen.fields.struct.struct_value
+value.struct_value.fields.b.bool_value = false
+copy.fields.struct.struct_value.fields.b.bool_value = false
+print(pcall(function() frozen.fields.list.null_value = 0 end))
+--> ~false\t.*attempt to modify read-only message
+print(list.values[1].string_value, value.struct_value.fields.b.bool_value)
+--> =changed	false
+`, map[string]rt.Value{
+		"frozen": proto.WrapReadOnly(frozen),
+	})
+	if !gproto.Equal(frozen, orig) {
+		t.Errorf("frozen message was modified: %v", frozen)
+	}
+}
+
+// TestCopyOnWrite tests that copy-on-write views leave the original message
+// unchanged and copy only modified parts.
+func TestCopyOnWrite(t *testing.T) {
+	orig := &structpb.Struct{Fields: map[string]*structpb.Value{
+		"list": structpb.NewListValue(&structpb.ListValue{
+			Values: []*structpb.Value{structpb.NewStringValue("a")},
+		}),
+		"struct": structpb.NewStructValue(&structpb.Struct{
+			Fields: map[string]*structpb.Value{"b": structpb.NewBoolValue(true)},
+		}),
+	}}
+	saved := gproto.Clone(orig)
+	unchanged, unchangedCow := proto.WrapCopyOnWrite(orig)
+	changed, changedCow := proto.WrapCopyOnWrite(orig)
+	runLuaTest(t, `
+print(unchanged.fields.list.list_value.values[1].string_value)
+--> =a
+local copy = proto.new("google.protobuf.Struct")
+copy.fields = changed.fields
+copy.fields.list.list_value.values[1].string_value = "copied"
+changed.fields.struct.struct_value.fields.b.bool_value = false
+print(changed.fields.struct.struct_value.fields.b.bool_value)
+--> =false
+print(unchanged.fields.struct.struct_value.fields.b.bool_value)
+--> =true
+print(changed.fields.list.list_value.values[1].string_value)
+--> =a
+`, map[string]rt.Value{
+		"unchanged": unchanged,
+		"changed":   changed,
+	})
+	if !gproto.Equal(orig, saved) {
+		t.Errorf("original message was modified: %v", orig)
+	}
+	if unchangedCow.Modified() || unchangedCow.Message() != orig {
+		t.Errorf("unexpected modification: %v", unchangedCow.Message())
+	}
+	if !changedCow.Modified() {
+		t.Fatal("modification not recorded")
+	}
+	result := changedCow.Message().(*structpb.Struct)
+	if result.Fields["struct"].GetStructValue().Fields["b"].GetBoolValue() {
+		t.Errorf("modification missing: %v", result)
+	}
+	if result.Fields["list"] != orig.Fields["list"] {
+		t.Errorf("unmodified field was copied: %v", result)
+	}
+
+	// Views stay bound to the message they were obtained from, and cannot
+	// be written to once it is removed.
+	stale, _ := proto.WrapCopyOnWrite(orig)
+	runLuaTest(t, `
+local s = stale.fields.struct
+local held = s.struct_value
+local v = stale.fields.list.list_value.values[1]
+stale.fields.list.list_value.values = nil
+print(v.string_value, v:Has("string_value"))
+--> =a	true
+print(pcall(function() v.string_value = "detached" end))
+--> ~false\t.*attempt to modify message removed from copy-on-write message
+print(#stale.fields.list.list_value.values)
+--> =0
+s.struct_value = proto.new("google.protobuf.Struct")
+print(held.fields.b.bool_value, #s.struct_value.fields)
+--> =true	0
+print(pcall(function() held.fields.b.bool_value = false end))
+--> ~false\t.*attempt to modify message removed from copy-on-write message
+stale.fields = nil
+print(s:Has("struct_value"))
+--> =true
+print(pcall(function() s.string_value = "detached" end))
+--> ~false\t.*attempt to modify message removed from copy-on-write message
+print(#stale.fields)
+--> =0
+`, map[string]rt.Value{"stale": stale})
+	if !gproto.Equal(orig, saved) {
+		t.Errorf("original message was modified: %v", orig)
+	}
+}
+
+// TestChanges tests the recording of changes to tracked messages.
+func TestChanges(t *testing.T) {
+	root := parseMessage(t, "golua.test.Required", requiredTree)
+	tracked, tracker := proto.WrapTracked(root.Interface())
+	runLuaTest(t, `
+print(proto.new("golua.test.Required"):Changes())
+--> =nil
+print(#root:Changes())
+--> =0
+root.id = "changed"
+root.child.id = "changed"
+root.children[1].id = "changed"
+root.by_name.a.id = "changed"
+root.id = "again"
+root.child.child = nil
+local copy = proto.new("golua.test.Required")
+copy.child = root.child
+copy.child.id = "copied"
+for _, path in ipairs(root.child:Changes()) do
+  print(path)
+end
+--> =id
+--> =child.id
+--> =children
+--> =by_name
+print(root.child.id)
+--> =changed
+`, map[string]rt.Value{
+		"root": tracked,
+	})
+	want := []string{"by_name", "child.id", "children", "id"}
+	if got := tracker.FieldMask().GetPaths(); !reflect.DeepEqual(got, want) {
+		t.Errorf("field mask paths %v, want %v", got, want)
+	}
+	id := root.Descriptor().Fields().ByName("id")
+	if got := root.Get(id).String(); got != "again" {
+		t.Errorf("id is %q, want %q", got, "again")
+	}
+
+	// Field masks cannot refer to extensions.
+	ext, extTracker := proto.WrapTracked(
+		parseMessage(t, "golua.test.Extendable", `name: "x"`).Interface())
+	runLuaTest(t, `
+ext:SetExtension("golua.test.ext_i32", 1)
+ext.name = "y"
+ext:SetExtension("golua.test.ext_msg", proto.new("golua.test.Extendable"))
+ext:GetExtension("golua.test.ext_msg").name = "z"
+for _, path in ipairs(ext:Changes()) do
+  print(path)
+end
+--> =[golua.test.ext_i32]
+--> =name
+--> =[golua.test.ext_msg]
+--> =[golua.test.ext_msg].name
+`, map[string]rt.Value{"ext": ext})
+	want = []string{"name"}
+	if got := extTracker.FieldMask().GetPaths(); !reflect.DeepEqual(got, want) {
+		t.Errorf("field mask paths %v, want %v", got, want)
+	}
+}
+
+// TestFieldHook tests the interception of field accesses by a field hook.
+func TestFieldHook(t *testing.T) {
+	const text = `
+		id: "root"
+		child {id: "child" child {id: "secret"}}
+		children {id: "first"}
+		by_name {key: "a" value {id: "a"}}
+	`
+	root := parseMessage(t, "golua.test.Required", text)
+	var reads, writes []string
+	hook := proto.FieldHookFuncs{
+		Read: func(
+			fd pr.FieldDescriptor, path string, v pr.Value,
+		) (pr.Value, error) {
+			reads = append(reads, path)
+			switch {
+			case path == "child.child":
+				return v, errors.New("access denied")
+			case strings.HasPrefix(path, "children[") && fd.Name() == "id":
+				return pr.ValueOfString("redacted"), nil
+			}
+			return v, nil
+		},
+		Write: func(fd pr.FieldDescriptor, path string, v pr.Value) error {
+			writes = append(writes, path)
+			if path == "id" {
+				return errors.New("read-only field")
+			}
+			return nil
+		},
+	}
+	runLuaTestOptions(t, proto.Options{FieldHook: hook}, `
+print(pcall(function() return root.child.child end))
+--> ~false\t.*access denied
+print(root.children[1].id)
+--> =redacted
+for _, child in pairs(root.children) do
+  print(child.id)
+end
+--> =redacted
+for k, v in root.by_name:Range() do
+  print(k, v.id)
+end
+--> =a	a
+print(pcall(function() root.id = "changed" end))
+--> ~false\t.*read-only field
+root.by_name.a.id = "changed"
+root.child = nil
+print(root.id, root.by_name.a.id)
+--> =root	changed
+`, map[string]rt.Value{
+		"root": proto.Wrap(root.Interface()),
+	})
+	wantReads := []string{
+		"child", "child.child",
+		"children", "children[1]", "children[1].id",
+		"children", "children[1]", "children[1].id",
+		"by_name", "by_name[\"a\"]", "by_name[\"a\"].id",
+		"by_name", "by_name[\"a\"]",
+		"id", "by_name", "by_name[\"a\"]", "by_name[\"a\"].id",
+	}
+	if !reflect.DeepEqual(reads, wantReads) {
+		t.Errorf("reads %q, want %q", reads, wantReads)
+	}
+	wantWrites := []string{"id", "by_name[\"a\"].id", "child"}
+	if !reflect.DeepEqual(writes, wantWrites) {
+		t.Errorf("writes %q, want %q", writes, wantWrites)
+	}
+	r := rt.New(io.Discard)
+	t.Cleanup(loadTestLibs(r, proto.Options{FieldHook: hook}))
+	root = parseMessage(t, "golua.test.Required", text)
+	root.SetUnknown(protowire.AppendVarint(
+		protowire.AppendTag(nil, 100, protowire.VarintType), 1))
+	seen := parseMessage(t, "golua.test.Required", `
+		id: "root"
+		child {id: "child"}
+		children {id: "redacted"}
+		by_name {key: "a" value {id: "a"}}
+	`)
+	partial := parseMessage(t, "golua.test.Required",
+		`id: "partial" child {id: "child"}`)
+	childFD := partial.Descriptor().Fields().ByName("child")
+	child := partial.Mutable(childFD).Message()
+	child.Set(childFD, pr.ValueOfMessage(partial.New()))
+	r.SetEnv(r.GlobalEnv(), "root", proto.Wrap(root.Interface()))
+	r.SetEnv(r.GlobalEnv(), "seen", proto.Wrap(seen.Interface()))
+	r.SetEnv(r.GlobalEnv(), "partial", proto.Wrap(partial.Interface()))
+	for _, src := range []string{
+		`return tostring(root)`,
+		`return tostring(proto.diff(root, proto.new("golua.test.Required")))`,
+		`return root:Marshal()`,
+		`return root.child:Marshal()`,
+		`return root:MarshalDelimited()`,
+		`return proto.write_delimited({root.child})`,
+		`return proto.pack(root):Marshal()`,
+		`return root:Redacted()`,
+		`local c = proto.new("golua.test.Required")
+		c.child = root.child
+		c.children = root.children
+		return c`,
+	} {
+		v := evalLua(t, r, src)
+		s, _ := v.TryString()
+		if msg, ok := proto.Unwrap(v); ok {
+			s = prototext.Format(msg)
+		}
+		if strings.Contains(s, "secret") || strings.Contains(s, "first") {
+			t.Errorf("%s: hook not applied: %q", src, s)
+		}
+	}
+	for src, want := range map[string]string{
+		`return tostring(root == seen)`:                                   "true",
+		`return tostring(root:Equal(seen))`:                               "true",
+		`return tostring(root:HasUnknown())`:                              "false",
+		`return tostring(#root:UnknownFields())`:                          "0",
+		`return tostring(partial:IsInitialized())`:                        "true",
+		`return tostring(#partial:MissingFields())`:                       "0",
+		`return tostring(pcall(root.child.Has, root.child, "child", ""))`: "false",
+	} {
+		s, _ := evalLua(t, r, src).TryString()
+		if s != want {
+			t.Errorf("%s: got %q, want %q", src, s, want)
+		}
+	}
+}
+
+// TestDispatcher tests dispatching unary calls to Lua handlers.
+func TestDispatcher(t *testing.T) {
+	r := newTestRuntime(t)
+	handlers := evalLua(t, r, `
+return {
+  Say = function(req)
+    if req.message == "fail" then
+      error("failed on purpose")
+    end
+    if req.message == "wrong" then
+      return req
+    end
+    local resp = proto.new("golua.test.EchoResponse")
+    resp.message = req.message .. "!"
+    resp.index = req.count
+    return resp
+  end,
+}`).AsTable()
+	svc := echoService(t)
+	d, err := proto.NewDispatcher(r, svc, handlers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRequest := func(message string) []byte {
+		req := parseMessage(t, "golua.test.EchoRequest", "count: 3")
+		req.Set(req.Descriptor().Fields().ByName("message"),
+			pr.ValueOfString(message))
+		b, err := gproto.Marshal(req.Interface())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	for _, method := range []string{
+		"Say", "golua.test.Echo.Say", "/golua.test.Echo/Say",
+	} {
+		b, err := d.Dispatch(method, newRequest("hello"))
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		resp := parseMessage(t, "golua.test.EchoResponse", "")
+		if err = gproto.Unmarshal(b, resp.Interface()); err != nil {
+			t.Fatal(err)
+		}
+		want := parseMessage(t, "golua.test.EchoResponse",
+			`message: "hello!" index: 3`)
+		if !gproto.Equal(resp.Interface(), want.Interface()) {
+			t.Errorf("%s: unexpected response %v", method, resp)
+		}
+	}
+	for request, want := range map[string]string{
+		"fail":  "failed on purpose",
+		"wrong": "bad response: message type 'golua.test.EchoRequest'",
+	} {
+		_, err := d.Dispatch("Say", newRequest(request))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got error %v, want %q", request, err, want)
+		}
+	}
+	for method, want := range map[string]string{
+		"Nope":              "no method 'Nope'",
+		"other.Service.Say": "does not belong to service",
+		"Repeat":            "not implemented",
+	} {
+		_, err := d.Dispatch(method, nil)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got error %v, want %q", method, err, want)
+		}
+	}
+	_, err = proto.NewDispatcher(r, svc, evalLua(t, r, `
+return {Nope = function() end}`).AsTable())
+	if err == nil {
+		t.Error("handler for unknown method accepted")
+	}
+}
+
+// TestDispatcherStream tests dispatching streaming calls to Lua handlers.
+func TestDispatcherStream(t *testing.T) {
+	r := newTestRuntime(t)
+	t.Cleanup(lib.LoadLibs(r, coroutine.LibLoader))
+	handlers := evalLua(t, r, `
+local function response(message, index)
+  local resp = proto.new("golua.test.EchoResponse")
+  resp.message = message
+  resp.index = index
+  return resp
+end
+return {
+  Say = function(req)
+    return response(req.message, 0)
+  end,
+  Repeat = function(req, stream)
+    for i = 1, req.count do
+      stream:Send(response(req.message, i))
+    end
+  end,
+  Collect = function(stream)
+    local message, n = "", 0
+    local req = stream:Recv()
+    while req ~= nil do
+      message = message .. req.message
+      n = n + 1
+      req = stream:Recv()
+    end
+    return response(message, n)
+  end,
+  Chat = function(stream)
+    local n = 0
+    local req = stream:Recv()
+    while req ~= nil do
+      n = n + 1
+      if req.message == "send" then
+        stream:Send(req)
+      elseif req.message == "yield" then
+        coroutine.yield()
+      elseif req.message == "yield send" then
+        coroutine.yield("send")
+      elseif req.message == "yield message" then
+        coroutine.yield("send", 42)
+      elseif req.message == "yield recv" then
+        coroutine.yield("recv")
+      end
+      stream:Send(response(req.message, n))
+      req = stream:Recv()
+    end
+  end,
+}`).AsTable()
+	d, err := proto.NewDispatcher(r, echoService(t), handlers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRequest := func(message string, count int32) gproto.Message {
+		return parseMessage(t, "golua.test.EchoRequest",
+			fmt.Sprintf("message: %q count: %d", message, count)).Interface()
+	}
+	recvAll := func(s *proto.Stream) ([]string, error) {
+		var got []string
+		for {
+			resp, err := s.Recv()
+			if err == io.EOF {
+				return got, nil
+			}
+			if err != nil {
+				return got, err
+			}
+			rmsg := resp.ProtoReflect()
+			fields := rmsg.Descriptor().Fields()
+			got = append(got, fmt.Sprintf("%s/%d",
+				rmsg.Get(fields.ByName("message")).String(),
+				rmsg.Get(fields.ByName("index")).Int()))
+		}
+	}
+	for _, test := range []struct {
+		method   string
+		requests []string
+		want     []string
+	}{
+		{"Repeat", []string{"a"}, []string{"a/1", "a/2", "a/3"}},
+		{"Collect", []string{"a", "b", "c"}, []string{"abc/3"}},
+		{"Collect", nil, []string{"/0"}},
+		{"Chat", []string{"a", "b"}, []string{"a/1", "b/2"}},
+	} {
+		s, err := d.DispatchStream(test.method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, message := range test.requests {
+			if err = s.Send(newRequest(message, 3)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s.CloseSend()
+		got, err := recvAll(s)
+		if err != nil {
+			t.Errorf("%s: %v", test.method, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.method, got, test.want)
+		}
+	}
+
+	// Requests may be sent while the handler is running.
+	s, err := d.DispatchStream("Chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for _, message := range []string{"x", "y"} {
+			if err := s.Send(newRequest(message, 0)); err != nil {
+				t.Error(err)
+			}
+		}
+		s.CloseSend()
+	}()
+	got, err := recvAll(s)
+	if err != nil || !reflect.DeepEqual(got, []string{"x/1", "y/2"}) {
+		t.Errorf("Chat: got %v, %v", got, err)
+	}
+
+	// Responses of the wrong type are rejected.
+	s, err = d.DispatchStream("Chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Send(newRequest("send", 0))
+	s.CloseSend()
+	if _, err = recvAll(s); err == nil ||
+		!strings.Contains(err.Error(), "bad response") {
+		t.Errorf("Chat: got error %v, want bad response", err)
+	}
+
+	// Plain coroutine yields cannot fake stream operations.
+	for _, message := range []string{
+		"yield", "yield send", "yield message", "yield recv",
+	} {
+		s, err := d.DispatchStream("Chat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Send(newRequest(message, 0)); err != nil {
+			t.Fatal(err)
+		}
+		s.CloseSend()
+		_, err = recvAll(s)
+		if err == nil || !strings.Contains(err.Error(), "yielded outside") {
+			t.Errorf("%s: got error %v, want yield error", message, err)
+		}
+	}
+
+	for method, want := range map[string]string{
+		"Say":    "not a streaming method",
+		"Repeat": "missing request",
+	} {
+		s, err := d.DispatchStream(method)
+		if err == nil {
+			s.CloseSend()
+			_, err = s.Recv()
+		}
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got error %v, want %q", method, err, want)
+		}
+	}
+	if _, err = d.DispatchMessage("Chat", newRequest("a", 0)); err == nil ||
+		!strings.Contains(err.Error(), "use DispatchStream") {
+		t.Errorf("Chat: got error %v, want streaming method error", err)
+	}
+}
+
+// TestClient tests calling service methods through a Lua client.
+func TestClient(t *testing.T) {
+	r := newTestRuntime(t)
+	d, err := proto.NewDispatcher(r, echoService(t), evalLua(t, r, `
+return {
+  Say = function(req)
+    if req.message == "fail" then
+      error("failed on purpose")
+    end
+    local resp = proto.new("golua.test.EchoResponse")
+    resp.message = req.message .. "!"
+    resp.index = req.count
+    return resp
+  end,
+}`).AsTable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var methods []string
+	transport := proto.TransportFunc(
+		func(method string, request []byte) ([]byte, error) {
+			methods = append(methods, method)
+			return d.Dispatch(method, request)
+		})
+	runLuaTest(t, `
+local client = proto.client("golua.test.Echo", transport)
+local req = proto.new("golua.test.EchoRequest")
+req.message = "hello"
+req.count = 2
+local resp = client:Say(req)
+print(resp.message, resp.index)
+--> =hello!	2
+resp = client:Say({message = "hi", count = 3})
+print(resp.message, resp.index)
+--> =hi!	3
+client = proto.client(proto.service("golua.test.Echo"), transport)
+print(client:Say({}).message, client.Nope)
+--> =!	nil
+print(pcall(client.Say, client, {message = "fail"}))
+--> ~false\t.*failed on purpose
+print(pcall(client.Say, client, {nope = 1}))
+--> ~false\t.*no such field: nope
+print(pcall(client.Say, client, proto.new("golua.test.EchoResponse")))
+--> ~false\t.*bad request: message type 'golua.test.EchoResponse'
+print(pcall(client.Repeat, client, {}))
+--> ~false\t.*Repeat is a streaming method
+print(pcall(proto.client, "golua.test.Nope", transport))
+--> ~false\t.*no such service: golua.test.Nope
+print(pcall(proto.client, "golua.test.Echo", {}))
+--> ~false\t.*#2 must be userdata
+`, map[string]rt.Value{"transport": proto.WrapTransport(transport)})
+	want := []string{
+		"golua.test.Echo.Say", "golua.test.Echo.Say", "golua.test.Echo.Say",
+		"golua.test.Echo.Say",
+	}
+	if !reflect.DeepEqual(methods, want) {
+		t.Errorf("got calls %v, want %v", methods, want)
+	}
+}
+
+// TestDelimited tests reading and writing length-delimited message streams.
+func TestDelimited(t *testing.T) {
+	r := newTestRuntime(t)
+	t.Cleanup(lib.LoadLibs(r, iolib.LibLoader))
+	req := parseMessage(t, "golua.test.EchoRequest",
+		fmt.Sprintf("message: %q", strings.Repeat("x", 1000)))
+	buf, err := gproto.Marshal(req.Interface())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = append(protowire.AppendVarint(nil, uint64(len(buf))), buf...)
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	if err = os.WriteFile(in, append(buf, buf...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r.SetEnv(r.GlobalEnv(), "input", rt.StringValue(in))
+	r.SetEnv(r.GlobalEnv(), "output", rt.StringValue(out))
+	evalLua(t, r, `
+local msgs = {}
+local f = io.open(input, "rb")
+for msg in proto.read_delimited("golua.test.EchoRequest", f) do
+  msgs[#msgs + 1] = msg
+end
+f:close()
+assert(#msgs == 2 and #msgs[1].message == 1000)
+f = io.open(output, "wb")
+proto.write_delimited(msgs, f):close()`)
+	written, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written) != string(buf)+string(buf) {
+		t.Errorf("written stream differs from read stream")
+	}
+
+	// The message size is limited by the memory quota.
+	r.SetEnv(r.GlobalEnv(), "stream", rt.StringValue(string(buf)))
+	read := evalLua(t, r, `
+return function()
+  return proto.read_delimited("golua.test.EchoRequest", stream)()
+end`)
+	_, err = r.MainThread().CallContext(rt.RuntimeContextDef{
+		HardLimits: rt.RuntimeResources{Memory: 100000},
+	}, func() error {
+		_, err := rt.Call1(r.MainThread(), read)
+		return err
+	})
+	if err != nil {
+		t.Errorf("read within memory quota failed: %v", err)
+	}
+	_, err = r.MainThread().CallContext(rt.RuntimeContextDef{
+		HardLimits: rt.RuntimeResources{Memory: 900},
+	}, func() error {
+		_, err := rt.Call1(r.MainThread(), read)
+		return err
+	})
+	if err == nil || !strings.Contains(err.Error(), "exceeds maximum size") {
+		t.Errorf("got error %v, want maximum size error", err)
+	}
+
+	// The memory for messages which cannot be read is released.
+	invalid := protowire.AppendVarint(nil, uint64(len(buf)))
+	invalid = append(invalid, strings.Repeat("\xff", len(buf))...)
+	for _, stream := range []string{
+		string(buf[:len(buf)/2]), string(invalid),
+	} {
+		r.SetEnv(r.GlobalEnv(), "stream", rt.StringValue(stream))
+		read = evalLua(t, r, `
+return function()
+  for i = 1, 200 do
+    assert(not pcall(proto.read_delimited("golua.test.EchoRequest", stream)))
+  end
+end`)
+		_, err = r.MainThread().CallContext(rt.RuntimeContextDef{
+			HardLimits: rt.RuntimeResources{Memory: 100000},
+		}, func() error {
+			_, err := rt.Call1(r.MainThread(), read)
+			return err
+		})
+		if err != nil {
+			t.Errorf("failed reads exceeded memory quota: %v", err)
+		}
+	}
+
+	// Decoded messages may need much more memory than their encoding.
+	scalars := parseMessage(t, "golua.test.Scalars",
+		strings.Repeat("u64s: 0 ", 2000))
+	if buf, err = gproto.Marshal(scalars.Interface()); err != nil {
+		t.Fatal(err)
+	}
+	buf = append(protowire.AppendVarint(nil, uint64(len(buf))), buf...)
+	r.SetEnv(r.GlobalEnv(), "stream", rt.StringValue(string(buf)))
+	read = evalLua(t, r, `
+return function()
+  return proto.read_delimited("golua.test.Scalars", stream)()
+end`)
+	_, err = r.MainThread().CallContext(rt.RuntimeContextDef{
+		HardLimits: rt.RuntimeResources{Memory: 10000},
+	}, func() error {
+		_, err := rt.Call1(r.MainThread(), read)
+		return err
+	})
+	if err == nil {
+		t.Errorf("read of %d bytes exceeding memory quota succeeded", len(buf))
+	}
+}
@@ -0,0 +1,41 @@
+-- bytes fields are read as bytes user data
+do
+  local msg = proto.new("golua.test.Scalars")
+  msg.bs = "hello, world"
+  local bs = msg.bs
+  print(type(bs), #bs, bs:Len(), tostring(bs))
+  --> =userdata	12	12	hello, world
+  print(bs:Hex(), bs:Base64())
+  --> =68656c6c6f2c20776f726c64	aGVsbG8sIHdvcmxk
+  print(bs:Sub(1, 5), bs:Sub(-5), bs:Sub(8, -1):ToString(), #bs:Sub(5, 2))
+  --> =hello	world	world	0
+  print(bs:Sub(0, 100):Len(), bs:Sub(-100, 3))
+  --> =12	hel
+  print(bs:Equal("hello, world"), bs:Equal(proto.bytes("hello")), bs == msg.bs)
+  --> =true	false	true
+  print("<" .. bs:Sub(1, 5) .. ">")
+  --> =<hello>
+end
+
+-- bytes user data can be assigned to bytes fields
+do
+  local msg = proto.new("golua.test.Scalars")
+  local other = proto.new("golua.test.Scalars")
+  other.bs = "\0\1\2\3"
+  msg.bs = other.bs:Sub(2, 3)
+  print(msg.bs:Hex(), other.bs:Hex())
+  --> =0102	00010203
+  msg.bs = proto.bytes("plain")
+  print(msg.bs)
+  --> =plain
+  print(pcall(function() msg.s = proto.bytes("x") end))
+  --> ~false\t.*expected string
+end
+
+-- wrapped bytes values are bytes user data too
+do
+  local msg = proto.new("google.protobuf.BytesValue")
+  msg.value = "abc"
+  print(msg.value:Hex())
+  --> =616263
+end
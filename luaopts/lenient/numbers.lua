@@ -0,0 +1,48 @@
+-- integral floats and numeric strings are accepted for integer fields
+do
+  local msg = proto.new("golua.test.Scalars")
+  msg.i32 = 3.0
+  msg.i64 = "42"
+  msg.u32 = " 7 "
+  msg.u64 = "18446744073709551615"
+  msg.si64 = "1e3"
+  print(msg.i32, msg.i64, msg.u32, msg.u64, msg.si64)
+  --> =3	42	7	18446744073709551615	1000
+  msg.u64 = 2^63
+  msg.fx64 = 2.0^64 - 2048
+  print(msg.u64, msg.fx64)
+  --> =9223372036854775808	18446744073709549568
+  print(pcall(function() msg.fx64 = 2^64 end))
+  --> ~false\t.*fixed64 field out of bounds: 1.8446744073709552e\+19
+  print(pcall(function() msg.i64 = -2^64 end))
+  --> ~false\t.*int64 field out of bounds: -1.8446744073709552e\+19
+  print(pcall(function() msg.i32 = 1 / 0 end))
+  --> ~false\t.*int32 field out of bounds: \+Inf
+end
+
+-- numeric strings are accepted for floating point fields
+do
+  local msg = proto.new("golua.test.Scalars")
+  msg.fl = "0.5"
+  msg.db = "1e-3"
+  print(msg.fl, msg.db)
+  --> =0.5	0.001
+  msg.fl = 0.1
+  print(msg.fl ~= 0.1)
+  --> =true
+end
+
+-- non-integral and non-numeric values are rejected
+do
+  local msg = proto.new("golua.test.Scalars")
+  print(pcall(function() msg.i32 = 3.5 end))
+  --> ~false\t.*field 'i32': 3.5 has no exact int32 representation
+  print(pcall(function() msg.i64 = "abc" end))
+  --> ~false\t.*field 'i64': cannot convert 'abc' to int64
+  print(pcall(function() msg.db = "abc" end))
+  --> ~false\t.*field 'db': cannot convert 'abc' to double
+  print(pcall(function() msg.u32 = -1.0 end))
+  --> ~false\t.*uint32 field out of bounds: -1
+  print(pcall(function() msg.i32 = true end))
+  --> ~false\t.*field 'i32': expected integer, got boolean
+end
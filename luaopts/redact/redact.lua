@@ -0,0 +1,12 @@
+-- tostring redacts debug_redact fields
+do
+  local msg = proto.new("golua.test.Redacted")
+  msg.name, msg.email = "n", "e"
+  print(tostring(msg), msg.email)
+  --> =golua.test.Redacted{name: "n"}	e
+  local root = parse("golua.test.Redacted", [[
+    children {child {email: "e"}}
+  ]])
+  print(tostring(root.children[1].child))
+  --> =golua.test.Redacted{}
+end
@@ -0,0 +1,40 @@
+-- exactly representable values are accepted
+do
+  local msg = proto.new("golua.test.Scalars")
+  msg.fl = 0.5
+  msg.db = 0.1
+  msg.i32 = 3
+  print(msg.fl, msg.db, msg.i32)
+  --> =0.5	0.1	3
+  msg.fl = 1 / 0
+  msg.db = 9007199254740992
+  print(msg.fl, msg.db)
+  --> =+Inf	9.007199254740992e+15
+end
+
+-- float precision loss and overflow are rejected
+do
+  local msg = proto.new("golua.test.Scalars")
+  print(pcall(function() msg.fl = 0.1 end))
+  --> ~false\t.*field 'fl': 0.1 loses precision as float
+  print(pcall(function() msg.fl = 1e39 end))
+  --> ~false\t.*field 'fl': 1e\+39 overflows float
+  print(pcall(function() msg.fl = 16777217 end))
+  --> ~false\t.*field 'fl': 1.6777217e\+07 loses precision as float
+  print(pcall(function() msg.db = 9007199254740993 end))
+  --> ~false\t.*field 'db': 9007199254740993 loses precision as double
+  print(pcall(function() msg.db = proto.uint64("18446744073709551615") end))
+  --> ~false\t.*field 'db': 18446744073709551615 loses precision as double
+  msg.db = proto.uint64("9223372036854775808")
+  print(msg.db)
+  --> =9.223372036854776e+18
+end
+
+-- integral floats and strings are still rejected
+do
+  local msg = proto.new("golua.test.Scalars")
+  print(pcall(function() msg.i32 = 3.0 end))
+  --> ~false\t.*field 'i32': expected integer, got number
+  print(pcall(function() msg.db = "1" end))
+  --> ~false\t.*expected number, got string
+end
@@ -0,0 +1,58 @@
+-- reading unset wrapper fields yields nil
+do
+  local msg = proto.new("golua.test.Wrappers")
+  print(msg.i32, msg.i64, msg.u32, msg.u64, msg.f, msg.d, msg.b, msg.s, msg.bs)
+  --> =nil	nil	nil	nil	nil	nil	nil	nil	nil
+  print(msg:Has("i64"))
+  --> =false
+end
+
+-- assigning scalars creates the wrappers
+do
+  local msg = proto.new("golua.test.Wrappers")
+  msg.i32 = -32
+  msg.i64 = 64
+  msg.u32 = 32
+  msg.u64 = 64
+  msg.f = 1.5
+  msg.d = 2.5
+  msg.b = false
+  msg.s = "foo"
+  msg.bs = "bar"
+  print(msg.i32, msg.i64, msg.u32, msg.u64, msg.f, msg.d, msg.b, msg.s, msg.bs)
+  --> =-32	64	32	64	1.5	2.5	false	foo	bar
+  print(msg:Has("b"), msg:Has("b", "value"))
+  --> =true	false
+  print(msg:Has("i64", "value"))
+  --> =true
+
+  msg.i64 = nil
+  print(msg.i64, msg:Has("i64"))
+  --> =nil	false
+end
+
+-- wrapper messages can still be assigned
+do
+  local msg = proto.new("golua.test.Wrappers")
+  local wrapper = proto.new("google.protobuf.StringValue")
+  wrapper.value = "wrapped"
+  msg.s = wrapper
+  print(msg.s)
+  --> =wrapped
+end
+
+-- assignment errors name the wrapper
+do
+  local msg = proto.new("golua.test.Wrappers")
+  print(pcall(function() msg.u32 = -1 end))
+  --> ~false\t.*UInt32Value: .*out of bounds
+  print(pcall(function() msg.s = 1 end))
+  --> ~false\t.*StringValue: expected string, got number
+end
+
+-- repeated wrappers
+do
+  local msg = proto.new("golua.test.Wrappers")
+  print(#msg.list)
+  --> =0
+end
@@ -1,6 +1,7 @@
 package proto
 
 import (
+	"errors"
 	"math"
 
 	rt "github.com/arnodel/golua/runtime"
@@ -14,6 +15,9 @@ type mapWrapper struct {
 
 	// m is the wrapped map.
 	m pr.Map
+
+	// path is the path of m, if a field hook is configured.
+	path string
 }
 
 var (
@@ -44,6 +48,13 @@ func init() {
 		"__len", mapLen, 1, false, cpuIOMemTimeSafe, mapTable, mapTableReadOnly)
 	setTableFunc(
 		"__len", mapLen, 1, false, cpuIOMemTimeSafe, mapTable, mapTableReadOnly)
+	setTableFunc("__newindex", mapNewIndexReadOnly, 3, false, cpuIOMemTimeSafe,
+		mapTableReadOnly)
+}
+
+// mapNewIndexReadOnly rejects the map[k] = v operation on read-only maps.
+func mapNewIndexReadOnly(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	return nil, errors.New("attempt to modify read-only map")
 }
 
 // mapHas checks whether the map has the specified key.
@@ -60,6 +71,9 @@ func mapHas(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
 	if b, ok := k.TryBool(); ok {
 		return mapHasBool(t, c, mw, b)
 	}
+	if u, ok := tryUint64(k); ok {
+		return mapHasUint64(t, c, mw, u)
+	}
 	return pushingFalse(t, c)
 }
 
@@ -92,6 +106,9 @@ func mapHasInt(
 		}
 		key = pr.ValueOfUint32(uint32(idx)).MapKey()
 	case pr.Uint64Kind, pr.Fixed64Kind:
+		if idx < 0 {
+			return pushingFalse(t, c)
+		}
 		key = pr.ValueOfUint64(uint64(idx)).MapKey()
 	default:
 		return pushingFalse(t, c)
@@ -99,6 +116,18 @@ func mapHasInt(
 	return mapHasTail(t, c, mw, key)
 }
 
+// mapHasUint64 checks whether the map has the specified uint64 key.
+func mapHasUint64(
+	t *rt.Thread, c *rt.GoCont, mw *mapWrapper, u uint64,
+) (rt.Cont, error) {
+	switch mw.field.MapKey().Kind() {
+	case pr.Uint64Kind, pr.Fixed64Kind:
+		return mapHasTail(t, c, mw, pr.ValueOfUint64(u).MapKey())
+	default:
+		return pushingFalse(t, c)
+	}
+}
+
 // mapHasString checks whether the map has the specified key.
 func mapHasString(
 	t *rt.Thread, c *rt.GoCont, mw *mapWrapper, s string,
@@ -121,7 +150,11 @@ func mapHasTail(
 	if len(tail) == 0 {
 		return pushingTrue(t, c)
 	}
-	value := protoValueToLua(mw.field, mw.m.Get(key), true)
+	value, err := mapValueToLua(
+		hasOptions(t.Runtime), mw, key, mw.m.Get(key), true)
+	if err != nil {
+		return nil, err
+	}
 	return tailMethodCall(t, c, value, "Has", tail)
 }
 
@@ -139,6 +172,9 @@ func mapIndex(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
 	if b, ok := k.TryBool(); ok {
 		return mapIndexBool(t, c, mw, b, false)
 	}
+	if u, ok := tryUint64(k); ok {
+		return mapIndexUint64(t, c, mw, u, false)
+	}
 	return c.Next(), nil
 }
 
@@ -157,6 +193,9 @@ func mapIndexReadOnly(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
 	if b, ok := k.TryBool(); ok {
 		return mapIndexBool(t, c, mw, b, true)
 	}
+	if u, ok := tryUint64(k); ok {
+		return mapIndexUint64(t, c, mw, u, true)
+	}
 	return c.Next(), nil
 }
 
@@ -172,7 +211,11 @@ func mapIndexBool(
 	if !mw.m.Has(key) {
 		return c.Next(), nil
 	}
-	ret := protoValueToLua(mw.field.MapValue(), mw.m.Get(key), readOnly)
+	ret, err := mapValueToLua(
+		runtimeOptions(t.Runtime), mw, key, mw.m.Get(key), readOnly)
+	if err != nil {
+		return nil, err
+	}
 	return c.PushingNext1(t.Runtime, ret), nil
 }
 
@@ -196,6 +239,9 @@ func mapIndexInt(
 		}
 		key = pr.ValueOfUint32(uint32(idx)).MapKey()
 	case pr.Uint64Kind, pr.Fixed64Kind:
+		if idx < 0 {
+			return c.Next(), nil
+		}
 		key = pr.ValueOfUint64(uint64(idx)).MapKey()
 	default:
 		return c.Next(), nil
@@ -203,7 +249,11 @@ func mapIndexInt(
 	if !mw.m.Has(key) {
 		return c.Next(), nil
 	}
-	ret := protoValueToLua(mw.field.MapValue(), mw.m.Get(key), readOnly)
+	ret, err := mapValueToLua(
+		runtimeOptions(t.Runtime), mw, key, mw.m.Get(key), readOnly)
+	if err != nil {
+		return nil, err
+	}
 	return c.PushingNext1(t.Runtime, ret), nil
 }
 
@@ -222,7 +272,33 @@ func mapIndexString(
 	if !mw.m.Has(key) {
 		return c.Next(), nil
 	}
-	ret := protoValueToLua(mw.field.MapValue(), mw.m.Get(key), readOnly)
+	ret, err := mapValueToLua(
+		runtimeOptions(t.Runtime), mw, key, mw.m.Get(key), readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return c.PushingNext1(t.Runtime, ret), nil
+}
+
+// mapIndexUint64 returns the map value at the specified uint64 key.
+// If readOnly is true, composite values are returned read-only.
+func mapIndexUint64(
+	t *rt.Thread, c *rt.GoCont, mw *mapWrapper, u uint64, readOnly bool,
+) (rt.Cont, error) {
+	switch mw.field.MapKey().Kind() {
+	case pr.Uint64Kind, pr.Fixed64Kind:
+	default:
+		return c.Next(), nil
+	}
+	key := pr.ValueOfUint64(u).MapKey()
+	if !mw.m.Has(key) {
+		return c.Next(), nil
+	}
+	ret, err := mapValueToLua(
+		runtimeOptions(t.Runtime), mw, key, mw.m.Get(key), readOnly)
+	if err != nil {
+		return nil, err
+	}
 	return c.PushingNext1(t.Runtime, ret), nil
 }
 
@@ -244,41 +320,46 @@ func mapLen(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
 // https://stackoverflow.com/q/75263097/4838452.
 func mapRange(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
 	type keyValue struct {
-		key, value rt.Value
+		key   pr.MapKey
+		value pr.Value
+		end   bool
 	}
 	ud, _ := c.UserDataArg(0)
 	mw := ud.Value().(*mapWrapper)
 	readOnly := ud.Metatable() == mapTableReadOnly
+	opts := runtimeOptions(t.Runtime)
 	state := make(chan keyValue)
 	done := make(chan struct{})
 	t.Runtime.RequireMem(goroutineOverhead)
 	closing := makeClosingVar(done, goroutineOverhead)
 	go func() {
 		mw.m.Range(func(k pr.MapKey, v pr.Value) bool {
-			elt := keyValue{
-				key:   protoValueToLua(mw.field.MapKey(), k.Value(), true),
-				value: protoValueToLua(mw.field.MapValue(), v, readOnly),
-			}
 			select {
 			case <-done:
 				return false
-			case state <- elt:
+			case state <- keyValue{key: k, value: v}:
 				return true
 			}
 		})
-		elt := keyValue{
-			key:   rt.NilValue,
-			value: rt.NilValue,
-		}
 		select {
 		case <-done:
-		case state <- elt:
+		case state <- keyValue{end: true}:
 		}
 	}()
+	// The elements are converted by the iterator function, so that the field
+	// hook is called on the Lua thread rather than on the goroutine.
 	iteratorFunction := rt.NewGoFunction(
 		func(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
 			elt := <-state
-			return c.PushingNext(t.Runtime, elt.key, elt.value), nil
+			if elt.end {
+				return c.PushingNext(t.Runtime, rt.NilValue, rt.NilValue), nil
+			}
+			value, err := mapValueToLua(opts, mw, elt.key, elt.value, readOnly)
+			if err != nil {
+				return nil, err
+			}
+			key := protoValueToLua(opts, mw.field.MapKey(), elt.key.Value(), true)
+			return c.PushingNext(t.Runtime, key, value), nil
 		}, "iterator", 2, false)
 	rt.SolemnlyDeclareCompliance(cpuIOMemTimeSafe, iteratorFunction)
 	return c.PushingNext(t.Runtime, rt.FunctionValue(iteratorFunction),
@@ -19,14 +19,20 @@ var (
 	msgTableReadOnly *rt.Table
 
 	// msgMethods are the methods for proto messages.
-	msgMethods map[string]rt.Value
+	msgMethods = make(map[string]rt.Value)
+
+	// errReadOnly is returned when a read-only message is to be modified.
+	errReadOnly = errors.New("attempt to modify read-only message")
+
+	// msgTypeMethods are additional methods for proto messages of
+	// specific types, keyed by message full name.
+	msgTypeMethods = make(map[pr.FullName]map[string]rt.Value)
 )
 
 // init initializes msgTable(ReadOnly) and msgMethods.
 func init() {
 	msgTable = rt.NewTable()
 	msgTableReadOnly = rt.NewTable()
-	msgMethods = make(map[string]rt.Value)
 	setMapFunc(msgMethods, "FullName", msgFullName, 1, false, cpuIOMemTimeSafe)
 	setMapFunc(msgMethods, "Has", msgHas, 2, true, cpuIOMemTimeSafe)
 	setMapFunc(
@@ -35,23 +41,34 @@ func init() {
 	setMapFunc(msgMethods, "Name", msgName, 1, false, cpuIOMemTimeSafe)
 	setMapFunc(msgMethods, "ReadOnly", msgReadOnly, 1, false, cpuIOMemTimeSafe)
 	setMapFunc(msgMethods, "Type", msgType, 1, false, cpuIOMemTimeSafe)
+	setTableFunc(
+		"__add", timeAdd, 2, false, cpuIOTimeSafe, msgTable, msgTableReadOnly)
 	setTableFunc(
 		"__eq", msgEqual, 2, false, cpuIOMemTimeSafe, msgTable, msgTableReadOnly)
 	setTableFunc("__index", msgIndex, 2, false, cpuIOMemTimeSafe, msgTable)
 	setTableFunc(
 		"__index", msgIndexReadOnly, 2, false, cpuIOMemTimeSafe, msgTableReadOnly)
+	setTableFunc(
+		"__le", timeLe, 2, false, cpuIOMemTimeSafe, msgTable, msgTableReadOnly)
+	setTableFunc(
+		"__lt", timeLt, 2, false, cpuIOMemTimeSafe, msgTable, msgTableReadOnly)
 	setTableFunc("__newindex", msgNewIndex, 3, false, cpuIOTimeSafe, msgTable)
+	setTableFunc("__newindex", msgNewIndexReadOnly, 3, false, cpuIOMemTimeSafe,
+		msgTableReadOnly)
+	setTableFunc(
+		"__sub", timeSub, 2, false, cpuIOTimeSafe, msgTable, msgTableReadOnly)
+	setTableFunc("__tostring", msgToString, 1, false, cpuIOTimeSafe, msgTable,
+		msgTableReadOnly)
 }
 
 // msgEqual checks two protobuf messages for equality in Lua.
 func msgEqual(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
-	lhs, _ := c.UserDataArg(0)
-	lhsMsg, ok := lhs.Value().(proto.Message)
+	opts := runtimeOptions(t.Runtime)
+	lhsMsg, ok := unwrapReadable(opts, c.Arg(0))
 	if !ok {
 		return pushingFalse(t, c)
 	}
-	rhs, _ := c.UserDataArg(1)
-	rhsMsg, ok := rhs.Value().(proto.Message)
+	rhsMsg, ok := unwrapReadable(opts, c.Arg(1))
 	if !ok {
 		return pushingFalse(t, c)
 	}
@@ -68,7 +85,8 @@ func msgFullName(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
 // msgHas checks whether the message has the specified field.
 func msgHas(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
 	ud, _ := c.UserDataArg(0)
-	rmsg := ud.Value().(proto.Message).ProtoReflect()
+	msg := ud.Value().(proto.Message)
+	rmsg := msg.ProtoReflect()
 	fieldSpec := c.Arg(1)
 	var fd pr.FieldDescriptor
 	if fieldName, ok := fieldSpec.TryString(); ok {
@@ -91,7 +109,10 @@ func msgHas(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
 	if len(tail) == 0 {
 		return pushingTrue(t, c)
 	}
-	value := protoFieldToLua(rmsg, fd, true)
+	value, err := msgFieldToLua(hasOptions(t.Runtime), msg, fd, true)
+	if err != nil {
+		return nil, err
+	}
 	return tailMethodCall(t, c, value, "Has", tail)
 }
 
@@ -144,7 +165,10 @@ func msgIndexInt(
 	if fd == nil {
 		return c.Next(), nil
 	}
-	retValue := protoFieldToLua(rmsg, fd, readOnly)
+	retValue, err := msgFieldToLua(runtimeOptions(t.Runtime), msg, fd, readOnly)
+	if err != nil {
+		return nil, err
+	}
 	if retValue.IsNil() {
 		return c.Next(), nil
 	}
@@ -152,7 +176,7 @@ func msgIndexInt(
 }
 
 // msgIndexString returns the method of msg named s, or, if it doesn't exist,
-// the value of the field named s.
+// the value of the field or extension field named s.
 // If readOnly is true, composite fields are returned read-only.
 func msgIndexString(
 	t *rt.Thread, c *rt.GoCont, msg proto.Message, s string, readOnly bool,
@@ -161,11 +185,20 @@ func msgIndexString(
 		return c.PushingNext1(t.Runtime, ret), nil
 	}
 	rmsg := msg.ProtoReflect()
+	if ret, ok := msgTypeMethods[rmsg.Descriptor().FullName()][s]; ok {
+		return c.PushingNext1(t.Runtime, ret), nil
+	}
 	fd := rmsg.Descriptor().Fields().ByName(pr.Name(s))
+	if fd == nil {
+		fd = extensionByName(rmsg.Descriptor(), s)
+	}
 	if fd == nil {
 		return c.Next(), nil
 	}
-	retValue := protoFieldToLua(rmsg, fd, readOnly)
+	retValue, err := msgFieldToLua(runtimeOptions(t.Runtime), msg, fd, readOnly)
+	if err != nil {
+		return nil, err
+	}
 	if retValue.IsNil() {
 		return c.Next(), nil
 	}
@@ -173,7 +206,7 @@ func msgIndexString(
 }
 
 // msgIndexUserData supports indexing msg via various user data types.
-// Currently, only pr.FieldDescriptor is supported.
+// Currently, pr.FieldDescriptor and pr.ExtensionType are supported.
 // If readOnly is true, composite fields are returned read-only.
 func msgIndexUserData(
 	t *rt.Thread, c *rt.GoCont, msg proto.Message, ud *rt.UserData, readOnly bool,
@@ -181,7 +214,23 @@ func msgIndexUserData(
 	rmsg := msg.ProtoReflect()
 	switch x := ud.Value().(type) {
 	case pr.FieldDescriptor:
-		retValue := protoFieldToLua(rmsg, x, readOnly)
+		retValue, err := msgFieldToLua(runtimeOptions(t.Runtime), msg, x, readOnly)
+		if err != nil {
+			return nil, err
+		}
+		if retValue.IsNil() {
+			return c.Next(), nil
+		}
+		return c.PushingNext1(t.Runtime, retValue), nil
+	case pr.ExtensionType:
+		xd := x.TypeDescriptor()
+		if xd.ContainingMessage().FullName() != rmsg.Descriptor().FullName() {
+			return c.Next(), nil
+		}
+		retValue, err := msgFieldToLua(runtimeOptions(t.Runtime), msg, xd, readOnly)
+		if err != nil {
+			return nil, err
+		}
 		if retValue.IsNil() {
 			return c.Next(), nil
 		}
@@ -201,53 +250,75 @@ func msgName(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
 // msgNewIndex implements the msg[k] = v operation in Lua.
 func msgNewIndex(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
 	ud, _ := c.UserDataArg(0)
-	rmsg := ud.Value().(proto.Message).ProtoReflect()
+	msg := ud.Value().(proto.Message)
 	k := c.Arg(1)
 	if s, ok := k.TryString(); ok {
-		return msgNewIndexString(t, c, rmsg, s)
+		return msgNewIndexString(t, c, msg, s)
 	}
 	if i, ok := k.TryInt(); ok {
-		return msgNewIndexInt(t, c, rmsg, i)
+		return msgNewIndexInt(t, c, msg, i)
 	}
 	if ud, ok := k.TryUserData(); ok {
-		return msgNewIndexUserData(t, c, rmsg, ud)
+		return msgNewIndexUserData(t, c, msg, ud)
 	}
 	return nil, fmt.Errorf("bad index type %s", k.TypeName())
 }
 
+// msgNewIndexReadOnly rejects the msg[k] = v operation on read-only
+// messages.
+func msgNewIndexReadOnly(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	return nil, errReadOnly
+}
+
 // msgNewIndexFD implements the msg[fd] = v operation in Lua.
 func msgNewIndexFD(
-	t *rt.Thread, c *rt.GoCont, msg pr.Message, fd pr.FieldDescriptor,
+	t *rt.Thread, c *rt.GoCont, msg proto.Message, fd pr.FieldDescriptor,
 ) (rt.Cont, error) {
-	if fd.ContainingMessage().FullName() != msg.Descriptor().FullName() {
+	rmsg := msg.ProtoReflect()
+	if fd.ContainingMessage().FullName() != rmsg.Descriptor().FullName() {
 		return nil, fmt.Errorf(
 			"field descriptor '%s' does not belong to message type '%s'",
-			fd.FullName(), msg.Descriptor().FullName())
+			fd.FullName(), rmsg.Descriptor().FullName())
+	}
+	if err := checkWritable(rmsg); err != nil {
+		return nil, err
 	}
+	opts := runtimeOptions(t.Runtime)
 	luaValue := c.Arg(2)
 	if luaValue.IsNil() {
 		if fd.HasPresence() || fd.IsList() || fd.IsMap() {
-			msg.Clear(fd)
+			if err := checkFieldWrite(opts, msg, fd, pr.Value{}); err != nil {
+				return nil, err
+			}
+			rmsg.Clear(fd)
 			return c.Next(), nil
 		}
 		return nil, fmt.Errorf("nil value not allowed for field '%s'", fd.Name())
 	}
-	value, err := luaToProtoValue(fd, luaValue)
+	value, err := luaToProtoValue(opts, fd, luaValue)
 	if err != nil {
 		return nil, err
 	}
-	msg.Set(fd, value)
+	if mustDetachValue(luaValue) {
+		value = detachValue(rmsg, fd, value)
+	}
+	value = readableValue(opts, rmsg, fd, luaValue, value)
+	if err := checkFieldWrite(opts, msg, fd, value); err != nil {
+		return nil, err
+	}
+	rmsg.Set(fd, value)
 	return c.Next(), nil
 }
 
 // msgNewIndexInt implements msg[fieldNumber] = v in Lua.
 func msgNewIndexInt(
-	t *rt.Thread, c *rt.GoCont, msg pr.Message, fieldNumber int64,
+	t *rt.Thread, c *rt.GoCont, msg proto.Message, fieldNumber int64,
 ) (rt.Cont, error) {
 	if fieldNumber < 0 || fieldNumber > math.MaxInt32 {
 		return nil, fmt.Errorf("field number out of bounds: %d", fieldNumber)
 	}
-	fd := msg.Descriptor().Fields().ByNumber(pr.FieldNumber(fieldNumber))
+	md := msg.ProtoReflect().Descriptor()
+	fd := md.Fields().ByNumber(pr.FieldNumber(fieldNumber))
 	if fd == nil {
 		return nil, fmt.Errorf("no such field number: %d", fieldNumber)
 	}
@@ -256,9 +327,13 @@ func msgNewIndexInt(
 
 // msgNewIndexString implements msg.fieldName = v in Lua.
 func msgNewIndexString(
-	t *rt.Thread, c *rt.GoCont, msg pr.Message, fieldName string,
+	t *rt.Thread, c *rt.GoCont, msg proto.Message, fieldName string,
 ) (rt.Cont, error) {
-	fd := msg.Descriptor().Fields().ByName(pr.Name(fieldName))
+	md := msg.ProtoReflect().Descriptor()
+	fd := md.Fields().ByName(pr.Name(fieldName))
+	if fd == nil {
+		fd = extensionByName(md, fieldName)
+	}
 	if fd == nil {
 		return nil, fmt.Errorf("no such field: %s", fieldName)
 	}
@@ -267,13 +342,15 @@ func msgNewIndexString(
 
 // msgNewIndexUserData supports setting a message field via various
 // user data types.
-// Currently, only pr.FieldDescriptor is supported.
+// Currently, pr.FieldDescriptor and pr.ExtensionType are supported.
 func msgNewIndexUserData(
-	t *rt.Thread, c *rt.GoCont, msg pr.Message, ud *rt.UserData,
+	t *rt.Thread, c *rt.GoCont, msg proto.Message, ud *rt.UserData,
 ) (rt.Cont, error) {
 	switch x := ud.Value().(type) {
 	case pr.FieldDescriptor:
 		return msgNewIndexFD(t, c, msg, x)
+	case pr.ExtensionType:
+		return msgNewIndexFD(t, c, msg, x.TypeDescriptor())
 	default:
 		return nil, fmt.Errorf("userdata index of type %T not supported", x)
 	}
@@ -288,7 +365,7 @@ func msgIsReadOnly(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
 // msgMarshal marshals a protobuf message to wire-format encoding in Lua.
 func msgMarshal(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
 	ud, _ := c.UserDataArg(0)
-	msg := ud.Value().(proto.Message)
+	msg := readableUserData(t, ud).Interface()
 	optsValue := c.Arg(1)
 	if optsValue.IsNil() {
 		return msgMarshalPlain(t, c, msg)
@@ -334,13 +411,33 @@ func msgType(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
 	return c.PushingNext1(t.Runtime, wrapType(msg.ProtoReflect().Type())), nil
 }
 
+// msgToString converts a protobuf message to a string consisting of its
+// full name and populated fields. If the RedactToString option is set, the
+// message is redacted first.
+func msgToString(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	opts := runtimeOptions(t.Runtime)
+	rmsg := readableMessage(opts, ud.Value().(proto.Message))
+	if opts.RedactToString {
+		var err error
+		rmsg, err = (&redactor{debugRedact: true}).redacted(rmsg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pushingString(
+		t, c, string(rmsg.Descriptor().FullName())+formatMessage(rmsg))
+}
+
 // Wrap returns the given protobuf message as a Lua value.
 func Wrap(msg proto.Message) rt.Value {
 	return wrap(msg, false)
 }
 
 // WrapReadOnly returns the given protobuf message as a Lua value.
-// The returned message cannot be changed from Lua.
+// The returned message cannot be changed from Lua. This extends to all
+// values obtained from it, and assigning them to mutable messages copies
+// them.
 func WrapReadOnly(msg proto.Message) rt.Value {
 	return wrap(msg, true)
 }
@@ -359,11 +456,16 @@ func wrap(msg proto.Message, readOnly bool) rt.Value {
 }
 
 // Unwrap unwraps the protobuf message from the given lua value.
+// Messages obtained from a value wrapped with WrapCopyOnWrite are
+// copy-on-write views rather than messages of a concrete Go type.
 func Unwrap(luaValue rt.Value) (msg proto.Message, ok bool) {
 	ud, ok := luaValue.TryUserData()
 	if !ok {
 		return
 	}
 	msg, ok = ud.Value().(proto.Message)
+	if pm, isPathMessage := msg.(*pathMessage); isPathMessage {
+		msg = pm.Message
+	}
 	return
 }
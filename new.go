@@ -51,15 +51,38 @@ func protoNewMessageType(
 // protoNewString creates a new, empty protobuf message with fullname given
 // by s.
 func protoNewString(t *rt.Thread, c *rt.GoCont, s string) (rt.Cont, error) {
+	mt, err := findMessageType(s)
+	if err != nil {
+		return nil, err
+	}
+	return protoNewMessageType(t, c, mt)
+}
+
+// findMessageType looks up the message type with full name or type URL s
+// in the global type registry.
+func findMessageType(s string) (pr.MessageType, error) {
 	mt, err := protoregistry.GlobalTypes.FindMessageByName(pr.FullName(s))
 	if err == nil {
-		return protoNewMessageType(t, c, mt)
+		return mt, nil
 	}
 	mt, err = protoregistry.GlobalTypes.FindMessageByURL(s)
 	if err != nil {
 		return nil, fmt.Errorf("no such message type: %s", s)
 	}
-	return protoNewMessageType(t, c, mt)
+	return mt, nil
+}
+
+// userDataMessageDescriptor returns the message descriptor for the given
+// message type or message descriptor user data.
+func userDataMessageDescriptor(ud *rt.UserData) (pr.MessageDescriptor, error) {
+	switch x := ud.Value().(type) {
+	case pr.MessageType:
+		return x.Descriptor(), nil
+	case pr.MessageDescriptor:
+		return x, nil
+	default:
+		return nil, fmt.Errorf("%T does not describe a message type", x)
+	}
 }
 
 // protoNewUserData creates a new, empty protobuf message based on the
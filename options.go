@@ -0,0 +1,81 @@
+package proto
+
+import (
+	rt "github.com/arnodel/golua/runtime"
+)
+
+// NumberConversion is a policy for converting Lua values to numeric fields.
+type NumberConversion int
+
+// Number conversion policies.
+const (
+	// NumberConversionDefault accepts only Lua integers for integer fields
+	// and any Lua number for floating point fields. Values assigned to float
+	// fields are rounded to single precision.
+	NumberConversionDefault NumberConversion = iota
+
+	// NumberConversionLenient additionally accepts floats with exact integer
+	// values for integer fields, and numeric strings for all numeric fields.
+	NumberConversionLenient
+
+	// NumberConversionStrict is like NumberConversionDefault, but rejects
+	// values which cannot be represented exactly in the field, such as
+	// doubles which overflow or lose precision in a float field, or integers
+	// beyond 2^53 in a double field.
+	NumberConversionStrict
+)
+
+// Options configures the proto package for a Lua runtime.
+// The zero value yields the default behaviour.
+type Options struct {
+	// UnwrapWrappers enables transparent handling of the well-known wrapper
+	// types such as google.protobuf.Int64Value. Reading a field of a wrapper
+	// type yields the wrapped scalar, or nil if the field is unset, and
+	// assigning a scalar to such a field creates the wrapper.
+	UnwrapWrappers bool
+
+	// NumberConversion is the policy for converting Lua values to numeric
+	// fields.
+	NumberConversion NumberConversion
+
+	// BytesUserData causes bytes fields to be read as bytes user data instead
+	// of strings. Bytes user data can be sliced and compared without copying,
+	// and can be assigned to bytes fields like strings.
+	BytesUserData bool
+
+	// RedactToString causes messages converted to strings to be redacted
+	// first, clearing all fields with the debug_redact option.
+	RedactToString bool
+
+	// FieldHook, if not nil, intercepts field accesses from Lua, such as
+	// reads of message fields, list elements and map values, and writes of
+	// message fields. See FieldHook for the operations it covers.
+	FieldHook FieldHook
+}
+
+// optionsKeyType is the type of the registry key under which the options
+// of a runtime are stored.
+type optionsKeyType struct{}
+
+var (
+	// defaultOptions are the options used in runtimes where the proto package
+	// has not been loaded.
+	defaultOptions Options
+
+	// optionsKey is the registry key for the options of a runtime.
+	optionsKey = rt.AsValue(optionsKeyType{})
+)
+
+// runtimeOptions returns the options of the proto package loaded in r.
+func runtimeOptions(r *rt.Runtime) *Options {
+	ud, ok := r.Registry(optionsKey).TryUserData()
+	if !ok {
+		return &defaultOptions
+	}
+	return ud.Value().(*Options)
+}
+
+// setRuntimeOptions stores opts as the options of the proto package in r.
+func setRuntimeOptions(r *rt.Runtime, opts *Options) {
+	r.SetRegistry(optionsKey, rt.UserDataValue(rt.NewUserData(opts, nil)))
+}
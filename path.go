@@ -0,0 +1,98 @@
+package proto
+
+import (
+	"fmt"
+	"sort"
+
+	pr "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// fieldPath returns the path of the field fd in the message at path prefix.
+// Extension fields are enclosed in brackets.
+func fieldPath(prefix string, fd pr.FieldDescriptor) string {
+	name := string(fd.Name())
+	if fd.IsExtension() {
+		name = "[" + string(fd.FullName()) + "]"
+	}
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// listIndexPath returns the path of the list element with the given
+// zero-based index in the list at path prefix.
+// As in Lua, the index in the path is one-based.
+func listIndexPath(prefix string, i int) string {
+	return fmt.Sprintf("%s[%d]", prefix, i+1)
+}
+
+// mapKeyPath returns the path of the map value with key k in the map at
+// path prefix.
+func mapKeyPath(prefix string, k pr.MapKey) string {
+	if s, ok := k.Interface().(string); ok {
+		return fmt.Sprintf("%s[%q]", prefix, s)
+	}
+	return fmt.Sprintf("%s[%v]", prefix, k.Interface())
+}
+
+// unknownPath returns the path of the unknown fields of the message at
+// path prefix.
+func unknownPath(prefix string) string {
+	if prefix == "" {
+		return "[unknown]"
+	}
+	return prefix + ".[unknown]"
+}
+
+// rangeFieldsOrdered calls f for each populated field of rmsg until f
+// returns false. Regular fields are visited in declaration order, followed
+// by extension fields in field number order.
+func rangeFieldsOrdered(
+	rmsg pr.Message, f func(pr.FieldDescriptor, pr.Value) bool,
+) {
+	fields := rmsg.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if rmsg.Has(fd) && !f(fd, rmsg.Get(fd)) {
+			return
+		}
+	}
+	var xds []pr.FieldDescriptor
+	rmsg.Range(func(fd pr.FieldDescriptor, _ pr.Value) bool {
+		if fd.IsExtension() {
+			xds = append(xds, fd)
+		}
+		return true
+	})
+	sort.Slice(xds, func(i, j int) bool {
+		return xds[i].Number() < xds[j].Number()
+	})
+	for _, xd := range xds {
+		if !f(xd, rmsg.Get(xd)) {
+			return
+		}
+	}
+}
+
+// sortedMapKeys returns the keys of m in ascending order.
+func sortedMapKeys(m pr.Map) []pr.MapKey {
+	keys := make([]pr.MapKey, 0, m.Len())
+	m.Range(func(k pr.MapKey, _ pr.Value) bool {
+		keys = append(keys, k)
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		switch x := keys[i].Interface().(type) {
+		case bool:
+			return !x && keys[j].Bool()
+		case int32, int64:
+			return keys[i].Int() < keys[j].Int()
+		case uint32, uint64:
+			return keys[i].Uint() < keys[j].Uint()
+		default:
+			return keys[i].String() < keys[j].String()
+		}
+	})
+	return keys
+}
@@ -0,0 +1,302 @@
+package proto
+
+import (
+	"fmt"
+	"sync"
+
+	rt "github.com/arnodel/golua/runtime"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	pr "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// debugRedactNumber is the field number of the debug_redact field option.
+// The option is newer than some versions of the descriptorpb package, which
+// keep it in the unknown fields of the field options.
+const debugRedactNumber protowire.Number = 16
+
+var (
+	// debugRedactCache caches the result of isDebugRedact, keyed by field
+	// full name.
+	debugRedactCache sync.Map
+
+	// fieldOptionsDescriptor is the descriptor of
+	// google.protobuf.FieldOptions.
+	fieldOptionsDescriptor pr.MessageDescriptor
+)
+
+// redactor redacts messages.
+type redactor struct {
+	// debugRedact causes fields with the debug_redact option to be redacted.
+	debugRedact bool
+
+	// option, if not nil, is a field option extension. Fields for which the
+	// option is set to a value other than false are redacted.
+	option pr.ExtensionType
+
+	// replacement, if valid, replaces redacted singular string and bytes
+	// fields instead of clearing them.
+	replacement pr.Value
+
+	// predicate, if not nil, decides whether the field fd is redacted. If
+	// the returned replacement is valid, it replaces the field instead of
+	// clearing it.
+	predicate func(fd pr.FieldDescriptor) (
+		redact bool, replacement pr.Value, err error)
+
+	// keepUnresolvedAny causes the payloads of Any messages whose type
+	// cannot be resolved to be kept. Otherwise, they are cleared.
+	keepUnresolvedAny bool
+}
+
+// init initializes the redaction methods of messages.
+func init() {
+	fieldOptionsDescriptor = (&descriptorpb.FieldOptions{}).ProtoReflect().
+		Descriptor()
+	setMapFunc(msgMethods, "Redacted", msgRedacted, 2, false, cpuIOTimeSafe)
+}
+
+// isDebugRedact checks whether the field fd has the debug_redact option set.
+func isDebugRedact(fd pr.FieldDescriptor) bool {
+	if redact, ok := debugRedactCache.Load(fd.FullName()); ok {
+		return redact.(bool)
+	}
+	redact := false
+	if opts, ok := fd.Options().(*descriptorpb.FieldOptions); ok && opts != nil {
+		rmsg := opts.ProtoReflect()
+		optFD := rmsg.Descriptor().Fields().ByNumber(debugRedactNumber)
+		if optFD != nil &&
+			optFD.Kind() == pr.BoolKind {
+			redact = rmsg.Get(optFD).Bool()
+		} else {
+			unknown, _ := parseWireFields(rmsg.GetUnknown())
+			for _, field := range unknown {
+				if field.number == debugRedactNumber &&
+					field.typ == protowire.VarintType {
+					redact = field.varint != 0
+				}
+			}
+		}
+	}
+	debugRedactCache.Store(fd.FullName(), redact)
+	return redact
+}
+
+// isOptionSet checks whether the field option extension xt is set to a
+// value other than false for the field fd.
+func isOptionSet(fd pr.FieldDescriptor, xt pr.ExtensionType) (bool, error) {
+	opts, err := resolvedOptions(fd)
+	if err != nil || opts == nil {
+		return false, err
+	}
+	rmsg := opts.ProtoReflect()
+	if !rmsg.Has(xt.TypeDescriptor()) {
+		return false, nil
+	}
+	b, ok := rmsg.Get(xt.TypeDescriptor()).Interface().(bool)
+	return b || !ok, nil
+}
+
+// msgRedacted returns a redacted copy of a message. The optional options
+// table supports the following keys:
+//
+//   - debug_redact: if false, the debug_redact field option is ignored.
+//   - option: the name of a field option extension; fields for which it is
+//     set to a value other than false are redacted.
+//   - predicate: a function called with the descriptor of each populated
+//     field. If it returns true, the field is cleared. If it returns another
+//     value except false or nil, the field is set to that value.
+//   - replacement: a string replacing redacted singular string and bytes
+//     fields instead of clearing them.
+//   - keep_unresolved_any: if true, the payloads of Any messages whose type
+//     cannot be resolved are kept unredacted instead of being cleared.
+func msgRedacted(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	rmsg := readableUserData(t, ud)
+	r := &redactor{debugRedact: true}
+	if c.NArgs() > 1 && !c.Arg(1).IsNil() {
+		optsTable, err := c.TableArg(1)
+		if err != nil {
+			return nil, err
+		}
+		if err = parseRedactOptions(t, r, optsTable); err != nil {
+			return nil, err
+		}
+	}
+	redacted, err := r.redacted(rmsg)
+	if err != nil {
+		return nil, err
+	}
+	return c.PushingNext1(t.Runtime, Wrap(redacted.Interface())), nil
+}
+
+// parseRedactOptions parses the redaction options in optsTable into r.
+// Predicates are called in the thread t.
+func parseRedactOptions(t *rt.Thread, r *redactor, optsTable *rt.Table) error {
+	if v := optsTable.Get(rt.StringValue("debug_redact")); !v.IsNil() {
+		r.debugRedact = rt.Truth(v)
+	}
+	if v := optsTable.Get(rt.StringValue("option")); !v.IsNil() {
+		xt, err := resolveExtension(fieldOptionsDescriptor, v)
+		if err != nil {
+			return err
+		}
+		r.option = xt
+	}
+	if v := optsTable.Get(rt.StringValue("replacement")); !v.IsNil() {
+		s, ok := v.TryString()
+		if !ok {
+			return fmt.Errorf("replacement must be a string, not %s", v.TypeName())
+		}
+		r.replacement = pr.ValueOfString(s)
+	}
+	if v := optsTable.Get(rt.StringValue("keep_unresolved_any")); !v.IsNil() {
+		r.keepUnresolvedAny = rt.Truth(v)
+	}
+	if v := optsTable.Get(rt.StringValue("predicate")); !v.IsNil() {
+		if _, ok := v.TryCallable(); !ok {
+			return fmt.Errorf("predicate must be callable, not %s", v.TypeName())
+		}
+		opts := runtimeOptions(t.Runtime)
+		r.predicate = func(fd pr.FieldDescriptor) (bool, pr.Value, error) {
+			ret, err := rt.Call1(t, v, wrapDescriptor(fd))
+			if err != nil || !rt.Truth(ret) {
+				return false, pr.Value{}, err
+			}
+			if b, ok := ret.TryBool(); ok && b {
+				return true, pr.Value{}, nil
+			}
+			replacement, err := luaToProtoValue(opts, fd, ret)
+			return err == nil, replacement, err
+		}
+	}
+	return nil
+}
+
+// redacted returns a redacted copy of rmsg.
+func (r *redactor) redacted(rmsg pr.Message) (pr.Message, error) {
+	redacted := cloneMessage(rmsg)
+	if err := r.redact(redacted); err != nil {
+		return nil, err
+	}
+	return redacted, nil
+}
+
+// redact redacts the mutable message rmsg in place.
+func (r *redactor) redact(rmsg pr.Message) error {
+	var fds []pr.FieldDescriptor
+	rmsg.Range(func(fd pr.FieldDescriptor, _ pr.Value) bool {
+		fds = append(fds, fd)
+		return true
+	})
+	for _, fd := range fds {
+		redact, replacement, err := r.decide(fd)
+		if err != nil {
+			return err
+		}
+		switch {
+		case redact && replacement.IsValid():
+			rmsg.Set(fd, replacement)
+		case redact:
+			rmsg.Clear(fd)
+		default:
+			if err = r.redactValue(fd, rmsg.Get(fd)); err != nil {
+				return err
+			}
+		}
+	}
+	if rmsg.Descriptor().FullName() == anyFullName {
+		return r.redactAny(rmsg)
+	}
+	return nil
+}
+
+// decide decides whether the field fd is to be redacted, and with which
+// replacement value.
+func (r *redactor) decide(fd pr.FieldDescriptor) (bool, pr.Value, error) {
+	redact := r.debugRedact && isDebugRedact(fd)
+	if !redact && r.option != nil {
+		var err error
+		if redact, err = isOptionSet(fd, r.option); err != nil {
+			return false, pr.Value{}, err
+		}
+	}
+	if redact {
+		return true, r.replacementFor(fd), nil
+	}
+	if r.predicate != nil {
+		return r.predicate(fd)
+	}
+	return false, pr.Value{}, nil
+}
+
+// replacementFor returns the replacement value for the redacted field fd,
+// or an invalid value if fd is to be cleared.
+func (r *redactor) replacementFor(fd pr.FieldDescriptor) pr.Value {
+	if !r.replacement.IsValid() || fd.IsList() || fd.IsMap() {
+		return pr.Value{}
+	}
+	switch fd.Kind() {
+	case pr.StringKind:
+		return r.replacement
+	case pr.BytesKind:
+		return pr.ValueOfBytes([]byte(r.replacement.String()))
+	default:
+		return pr.Value{}
+	}
+}
+
+// redactValue redacts the messages contained in the value v of the field
+// fd in place.
+func (r *redactor) redactValue(fd pr.FieldDescriptor, v pr.Value) error {
+	switch {
+	case fd.IsList() &&
+		(fd.Kind() == pr.MessageKind || fd.Kind() == pr.GroupKind):
+		list := v.List()
+		for i := 0; i < list.Len(); i++ {
+			if err := r.redact(list.Get(i).Message()); err != nil {
+				return err
+			}
+		}
+	case fd.IsMap() && fd.MapValue().Kind() == pr.MessageKind:
+		var err error
+		v.Map().Range(func(_ pr.MapKey, v pr.Value) bool {
+			err = r.redact(v.Message())
+			return err == nil
+		})
+		return err
+	case !fd.IsList() && !fd.IsMap() &&
+		(fd.Kind() == pr.MessageKind || fd.Kind() == pr.GroupKind):
+		return r.redact(v.Message())
+	}
+	return nil
+}
+
+// redactAny redacts the payload of the Any message rmsg in place.
+// Payloads of unknown type cannot be redacted and are cleared, unless
+// keepUnresolvedAny is set.
+func (r *redactor) redactAny(rmsg pr.Message) error {
+	typeURL, value := anyFields(rmsg)
+	mt, err := findMessageType(typeURL)
+	if err != nil {
+		if !r.keepUnresolvedAny {
+			rmsg.Clear(rmsg.Descriptor().Fields().ByName("value"))
+		}
+		return nil
+	}
+	payload := mt.New()
+	if err = proto.Unmarshal(value, payload.Interface()); err != nil {
+		return err
+	}
+	if err = r.redact(payload); err != nil {
+		return err
+	}
+	value, err = proto.MarshalOptions{Deterministic: true}.
+		Marshal(payload.Interface())
+	if err != nil {
+		return err
+	}
+	rmsg.Set(rmsg.Descriptor().Fields().ByName("value"), pr.ValueOfBytes(value))
+	return nil
+}
@@ -0,0 +1,545 @@
+package proto_test
+
+import (
+	proto "github.com/TheCount/golua-proto"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// testSchema is the schema of the messages used in the Lua tests.
+const testSchema = `
+name: "golua/test.proto"
+package: "golua.test"
+dependency: "google/protobuf/wrappers.proto"
+syntax: "proto3"
+message_type {
+  name: "Scalars"
+  field {
+    name: "i32" number: 1 label: LABEL_OPTIONAL type: TYPE_INT32
+  }
+  field {
+    name: "i64" number: 2 label: LABEL_OPTIONAL type: TYPE_INT64
+  }
+  field {
+    name: "u32" number: 3 label: LABEL_OPTIONAL type: TYPE_UINT32
+  }
+  field {
+    name: "u64" number: 4 label: LABEL_OPTIONAL type: TYPE_UINT64
+  }
+  field {
+    name: "si32" number: 5 label: LABEL_OPTIONAL type: TYPE_SINT32
+  }
+  field {
+    name: "si64" number: 6 label: LABEL_OPTIONAL type: TYPE_SINT64
+  }
+  field {
+    name: "fx32" number: 7 label: LABEL_OPTIONAL type: TYPE_FIXED32
+  }
+  field {
+    name: "fx64" number: 8 label: LABEL_OPTIONAL type: TYPE_FIXED64
+  }
+  field {
+    name: "sfx32" number: 9 label: LABEL_OPTIONAL type: TYPE_SFIXED32
+  }
+  field {
+    name: "sfx64" number: 10 label: LABEL_OPTIONAL type: TYPE_SFIXED64
+  }
+  field {
+    name: "fl" number: 11 label: LABEL_OPTIONAL type: TYPE_FLOAT
+  }
+  field {
+    name: "db" number: 12 label: LABEL_OPTIONAL type: TYPE_DOUBLE
+  }
+  field {
+    name: "b" number: 13 label: LABEL_OPTIONAL type: TYPE_BOOL
+  }
+  field {
+    name: "s" number: 14 label: LABEL_OPTIONAL type: TYPE_STRING
+  }
+  field {
+    name: "bs" number: 15 label: LABEL_OPTIONAL type: TYPE_BYTES
+  }
+  field {
+    name: "e" number: 16 label: LABEL_OPTIONAL
+    type: TYPE_ENUM type_name: ".golua.test.Color"
+  }
+  field {
+    name: "u64s" number: 17 label: LABEL_REPEATED type: TYPE_UINT64
+  }
+  field {
+    name: "u64map" number: 18 label: LABEL_REPEATED
+    type: TYPE_MESSAGE type_name: ".golua.test.Scalars.U64mapEntry"
+  }
+  nested_type {
+    name: "U64mapEntry"
+    field { name: "key" number: 1 label: LABEL_OPTIONAL type: TYPE_UINT64 }
+    field { name: "value" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+    options { map_entry: true }
+  }
+}
+enum_type {
+  name: "Color"
+  value { name: "COLOR_UNSPECIFIED" number: 0 }
+  value { name: "RED" number: 1 }
+}
+message_type {
+  name: "Wrappers"
+  field {
+    name: "i32" number: 1 label: LABEL_OPTIONAL
+    type: TYPE_MESSAGE type_name: ".google.protobuf.Int32Value"
+  }
+  field {
+    name: "i64" number: 2 label: LABEL_OPTIONAL
+    type: TYPE_MESSAGE type_name: ".google.protobuf.Int64Value"
+  }
+  field {
+    name: "u32" number: 3 label: LABEL_OPTIONAL
+    type: TYPE_MESSAGE type_name: ".google.protobuf.UInt32Value"
+  }
+  field {
+    name: "u64" number: 4 label: LABEL_OPTIONAL
+    type: TYPE_MESSAGE type_name: ".google.protobuf.UInt64Value"
+  }
+  field {
+    name: "f" number: 5 label: LABEL_OPTIONAL
+    type: TYPE_MESSAGE type_name: ".google.protobuf.FloatValue"
+  }
+  field {
+    name: "d" number: 6 label: LABEL_OPTIONAL
+    type: TYPE_MESSAGE type_name: ".google.protobuf.DoubleValue"
+  }
+  field {
+    name: "b" number: 7 label: LABEL_OPTIONAL
+    type: TYPE_MESSAGE type_name: ".google.protobuf.BoolValue"
+  }
+  field {
+    name: "s" number: 8 label: LABEL_OPTIONAL
+    type: TYPE_MESSAGE type_name: ".google.protobuf.StringValue"
+  }
+  field {
+    name: "bs" number: 9 label: LABEL_OPTIONAL
+    type: TYPE_MESSAGE type_name: ".google.protobuf.BytesValue"
+  }
+  field {
+    name: "list" number: 10 label: LABEL_REPEATED
+    type: TYPE_MESSAGE type_name: ".google.protobuf.Int64Value"
+  }
+}
+`
+
+// testExtSchema is the schema of the proto2 messages and extensions used in
+// the Lua tests.
+const testExtSchema = `
+name: "golua/ext.proto"
+package: "golua.test"
+syntax: "proto2"
+message_type {
+  name: "Extendable"
+  field {
+    name: "name" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING
+  }
+  extension_range { start: 100 end: 200 }
+}
+message_type {
+  name: "Required"
+  field {
+    name: "id" number: 1 label: LABEL_REQUIRED type: TYPE_STRING
+  }
+  field {
+    name: "child" number: 2 label: LABEL_OPTIONAL
+    type: TYPE_MESSAGE type_name: ".golua.test.Required"
+  }
+  field {
+    name: "children" number: 3 label: LABEL_REPEATED
+    type: TYPE_MESSAGE type_name: ".golua.test.Required"
+  }
+  field {
+    name: "by_name" number: 4 label: LABEL_REPEATED
+    type: TYPE_MESSAGE type_name: ".golua.test.Required.ByNameEntry"
+  }
+  nested_type {
+    name: "ByNameEntry"
+    field {
+      name: "key" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING
+    }
+    field {
+      name: "value" number: 2 label: LABEL_OPTIONAL
+      type: TYPE_MESSAGE type_name: ".golua.test.Required"
+    }
+    options { map_entry: true }
+  }
+}
+message_type {
+  name: "Grouped"
+  field {
+    name: "item" number: 1 label: LABEL_OPTIONAL
+    type: TYPE_GROUP type_name: ".golua.test.Grouped.Item"
+  }
+  field {
+    name: "items" number: 2 label: LABEL_REPEATED
+    type: TYPE_GROUP type_name: ".golua.test.Grouped.Items"
+  }
+  nested_type {
+    name: "Item"
+    field {
+      name: "id" number: 3 label: LABEL_REQUIRED type: TYPE_STRING
+    }
+    field {
+      name: "note" number: 4 label: LABEL_OPTIONAL type: TYPE_STRING
+    }
+  }
+  nested_type {
+    name: "Items"
+    field {
+      name: "id" number: 5 label: LABEL_REQUIRED type: TYPE_STRING
+    }
+    field {
+      name: "note" number: 6 label: LABEL_OPTIONAL type: TYPE_STRING
+    }
+  }
+}
+extension {
+  name: "ext_i32" number: 100 label: LABEL_OPTIONAL type: TYPE_INT32
+  extendee: ".golua.test.Extendable"
+}
+extension {
+  name: "ext_s" number: 101 label: LABEL_OPTIONAL type: TYPE_STRING
+  extendee: ".golua.test.Extendable"
+}
+extension {
+  name: "ext_list" number: 102 label: LABEL_REPEATED type: TYPE_INT64
+  extendee: ".golua.test.Extendable"
+}
+extension {
+  name: "ext_msg" number: 103 label: LABEL_OPTIONAL
+  type: TYPE_MESSAGE type_name: ".golua.test.Extendable"
+  extendee: ".golua.test.Extendable"
+}
+`
+
+// testOptionsSchema defines the custom options used in the Lua tests.
+const testOptionsSchema = `
+name: "golua/options.proto"
+package: "golua.test"
+dependency: "google/protobuf/descriptor.proto"
+syntax: "proto2"
+extension {
+  name: "table" number: 51000 label: LABEL_OPTIONAL type: TYPE_STRING
+  extendee: ".google.protobuf.MessageOptions"
+}
+extension {
+  name: "sensitive" number: 51000 label: LABEL_OPTIONAL type: TYPE_BOOL
+  extendee: ".google.protobuf.FieldOptions"
+}
+extension {
+  name: "choice_hint" number: 51000 label: LABEL_OPTIONAL type: TYPE_STRING
+  extendee: ".google.protobuf.OneofOptions"
+}
+extension {
+  name: "enum_hint" number: 51000 label: LABEL_OPTIONAL type: TYPE_STRING
+  extendee: ".google.protobuf.EnumOptions"
+}
+extension {
+  name: "display" number: 51000 label: LABEL_OPTIONAL type: TYPE_STRING
+  extendee: ".google.protobuf.EnumValueOptions"
+}
+extension {
+  name: "owner" number: 51000 label: LABEL_OPTIONAL type: TYPE_STRING
+  extendee: ".google.protobuf.ServiceOptions"
+}
+extension {
+  name: "cacheable" number: 51000 label: LABEL_OPTIONAL type: TYPE_BOOL
+  extendee: ".google.protobuf.MethodOptions"
+}
+`
+
+// testAnnotatedSchema is the schema of the annotated messages and services
+// used in the Lua tests.
+const testAnnotatedSchema = `
+name: "golua/annotated.proto"
+package: "golua.test"
+dependency: "golua/options.proto"
+syntax: "proto3"
+message_type {
+  name: "Annotated"
+  field {
+    name: "secret" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING
+    options { [golua.test.sensitive]: true }
+  }
+  field {
+    name: "plain" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING
+    options { deprecated: true }
+  }
+  field {
+    name: "a" number: 3 label: LABEL_OPTIONAL type: TYPE_STRING oneof_index: 0
+  }
+  field {
+    name: "level" number: 4 label: LABEL_OPTIONAL
+    type: TYPE_ENUM type_name: ".golua.test.Level"
+  }
+  oneof_decl {
+    name: "choice"
+    options { [golua.test.choice_hint]: "pick one" }
+  }
+  options { [golua.test.table]: "annotated" }
+}
+enum_type {
+  name: "Level"
+  value { name: "LEVEL_UNSPECIFIED" number: 0 }
+  value {
+    name: "LEVEL_HIGH" number: 1
+    options { [golua.test.display]: "High" }
+  }
+  options { [golua.test.enum_hint]: "levels" }
+}
+service {
+  name: "AnnotatedService"
+  method {
+    name: "Get"
+    input_type: ".golua.test.Annotated" output_type: ".golua.test.Annotated"
+    options { [golua.test.cacheable]: true }
+  }
+  options { [golua.test.owner]: "team" }
+}
+`
+
+// testValidatedSchema is the schema of the messages with validation rules
+// used in the Lua tests.
+const testValidatedSchema = `
+name: "golua/validated.proto"
+package: "golua.test"
+dependency: "golua/test.proto"
+dependency: "golua/validate.proto"
+syntax: "proto2"
+message_type {
+  name: "Validated"
+  field {
+    name: "name" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING
+    options {
+      [golua.validate.field] { min_len: 2 max_len: 5 pattern: "^[a-z]+$" }
+    }
+  }
+  field {
+    name: "age" number: 2 label: LABEL_OPTIONAL type: TYPE_INT32
+    options { [golua.validate.field] { min: 0 max: 150 } }
+  }
+  field {
+    name: "email" number: 3 label: LABEL_OPTIONAL type: TYPE_STRING
+    options { [golua.validate.field] { required: true } }
+  }
+  field {
+    name: "color" number: 4 label: LABEL_OPTIONAL
+    type: TYPE_ENUM type_name: ".golua.test.Color"
+    options { [golua.validate.field] { not_in: "COLOR_UNSPECIFIED" } }
+  }
+  field {
+    name: "tags" number: 5 label: LABEL_REPEATED type: TYPE_STRING
+    options {
+      [golua.validate.field] {
+        max_len: 3 unique: true in: ["a", "b", "c"]
+      }
+    }
+  }
+  field {
+    name: "child" number: 6 label: LABEL_OPTIONAL
+    type: TYPE_MESSAGE type_name: ".golua.test.Validated"
+  }
+  options {
+    [golua.validate.message] {
+      constraints {
+        expr: "msg.age >= 18 or not msg:Has('email')"
+        message: "minors must not have an email address"
+      }
+    }
+  }
+}
+message_type {
+  name: "Sandboxed"
+  options {
+    [golua.validate.message] {
+      constraints {
+        expr: "type(msg) == 'userdata' and proto == nil and print == nil"
+        message: "constraints see the global environment"
+      }
+      constraints {
+        expr: "leaked = true msg = nil return true"
+      }
+      constraints {
+        expr: "msg ~= nil and leaked == nil"
+        message: "constraints share globals"
+      }
+    }
+  }
+}
+`
+
+// testRedactedSchema is the schema of the messages used in the redaction
+// tests. The email field additionally has the debug_redact option, see init.
+const testRedactedSchema = `
+name: "golua/redacted.proto"
+package: "golua.test"
+dependency: "golua/options.proto"
+dependency: "google/protobuf/any.proto"
+syntax: "proto3"
+message_type {
+  name: "Redacted"
+  field {
+    name: "name" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING
+  }
+  field {
+    name: "email" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING
+    options {}
+  }
+  field {
+    name: "note" number: 3 label: LABEL_OPTIONAL type: TYPE_STRING
+    options { [golua.test.sensitive]: true }
+  }
+  field {
+    name: "age" number: 4 label: LABEL_OPTIONAL type: TYPE_INT32
+  }
+  field {
+    name: "child" number: 5 label: LABEL_OPTIONAL
+    type: TYPE_MESSAGE type_name: ".golua.test.Redacted"
+  }
+  field {
+    name: "children" number: 6 label: LABEL_REPEATED
+    type: TYPE_MESSAGE type_name: ".golua.test.Redacted"
+  }
+  field {
+    name: "payload" number: 7 label: LABEL_OPTIONAL
+    type: TYPE_MESSAGE type_name: ".google.protobuf.Any"
+  }
+  field {
+    name: "by_name" number: 8 label: LABEL_REPEATED
+    type: TYPE_MESSAGE type_name: ".golua.test.Redacted.ByNameEntry"
+  }
+  nested_type {
+    name: "ByNameEntry"
+    field {
+      name: "key" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING
+    }
+    field {
+      name: "value" number: 2 label: LABEL_OPTIONAL
+      type: TYPE_MESSAGE type_name: ".golua.test.Redacted"
+    }
+    options { map_entry: true }
+  }
+}
+`
+
+// testServiceSchema is the schema of the services used in the RPC tests.
+const testServiceSchema = `
+name: "golua/service.proto"
+package: "golua.test"
+dependency: "golua/options.proto"
+syntax: "proto3"
+message_type {
+  name: "EchoRequest"
+  field {
+    name: "message" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING
+  }
+  field {
+    name: "count" number: 2 label: LABEL_OPTIONAL type: TYPE_INT32
+  }
+}
+message_type {
+  name: "EchoResponse"
+  field {
+    name: "message" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING
+  }
+  field {
+    name: "index" number: 2 label: LABEL_OPTIONAL type: TYPE_INT32
+  }
+}
+service {
+  name: "Echo"
+  method {
+    name: "Say"
+    input_type: ".golua.test.EchoRequest"
+    output_type: ".golua.test.EchoResponse"
+    options { [golua.test.cacheable]: true }
+  }
+  method {
+    name: "Repeat"
+    input_type: ".golua.test.EchoRequest"
+    output_type: ".golua.test.EchoResponse"
+    server_streaming: true
+  }
+  method {
+    name: "Collect"
+    input_type: ".golua.test.EchoRequest"
+    output_type: ".golua.test.EchoResponse"
+    client_streaming: true
+  }
+  method {
+    name: "Chat"
+    input_type: ".golua.test.EchoRequest"
+    output_type: ".golua.test.EchoResponse"
+    client_streaming: true server_streaming: true
+  }
+  options { [golua.test.owner]: "echo team" }
+}
+`
+
+// init registers the test schemas in the global registries.
+func init() {
+	registerSchema(testSchema)
+	registerSchema(testExtSchema)
+	registerSchema(testOptionsSchema)
+	registerSchema(testAnnotatedSchema)
+	if err := proto.RegisterValidateSchema(); err != nil {
+		panic(err)
+	}
+	registerSchema(testValidatedSchema)
+	registerSchema(testServiceSchema)
+	redacted := parseSchema(testRedactedSchema)
+	// The debug_redact option is unknown to descriptorpb, so it is added
+	// as an unknown field.
+	emailOptions := redacted.MessageType[0].Field[1].Options.ProtoReflect()
+	emailOptions.SetUnknown(protowire.AppendVarint(
+		protowire.AppendTag(nil, 16, protowire.VarintType), 1))
+	registerFile(redacted)
+}
+
+// parseSchema parses the given FileDescriptorProto in text format.
+func parseSchema(schema string) *descriptorpb.FileDescriptorProto {
+	fdp := new(descriptorpb.FileDescriptorProto)
+	if err := prototext.Unmarshal([]byte(schema), fdp); err != nil {
+		panic(err)
+	}
+	return fdp
+}
+
+// registerSchema registers the messages and extensions of the given
+// FileDescriptorProto in text format in the global registries.
+func registerSchema(schema string) {
+	registerFile(parseSchema(schema))
+}
+
+// registerFile registers the messages and extensions of the given
+// FileDescriptorProto in the global registries.
+func registerFile(fdp *descriptorpb.FileDescriptorProto) {
+	fd, err := protodesc.NewFile(fdp, protoregistry.GlobalFiles)
+	if err != nil {
+		panic(err)
+	}
+	if err = protoregistry.GlobalFiles.RegisterFile(fd); err != nil {
+		panic(err)
+	}
+	for i := 0; i < fd.Messages().Len(); i++ {
+		mt := dynamicpb.NewMessageType(fd.Messages().Get(i))
+		if err = protoregistry.GlobalTypes.RegisterMessage(mt); err != nil {
+			panic(err)
+		}
+	}
+	for i := 0; i < fd.Extensions().Len(); i++ {
+		xt := dynamicpb.NewExtensionType(fd.Extensions().Get(i))
+		if err = protoregistry.GlobalTypes.RegisterExtension(xt); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package proto
+
+import (
+	"fmt"
+
+	rt "github.com/arnodel/golua/runtime"
+	pr "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+var (
+	// serviceMethods are the additional methods for service descriptors.
+	serviceMethods = make(map[string]rt.Value)
+
+	// methodMethods are the additional methods for method descriptors.
+	methodMethods = make(map[string]rt.Value)
+)
+
+// init initializes serviceMethods and methodMethods.
+func init() {
+	setMapFunc(serviceMethods, "Method", serviceMethod, 2, false,
+		cpuIOMemTimeSafe)
+	setMapFunc(serviceMethods, "Methods", serviceMethodList, 1, false,
+		cpuIOTimeSafe)
+	setMapFunc(methodMethods, "Input", methodInput, 1, false,
+		cpuIOMemTimeSafe)
+	setMapFunc(methodMethods, "IsClientStreaming", methodIsClientStreaming, 1,
+		false, cpuIOMemTimeSafe)
+	setMapFunc(methodMethods, "IsServerStreaming", methodIsServerStreaming, 1,
+		false, cpuIOMemTimeSafe)
+	setMapFunc(methodMethods, "Output", methodOutput, 1, false,
+		cpuIOMemTimeSafe)
+	setMapFunc(methodMethods, "Service", methodService, 1, false,
+		cpuIOMemTimeSafe)
+}
+
+// findService looks up a service descriptor by full name.
+func findService(name string) (pr.ServiceDescriptor, error) {
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName(
+		pr.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("no such service: %s", name)
+	}
+	sd, ok := desc.(pr.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("no such service: %s", name)
+	}
+	return sd, nil
+}
+
+// messageTypeOf returns the message type for md. Types missing from the
+// global type registry are created dynamically.
+func messageTypeOf(md pr.MessageDescriptor) pr.MessageType {
+	mt, err := protoregistry.GlobalTypes.FindMessageByName(md.FullName())
+	if err != nil {
+		return dynamicpb.NewMessageType(md)
+	}
+	return mt
+}
+
+// methodInput returns the input message type of a method descriptor.
+func methodInput(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	md := ud.Value().(pr.MethodDescriptor)
+	return c.PushingNext1(t.Runtime, wrapType(messageTypeOf(md.Input()))), nil
+}
+
+// methodIsClientStreaming checks whether the client sends a stream of
+// messages to a method.
+func methodIsClientStreaming(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	return pushingBool(t, c, ud.Value().(pr.MethodDescriptor).IsStreamingClient())
+}
+
+// methodIsServerStreaming checks whether the server sends a stream of
+// messages from a method.
+func methodIsServerStreaming(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	return pushingBool(t, c, ud.Value().(pr.MethodDescriptor).IsStreamingServer())
+}
+
+// methodOutput returns the output message type of a method descriptor.
+func methodOutput(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	md := ud.Value().(pr.MethodDescriptor)
+	return c.PushingNext1(t.Runtime, wrapType(messageTypeOf(md.Output()))), nil
+}
+
+// methodService returns the service descriptor of a method descriptor.
+func methodService(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	md := ud.Value().(pr.MethodDescriptor)
+	return c.PushingNext1(t.Runtime, wrapDescriptor(md.Parent())), nil
+}
+
+// protoService looks up a service descriptor by full name.
+func protoService(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	if err := c.Check1Arg(); err != nil {
+		return nil, err
+	}
+	name, err := c.StringArg(0)
+	if err != nil {
+		return nil, err
+	}
+	sd, err := findService(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.PushingNext1(t.Runtime, wrapDescriptor(sd)), nil
+}
+
+// serviceMethod returns the method descriptor with the given name of a
+// service descriptor, or nil if there is no such method.
+func serviceMethod(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	if err := c.CheckNArgs(2); err != nil {
+		return nil, err
+	}
+	ud, _ := c.UserDataArg(0)
+	name, err := c.StringArg(1)
+	if err != nil {
+		return nil, err
+	}
+	sd := ud.Value().(pr.ServiceDescriptor)
+	md := sd.Methods().ByName(pr.Name(name))
+	if md == nil {
+		return c.PushingNext1(t.Runtime, rt.NilValue), nil
+	}
+	return c.PushingNext1(t.Runtime, wrapDescriptor(md)), nil
+}
+
+// serviceMethodList returns the list of method descriptors of a service
+// descriptor in declaration order.
+func serviceMethodList(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	methods := ud.Value().(pr.ServiceDescriptor).Methods()
+	tbl := rt.NewTable()
+	for i := 0; i < methods.Len(); i++ {
+		t.Runtime.SetTable(
+			tbl, rt.IntValue(int64(i)+1), wrapDescriptor(methods.Get(i)))
+	}
+	return c.PushingNext1(t.Runtime, rt.TableValue(tbl)), nil
+}
@@ -0,0 +1,318 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	rt "github.com/arnodel/golua/runtime"
+	"google.golang.org/protobuf/proto"
+	pr "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// streamYield tags the values yielded by a stream handler to identify what
+// the handler waits for. Lua code cannot create values of this type, so
+// plain coroutine yields are not mistaken for stream operations.
+type streamYield int
+
+// Yield tags identifying what a stream handler waits for.
+const (
+	// streamYieldRecv is yielded by stream:Recv() to wait for a request.
+	streamYieldRecv streamYield = iota
+
+	// streamYieldSend is yielded by stream:Send() together with a response.
+	streamYieldSend
+)
+
+var (
+	// streamTable is the metatable for stream userdata values.
+	streamTable *rt.Table
+
+	// streamMethods are the methods for streams.
+	streamMethods = make(map[string]rt.Value)
+)
+
+// Stream is a call of a streaming method handled in Lua. The handler runs
+// in a Lua coroutine, which yields whenever the handler sends a response
+// or waits for a request.
+//
+// Handlers of server streaming methods are called with the request message
+// and the stream, and send their responses with stream:Send(msg).
+// Handlers of client streaming methods are called with the stream, receive
+// requests with stream:Recv(), which returns nil after the last request, and
+// return the response message. Handlers of bidirectional streaming methods
+// are called with the stream and use both stream:Recv() and stream:Send().
+//
+// Requests may be sent from any goroutine, but Recv must not be called
+// concurrently with other uses of the Lua runtime.
+type Stream struct {
+	// method is the called method.
+	method pr.MethodDescriptor
+
+	// runtime is the Lua runtime in which the handler runs.
+	runtime *rt.Runtime
+
+	// handler is the handler function.
+	handler rt.Value
+
+	// co is the coroutine running the handler, or nil if the handler has not
+	// been started yet.
+	co *rt.Thread
+
+	// mu protects requests and closed.
+	mu sync.Mutex
+
+	// cond signals changes to requests and closed.
+	cond *sync.Cond
+
+	// requests are the pending requests.
+	requests []proto.Message
+
+	// closed is true if no more requests will be sent.
+	closed bool
+
+	// err is the final error, or io.EOF if the handler returned normally.
+	err error
+}
+
+// init initializes streamTable and streamMethods.
+func init() {
+	streamTable = rt.NewTable()
+	streamTable.Set(rt.StringValue("__name"), rt.StringValue("stream"))
+	setMapFunc(streamMethods, "Method", streamMethod, 1, false,
+		cpuIOMemTimeSafe)
+	setMapFunc(streamMethods, "Recv", streamRecv, 1, false, cpuIOTimeSafe)
+	setMapFunc(streamMethods, "Send", streamSend, 2, false, cpuIOTimeSafe)
+	setTableFunc("__index", streamIndex, 2, false, cpuIOMemTimeSafe, streamTable)
+}
+
+// DispatchStream starts a call of the streaming method with the given name.
+// The handler starts running on the first call of Recv.
+func (d *Dispatcher) DispatchStream(method string) (*Stream, error) {
+	md, handler, err := d.method(method)
+	if err != nil {
+		return nil, err
+	}
+	if !md.IsStreamingClient() && !md.IsStreamingServer() {
+		return nil, fmt.Errorf("%s is not a streaming method", md.FullName())
+	}
+	s := &Stream{
+		method:  md,
+		runtime: d.runtime,
+		handler: handler,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s, nil
+}
+
+// Send sends the request req to the handler.
+func (s *Stream) Send(req proto.Message) error {
+	if err := checkMessageType(req, s.method.Input()); err != nil {
+		return fmt.Errorf("%s: bad request: %w", s.method.FullName(), err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fmt.Errorf("%s: send on closed stream", s.method.FullName())
+	}
+	s.requests = append(s.requests, req)
+	s.cond.Signal()
+	return nil
+}
+
+// CloseSend signals that no more requests will be sent.
+func (s *Stream) CloseSend() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cond.Signal()
+}
+
+// nextRequest waits for the next request. It returns nil once the requests
+// are exhausted.
+func (s *Stream) nextRequest() proto.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.requests) == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if len(s.requests) == 0 {
+		return nil
+	}
+	req := s.requests[0]
+	s.requests = s.requests[1:]
+	return req
+}
+
+// Recv runs the handler until it sends the next response, and returns it.
+// When the handler waits for a request, Recv waits until one is sent with
+// Send or CloseSend is called. The response of a client streaming method is
+// the return value of the handler. After the last response, Recv returns
+// io.EOF, or the error raised by the handler.
+func (s *Stream) Recv() (proto.Message, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	var args []rt.Value
+	if s.co == nil {
+		streamValue := rt.UserDataValue(rt.NewUserData(s, streamTable))
+		args = []rt.Value{streamValue}
+		if !s.method.IsStreamingClient() {
+			req := s.nextRequest()
+			if req == nil {
+				s.err = fmt.Errorf("%s: missing request", s.method.FullName())
+				return nil, s.err
+			}
+			args = []rt.Value{Wrap(req), streamValue}
+		}
+		s.co = rt.NewThread(s.runtime)
+		s.co.Start(s.handler.AsCallable())
+	}
+	for {
+		yielded, err := s.co.Resume(s.runtime.MainThread(), args)
+		if err != nil {
+			s.err = fmt.Errorf("%s: %w", s.method.FullName(), err)
+			return nil, s.err
+		}
+		if s.co.Status() == rt.ThreadDead {
+			s.err = io.EOF
+			if s.method.IsStreamingServer() {
+				return nil, s.err
+			}
+			ret := rt.NilValue
+			if len(yielded) > 0 {
+				ret = yielded[0]
+			}
+			resp, err := checkResponse(s.method, ret)
+			if err != nil {
+				s.err = err
+				return nil, err
+			}
+			return resp, nil
+		}
+		var tag any
+		if len(yielded) > 0 {
+			tag = yielded[0].Interface()
+		}
+		switch {
+		case tag == streamYieldSend && len(yielded) == 2:
+			if resp, ok := Unwrap(yielded[1]); ok {
+				return resp, nil
+			}
+		case tag == streamYieldRecv && len(yielded) == 1:
+			args = []rt.Value{rt.NilValue}
+			if req := s.nextRequest(); req != nil {
+				args[0] = Wrap(req)
+			}
+			continue
+		}
+		s.Close()
+		s.err = fmt.Errorf("%s: handler yielded outside of stream methods",
+			s.method.FullName())
+		return nil, s.err
+	}
+}
+
+// Close stops the handler if it is still running.
+func (s *Stream) Close() error {
+	s.CloseSend()
+	if s.co == nil || s.co.Status() == rt.ThreadDead {
+		return nil
+	}
+	if s.err == nil {
+		s.err = fmt.Errorf("%s: stream closed", s.method.FullName())
+	}
+	_, err := s.co.Close(s.runtime.MainThread())
+	return err
+}
+
+// streamArg returns the stream passed as first argument and checks that it
+// is used from within its handler.
+func streamArg(t *rt.Thread, c *rt.GoCont) (*Stream, error) {
+	ud, err := c.UserDataArg(0)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := ud.Value().(*Stream)
+	if !ok {
+		return nil, errors.New("stream expected")
+	}
+	if t != s.co {
+		return nil, errors.New("stream used outside of its handler")
+	}
+	return s, nil
+}
+
+// streamIndex implements the index operation for streams.
+// Only methods can be indexed.
+func streamIndex(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	s, ok := c.Arg(1).TryString()
+	if !ok {
+		return c.Next(), nil
+	}
+	if ret, ok := streamMethods[s]; ok {
+		return c.PushingNext1(t.Runtime, ret), nil
+	}
+	return c.Next(), nil
+}
+
+// streamMethod returns the method descriptor of a stream.
+func streamMethod(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, err := c.UserDataArg(0)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := ud.Value().(*Stream)
+	if !ok {
+		return nil, errors.New("stream expected")
+	}
+	return c.PushingNext1(t.Runtime, wrapDescriptor(s.method)), nil
+}
+
+// streamRecv waits for the next request of a client or bidirectional
+// streaming method. It returns nil after the last request.
+func streamRecv(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	s, err := streamArg(t, c)
+	if err != nil {
+		return nil, err
+	}
+	if !s.method.IsStreamingClient() {
+		return nil, fmt.Errorf("%s does not receive a stream of requests",
+			s.method.FullName())
+	}
+	ret, err := t.Yield([]rt.Value{rt.AsValue(streamYieldRecv)})
+	if err != nil {
+		return nil, err
+	}
+	return c.PushingNext(t.Runtime, ret...), nil
+}
+
+// streamSend sends a response of a server or bidirectional streaming
+// method. The response is copied, so it may be reused afterwards.
+func streamSend(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	if err := c.CheckNArgs(2); err != nil {
+		return nil, err
+	}
+	s, err := streamArg(t, c)
+	if err != nil {
+		return nil, err
+	}
+	if !s.method.IsStreamingServer() {
+		return nil, fmt.Errorf("%s does not send a stream of responses",
+			s.method.FullName())
+	}
+	resp, ok := Unwrap(c.Arg(1))
+	if !ok {
+		return nil, fmt.Errorf("message expected, got %s", c.Arg(1).TypeName())
+	}
+	if err = checkMessageType(resp, s.method.Output()); err != nil {
+		return nil, fmt.Errorf("%s: bad response: %w", s.method.FullName(), err)
+	}
+	resp = cloneMessage(resp.ProtoReflect()).Interface()
+	_, err = t.Yield([]rt.Value{rt.AsValue(streamYieldSend), Wrap(resp)})
+	if err != nil {
+		return nil, err
+	}
+	return c.Next(), nil
+}
@@ -0,0 +1,289 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	rt "github.com/arnodel/golua/runtime"
+	"google.golang.org/protobuf/proto"
+	pr "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Full names of the well-known JSON-like types.
+const (
+	listValueFullName = pr.FullName("google.protobuf.ListValue")
+	structFullName    = pr.FullName("google.protobuf.Struct")
+	valueFullName     = pr.FullName("google.protobuf.Value")
+)
+
+// toValueOptions controls the conversion of Lua values to
+// google.protobuf.Value messages.
+type toValueOptions struct {
+	// mixedAsObject causes tables with both array and hash parts to be
+	// converted to structs, with integer keys converted to strings.
+	// Otherwise, such tables are an error.
+	mixedAsObject bool
+
+	// emptyAsList causes empty tables to be converted to empty lists instead
+	// of empty structs.
+	emptyAsList bool
+
+	// runtime holds the options of the runtime, which apply to converted
+	// messages.
+	runtime *Options
+}
+
+// init initializes the methods for the JSON-like well-known types.
+func init() {
+	methods := make(map[string]rt.Value)
+	setMapFunc(methods, "ToLua", structToLua, 2, false, cpuIOTimeSafe)
+	msgTypeMethods[listValueFullName] = methods
+	msgTypeMethods[structFullName] = methods
+	msgTypeMethods[valueFullName] = methods
+}
+
+// luaToStructValue converts the given Lua value to a google.protobuf.Value.
+// visiting contains the tables currently being converted, for cycle
+// detection.
+func luaToStructValue(
+	opts *toValueOptions, v rt.Value, visiting map[*rt.Table]bool,
+) (*structpb.Value, error) {
+	if v.IsNil() {
+		return structpb.NewNullValue(), nil
+	}
+	if b, ok := v.TryBool(); ok {
+		return structpb.NewBoolValue(b), nil
+	}
+	if i, ok := v.TryInt(); ok {
+		return structpb.NewNumberValue(float64(i)), nil
+	}
+	if f, ok := v.TryFloat(); ok {
+		return structpb.NewNumberValue(f), nil
+	}
+	if s, ok := v.TryString(); ok {
+		return structpb.NewStringValue(s), nil
+	}
+	if tbl, ok := v.TryTable(); ok {
+		return luaTableToStructValue(opts, tbl, visiting)
+	}
+	if msg, ok := unwrapReadable(opts.runtime, v); ok {
+		return messageToStructValue(msg)
+	}
+	return nil, fmt.Errorf("cannot convert %s to google.protobuf.Value",
+		v.TypeName())
+}
+
+// luaTableToStructValue converts the given Lua table to a
+// google.protobuf.Value containing either a list or a struct.
+func luaTableToStructValue(
+	opts *toValueOptions, tbl *rt.Table, visiting map[*rt.Table]bool,
+) (*structpb.Value, error) {
+	if visiting[tbl] {
+		return nil, errors.New("cannot convert table with cycles")
+	}
+	visiting[tbl] = true
+	defer delete(visiting, tbl)
+	var nInts, nStrings int64
+	for k, _, _ := tbl.Next(rt.NilValue); !k.IsNil(); k, _, _ = tbl.Next(k) {
+		if _, ok := k.TryString(); ok {
+			nStrings++
+			continue
+		}
+		if i, ok := k.TryInt(); ok && i > 0 {
+			nInts++
+			continue
+		}
+		if !opts.mixedAsObject {
+			return nil, fmt.Errorf("cannot convert table with %s key",
+				k.TypeName())
+		}
+		nStrings++
+	}
+	isList := nStrings == 0 && nInts == tbl.Len() &&
+		(nInts > 0 || opts.emptyAsList)
+	if nInts > 0 && !isList && !opts.mixedAsObject {
+		return nil, errors.New("table is neither an array nor an object")
+	}
+	if isList {
+		list := &structpb.ListValue{
+			Values: make([]*structpb.Value, nInts),
+		}
+		for i := range list.Values {
+			value, err := luaToStructValue(
+				opts, tbl.Get(rt.IntValue(int64(i)+1)), visiting)
+			if err != nil {
+				return nil, err
+			}
+			list.Values[i] = value
+		}
+		return structpb.NewListValue(list), nil
+	}
+	s := &structpb.Struct{
+		Fields: make(map[string]*structpb.Value),
+	}
+	for k, v, _ := tbl.Next(rt.NilValue); !k.IsNil(); k, v, _ = tbl.Next(k) {
+		key, ok := k.TryString()
+		if !ok {
+			key, ok = k.ToString()
+			if !ok {
+				return nil, fmt.Errorf("cannot convert table with %s key",
+					k.TypeName())
+			}
+		}
+		value, err := luaToStructValue(opts, v, visiting)
+		if err != nil {
+			return nil, err
+		}
+		s.Fields[key] = value
+	}
+	return structpb.NewStructValue(s), nil
+}
+
+// messageToStructValue converts the given message to a
+// google.protobuf.Value. Only Value, Struct and ListValue messages are
+// supported.
+func messageToStructValue(msg proto.Message) (*structpb.Value, error) {
+	switch x := msg.(type) {
+	case *structpb.Value:
+		return proto.Clone(x).(*structpb.Value), nil
+	case *structpb.Struct:
+		return structpb.NewStructValue(proto.Clone(x).(*structpb.Struct)), nil
+	case *structpb.ListValue:
+		return structpb.NewListValue(proto.Clone(x).(*structpb.ListValue)), nil
+	}
+	concrete, err := toConcreteStructMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	return messageToStructValue(concrete)
+}
+
+// protoToValue converts a Lua value to a google.protobuf.Value.
+func protoToValue(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	if err := c.Check1Arg(); err != nil {
+		return nil, err
+	}
+	opts := toValueOptions{runtime: runtimeOptions(t.Runtime)}
+	if c.NArgs() > 1 && !c.Arg(1).IsNil() {
+		optsTable, err := c.TableArg(1)
+		if err != nil {
+			return nil, err
+		}
+		if err = parseToValueOptions(&opts, optsTable); err != nil {
+			return nil, err
+		}
+	}
+	value, err := luaToStructValue(&opts, c.Arg(0), make(map[*rt.Table]bool))
+	if err != nil {
+		return nil, err
+	}
+	return c.PushingNext1(t.Runtime, Wrap(value)), nil
+}
+
+// parseToValueOptions parses the options table for proto.to_value into opts.
+func parseToValueOptions(opts *toValueOptions, tbl *rt.Table) error {
+	mixed, _ := tbl.Get(rt.StringValue("mixed")).TryString()
+	switch mixed {
+	case "", "error":
+	case "object":
+		opts.mixedAsObject = true
+	default:
+		return fmt.Errorf("invalid mixed table policy '%s'", mixed)
+	}
+	empty, _ := tbl.Get(rt.StringValue("empty")).TryString()
+	switch empty {
+	case "", "object":
+	case "array":
+		opts.emptyAsList = true
+	default:
+		return fmt.Errorf("invalid empty table policy '%s'", empty)
+	}
+	return nil
+}
+
+// structToLua converts a google.protobuf.Value, Struct or ListValue message
+// to a native Lua value.
+// An optional second argument is used in place of null values.
+func structToLua(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	msg, err := toConcreteStructMessage(readableUserData(t, ud).Interface())
+	if err != nil {
+		return nil, err
+	}
+	null := c.Arg(1)
+	var ret rt.Value
+	switch x := msg.(type) {
+	case *structpb.Value:
+		ret = structValueToLua(t.Runtime, x, null)
+	case *structpb.Struct:
+		ret = structValueToLua(t.Runtime, structpb.NewStructValue(x), null)
+	case *structpb.ListValue:
+		ret = structValueToLua(t.Runtime, structpb.NewListValue(x), null)
+	}
+	return c.PushingNext1(t.Runtime, ret), nil
+}
+
+// structValueToLua converts the given google.protobuf.Value to a native Lua
+// value. Null values are converted to null.
+func structValueToLua(
+	r *rt.Runtime, value *structpb.Value, null rt.Value,
+) rt.Value {
+	switch x := value.GetKind().(type) {
+	case *structpb.Value_BoolValue:
+		return rt.BoolValue(x.BoolValue)
+	case *structpb.Value_NumberValue:
+		f := x.NumberValue
+		if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+			return rt.IntValue(int64(f))
+		}
+		return rt.FloatValue(f)
+	case *structpb.Value_StringValue:
+		return rt.StringValue(x.StringValue)
+	case *structpb.Value_ListValue:
+		tbl := rt.NewTable()
+		for i, v := range x.ListValue.GetValues() {
+			r.SetTable(tbl, rt.IntValue(int64(i)+1), structValueToLua(r, v, null))
+		}
+		return rt.TableValue(tbl)
+	case *structpb.Value_StructValue:
+		tbl := rt.NewTable()
+		for k, v := range x.StructValue.GetFields() {
+			r.SetTable(tbl, rt.StringValue(k), structValueToLua(r, v, null))
+		}
+		return rt.TableValue(tbl)
+	default:
+		return null
+	}
+}
+
+// toConcreteStructMessage returns msg as a *structpb.Value,
+// *structpb.Struct or *structpb.ListValue, converting dynamic messages via
+// the wire format if necessary.
+func toConcreteStructMessage(msg proto.Message) (proto.Message, error) {
+	switch msg.(type) {
+	case *structpb.Value, *structpb.Struct, *structpb.ListValue:
+		return msg, nil
+	}
+	var concrete proto.Message
+	switch msg.ProtoReflect().Descriptor().FullName() {
+	case valueFullName:
+		concrete = &structpb.Value{}
+	case structFullName:
+		concrete = &structpb.Struct{}
+	case listValueFullName:
+		concrete = &structpb.ListValue{}
+	default:
+		return nil, fmt.Errorf("cannot convert %s to google.protobuf.Value",
+			msg.ProtoReflect().Descriptor().FullName())
+	}
+	buf, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	if err = proto.Unmarshal(buf, concrete); err != nil {
+		return nil, err
+	}
+	return concrete, nil
+}
@@ -0,0 +1,469 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	rt "github.com/arnodel/golua/runtime"
+	pr "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Full names of the well-known time types.
+const (
+	durationFullName  = pr.FullName("google.protobuf.Duration")
+	timestampFullName = pr.FullName("google.protobuf.Timestamp")
+)
+
+// Valid ranges for timestamps and durations as documented in
+// google/protobuf/timestamp.proto and google/protobuf/duration.proto.
+const (
+	maxDurationSeconds  = 315576000000
+	minTimestampSeconds = -62135596800
+	maxTimestampSeconds = 253402300799
+	nanosPerSecond      = 1000000000
+)
+
+// timeKind classifies operands of time arithmetic.
+type timeKind int
+
+// Time operand kinds.
+const (
+	timeKindNone timeKind = iota
+	timeKindNumber
+	timeKindDuration
+	timeKindTimestamp
+)
+
+// timeOperand is an operand of time arithmetic.
+type timeOperand struct {
+	// kind is the kind of operand.
+	kind timeKind
+
+	// mt is the message type of a duration or timestamp operand.
+	mt pr.MessageType
+
+	// seconds and nanos make up the value of the operand.
+	seconds, nanos int64
+}
+
+// isTime reports whether o is a duration or a timestamp.
+func (o timeOperand) isTime() bool {
+	return o.kind == timeKindDuration || o.kind == timeKindTimestamp
+}
+
+// init initializes the methods for duration and timestamp messages.
+func init() {
+	durationMethods := make(map[string]rt.Value)
+	setMapFunc(durationMethods,
+		"Seconds", durationSeconds, 1, false, cpuIOMemTimeSafe)
+	setMapFunc(durationMethods, "String", durationString, 1, false, cpuIOTimeSafe)
+	msgTypeMethods[durationFullName] = durationMethods
+	timestampMethods := make(map[string]rt.Value)
+	setMapFunc(timestampMethods, "Date", timestampDate, 1, false, cpuIOTimeSafe)
+	setMapFunc(timestampMethods, "Unix", timestampUnix, 1, false, cpuIOMemTimeSafe)
+	msgTypeMethods[timestampFullName] = timestampMethods
+}
+
+// durationSeconds returns a duration as a number of seconds.
+func durationSeconds(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	seconds, nanos := timeFields(readableUserData(t, ud))
+	return c.PushingNext1(t.Runtime, secondsNanosToLua(seconds, nanos)), nil
+}
+
+// durationString returns a duration as a string such as "1h30m0s".
+func durationString(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	seconds, nanos := timeFields(readableUserData(t, ud))
+	if seconds > math.MaxInt64/nanosPerSecond ||
+		seconds < math.MinInt64/nanosPerSecond {
+		// not representable as time.Duration
+		return pushingString(t, c, secondsNanosString(seconds, nanos))
+	}
+	d := time.Duration(seconds)*time.Second + time.Duration(nanos)
+	return pushingString(t, c, d.String())
+}
+
+// secondsNanosString formats the duration given by seconds and nanos with
+// the same sign as a number of seconds, such as "-1.5s".
+func secondsNanosString(seconds, nanos int64) string {
+	sign := ""
+	if seconds < 0 || nanos < 0 {
+		sign, seconds, nanos = "-", -seconds, -nanos
+	}
+	if nanos == 0 {
+		return fmt.Sprintf("%s%ds", sign, seconds)
+	}
+	frac := strings.TrimRight(fmt.Sprintf("%09d", nanos), "0")
+	return fmt.Sprintf("%s%d.%ss", sign, seconds, frac)
+}
+
+// normalizeDuration normalizes the given duration seconds and nanos such that
+// both have the same sign and nanos is less than a second in absolute value.
+func normalizeDuration(seconds, nanos int64) (int64, int64, error) {
+	seconds += nanos / nanosPerSecond
+	nanos %= nanosPerSecond
+	if seconds > 0 && nanos < 0 {
+		seconds--
+		nanos += nanosPerSecond
+	} else if seconds < 0 && nanos > 0 {
+		seconds++
+		nanos -= nanosPerSecond
+	}
+	if seconds < -maxDurationSeconds || seconds > maxDurationSeconds {
+		return 0, 0, errors.New("duration out of range")
+	}
+	return seconds, nanos, nil
+}
+
+// normalizeTimestamp normalizes the given timestamp seconds and nanos such
+// that nanos is non-negative and less than a second.
+func normalizeTimestamp(seconds, nanos int64) (int64, int64, error) {
+	seconds += nanos / nanosPerSecond
+	nanos %= nanosPerSecond
+	if nanos < 0 {
+		seconds--
+		nanos += nanosPerSecond
+	}
+	if seconds < minTimestampSeconds || seconds > maxTimestampSeconds {
+		return 0, 0, errors.New("timestamp out of range")
+	}
+	return seconds, nanos, nil
+}
+
+// numberToSecondsNanos converts the given Lua number of seconds to seconds
+// and nanos. Numbers whose whole seconds exceed maxSeconds in absolute value
+// are out of range.
+func numberToSecondsNanos(
+	v rt.Value, maxSeconds float64,
+) (seconds, nanos int64, err error) {
+	if i, ok := v.TryInt(); ok {
+		return i, 0, nil
+	}
+	f, ok := v.TryFloat()
+	if !ok {
+		return 0, 0, fmt.Errorf("expected number, got %s", v.TypeName())
+	}
+	if math.IsNaN(f) || f <= -(maxSeconds+1) || f >= maxSeconds+1 {
+		return 0, 0, fmt.Errorf("number of seconds out of range: %g", f)
+	}
+	whole, frac := math.Modf(f)
+	return int64(whole), int64(math.Round(frac * nanosPerSecond)), nil
+}
+
+// protoDuration creates a new duration from a number of seconds or a string
+// such as "1h30m".
+func protoDuration(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	if err := c.Check1Arg(); err != nil {
+		return nil, err
+	}
+	var seconds, nanos int64
+	arg := c.Arg(0)
+	if s, ok := arg.TryString(); ok {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, err
+		}
+		seconds, nanos = int64(d/time.Second), int64(d%time.Second)
+	} else {
+		var err error
+		seconds, nanos, err = numberToSecondsNanos(arg, maxDurationSeconds)
+		if err != nil {
+			return nil, err
+		}
+	}
+	seconds, nanos, err := normalizeDuration(seconds, nanos)
+	if err != nil {
+		return nil, err
+	}
+	return c.PushingNext1(t.Runtime, Wrap(&durationpb.Duration{
+		Seconds: seconds,
+		Nanos:   int32(nanos),
+	})), nil
+}
+
+// protoTimestamp creates a new timestamp from a number of seconds since the
+// Unix epoch, an RFC 3339 string, or an os.date style table.
+// Date tables are interpreted as UTC.
+func protoTimestamp(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	if err := c.Check1Arg(); err != nil {
+		return nil, err
+	}
+	var seconds, nanos int64
+	arg := c.Arg(0)
+	if s, ok := arg.TryString(); ok {
+		tm, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, err
+		}
+		seconds, nanos = tm.Unix(), int64(tm.Nanosecond())
+	} else if tbl, ok := arg.TryTable(); ok {
+		tm, err := dateTableToTime(tbl)
+		if err != nil {
+			return nil, err
+		}
+		seconds = tm.Unix()
+	} else {
+		var err error
+		seconds, nanos, err = numberToSecondsNanos(arg, maxTimestampSeconds)
+		if err != nil {
+			return nil, err
+		}
+	}
+	seconds, nanos, err := normalizeTimestamp(seconds, nanos)
+	if err != nil {
+		return nil, err
+	}
+	return c.PushingNext1(t.Runtime, Wrap(&timestamppb.Timestamp{
+		Seconds: seconds,
+		Nanos:   int32(nanos),
+	})), nil
+}
+
+// dateTableToTime converts an os.date style table to a UTC time.
+// As with os.time, the hour defaults to 12 and minutes and seconds to 0.
+func dateTableToTime(tbl *rt.Table) (time.Time, error) {
+	fields := []struct {
+		name     string
+		value    int64
+		required bool
+	}{
+		{"year", 0, true},
+		{"month", 0, true},
+		{"day", 0, true},
+		{"hour", 12, false},
+		{"min", 0, false},
+		{"sec", 0, false},
+	}
+	for i := range fields {
+		v := tbl.Get(rt.StringValue(fields[i].name))
+		if v.IsNil() {
+			if fields[i].required {
+				return time.Time{}, fmt.Errorf(
+					"required field '%s' missing", fields[i].name)
+			}
+			continue
+		}
+		n, ok := rt.ToIntNoString(v)
+		if !ok || n < math.MinInt32 || n > math.MaxInt32 {
+			return time.Time{}, fmt.Errorf(
+				"field '%s' is not an integer", fields[i].name)
+		}
+		fields[i].value = n
+	}
+	return time.Date(int(fields[0].value), time.Month(fields[1].value),
+		int(fields[2].value), int(fields[3].value), int(fields[4].value),
+		int(fields[5].value), 0, time.UTC), nil
+}
+
+// secondsNanosToLua converts the given seconds and nanos to a Lua number.
+// The number is an integer if nanos is zero.
+func secondsNanosToLua(seconds, nanos int64) rt.Value {
+	if nanos == 0 {
+		return rt.IntValue(seconds)
+	}
+	return rt.FloatValue(float64(seconds) + float64(nanos)/nanosPerSecond)
+}
+
+// timeAdd implements the __add metamethod for durations and timestamps.
+func timeAdd(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	opts := runtimeOptions(t.Runtime)
+	lhs, rhs := toTimeOperand(opts, c.Arg(0)), toTimeOperand(opts, c.Arg(1))
+	seconds, nanos := lhs.seconds+rhs.seconds, lhs.nanos+rhs.nanos
+	switch {
+	case lhs.kind == timeKindTimestamp && rhs.kind == timeKindTimestamp:
+		return nil, errors.New("cannot add two timestamps")
+	case lhs.kind == timeKindTimestamp && rhs.kind != timeKindNone:
+		return pushingTimeResult(t, c, lhs.mt, seconds, nanos)
+	case lhs.kind != timeKindNone && rhs.kind == timeKindTimestamp:
+		return pushingTimeResult(t, c, rhs.mt, seconds, nanos)
+	case lhs.kind == timeKindDuration && rhs.kind != timeKindNone:
+		return pushingTimeResult(t, c, lhs.mt, seconds, nanos)
+	case lhs.kind != timeKindNone && rhs.kind == timeKindDuration:
+		return pushingTimeResult(t, c, rhs.mt, seconds, nanos)
+	case !lhs.isTime() && !rhs.isTime():
+		// The metamethod is shared by all messages.
+		return nil, rt.BinaryArithmeticError("add", c.Arg(0), c.Arg(1))
+	default:
+		return nil, fmt.Errorf("cannot add %s and %s",
+			timeOperandName(c.Arg(0)), timeOperandName(c.Arg(1)))
+	}
+}
+
+// timeCompare compares two durations, two timestamps, or a duration with
+// a number of seconds.
+// The result is negative, zero, or positive like in strings.Compare.
+func timeCompare(opts *Options, lhsValue, rhsValue rt.Value) (int, error) {
+	lhs, rhs := toTimeOperand(opts, lhsValue), toTimeOperand(opts, rhsValue)
+	switch {
+	case lhs.kind == timeKindTimestamp && rhs.kind == timeKindTimestamp:
+	case lhs.kind == timeKindDuration &&
+		(rhs.kind == timeKindDuration || rhs.kind == timeKindNumber):
+	case lhs.kind == timeKindNumber && rhs.kind == timeKindDuration:
+	case !lhs.isTime() && !rhs.isTime():
+		return 0, fmt.Errorf("attempt to compare a %s value with a %s value",
+			lhsValue.CustomTypeName(), rhsValue.CustomTypeName())
+	default:
+		return 0, fmt.Errorf("cannot compare %s with %s",
+			timeOperandName(lhsValue), timeOperandName(rhsValue))
+	}
+	switch {
+	case lhs.seconds < rhs.seconds:
+		return -1, nil
+	case lhs.seconds > rhs.seconds:
+		return 1, nil
+	case lhs.nanos < rhs.nanos:
+		return -1, nil
+	case lhs.nanos > rhs.nanos:
+		return 1, nil
+	default:
+		return 0, nil
+	}
+}
+
+// timeFields returns the seconds and nanos of a duration or timestamp
+// message.
+func timeFields(rmsg pr.Message) (seconds, nanos int64) {
+	fields := rmsg.Descriptor().Fields()
+	seconds = rmsg.Get(fields.ByName("seconds")).Int()
+	nanos = rmsg.Get(fields.ByName("nanos")).Int()
+	return
+}
+
+// timeLe implements the __le metamethod for durations and timestamps.
+func timeLe(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	cmp, err := timeCompare(runtimeOptions(t.Runtime), c.Arg(0), c.Arg(1))
+	if err != nil {
+		return nil, err
+	}
+	return pushingBool(t, c, cmp <= 0)
+}
+
+// timeLt implements the __lt metamethod for durations and timestamps.
+func timeLt(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	cmp, err := timeCompare(runtimeOptions(t.Runtime), c.Arg(0), c.Arg(1))
+	if err != nil {
+		return nil, err
+	}
+	return pushingBool(t, c, cmp < 0)
+}
+
+// timeOperandName returns a name for v suitable for error messages.
+func timeOperandName(v rt.Value) string {
+	if msg, ok := Unwrap(v); ok {
+		return string(msg.ProtoReflect().Descriptor().FullName())
+	}
+	return v.TypeName()
+}
+
+// timeSub implements the __sub metamethod for durations and timestamps.
+func timeSub(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	opts := runtimeOptions(t.Runtime)
+	lhs, rhs := toTimeOperand(opts, c.Arg(0)), toTimeOperand(opts, c.Arg(1))
+	seconds, nanos := lhs.seconds-rhs.seconds, lhs.nanos-rhs.nanos
+	switch {
+	case lhs.kind == timeKindTimestamp && rhs.kind == timeKindTimestamp:
+		mt := (&durationpb.Duration{}).ProtoReflect().Type()
+		return pushingTimeResult(t, c, mt, seconds, nanos)
+	case lhs.kind == timeKindTimestamp && rhs.kind != timeKindNone:
+		return pushingTimeResult(t, c, lhs.mt, seconds, nanos)
+	case lhs.kind == timeKindDuration &&
+		(rhs.kind == timeKindDuration || rhs.kind == timeKindNumber):
+		return pushingTimeResult(t, c, lhs.mt, seconds, nanos)
+	case lhs.kind == timeKindNumber && rhs.kind == timeKindDuration:
+		return pushingTimeResult(t, c, rhs.mt, seconds, nanos)
+	case !lhs.isTime() && !rhs.isTime():
+		return nil, rt.BinaryArithmeticError("sub", c.Arg(0), c.Arg(1))
+	default:
+		return nil, fmt.Errorf("cannot subtract %s from %s",
+			timeOperandName(c.Arg(1)), timeOperandName(c.Arg(0)))
+	}
+}
+
+// pushingTimeResult creates a new duration or timestamp of type mt from
+// the given seconds and nanos, normalizing it, and returns it.
+func pushingTimeResult(
+	t *rt.Thread, c *rt.GoCont, mt pr.MessageType, seconds, nanos int64,
+) (rt.Cont, error) {
+	var err error
+	if mt.Descriptor().FullName() == timestampFullName {
+		seconds, nanos, err = normalizeTimestamp(seconds, nanos)
+	} else {
+		seconds, nanos, err = normalizeDuration(seconds, nanos)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rmsg := mt.New()
+	fields := rmsg.Descriptor().Fields()
+	rmsg.Set(fields.ByName("seconds"), pr.ValueOfInt64(seconds))
+	rmsg.Set(fields.ByName("nanos"), pr.ValueOfInt32(int32(nanos)))
+	return c.PushingNext1(t.Runtime, Wrap(rmsg.Interface())), nil
+}
+
+// timestampDate returns a timestamp as an os.date style table in UTC.
+func timestampDate(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	seconds, nanos := timeFields(readableUserData(t, ud))
+	tm := time.Unix(seconds, nanos).UTC()
+	// Weeks start on Sunday according to Lua!
+	wday := tm.Weekday() + 1
+	tbl := rt.NewTable()
+	t.Runtime.SetEnv(tbl, "year", rt.IntValue(int64(tm.Year())))
+	t.Runtime.SetEnv(tbl, "month", rt.IntValue(int64(tm.Month())))
+	t.Runtime.SetEnv(tbl, "day", rt.IntValue(int64(tm.Day())))
+	t.Runtime.SetEnv(tbl, "hour", rt.IntValue(int64(tm.Hour())))
+	t.Runtime.SetEnv(tbl, "min", rt.IntValue(int64(tm.Minute())))
+	t.Runtime.SetEnv(tbl, "sec", rt.IntValue(int64(tm.Second())))
+	t.Runtime.SetEnv(tbl, "wday", rt.IntValue(int64(wday)))
+	t.Runtime.SetEnv(tbl, "yday", rt.IntValue(int64(tm.YearDay())))
+	t.Runtime.SetEnv(tbl, "isdst", falseValue)
+	return c.PushingNext1(t.Runtime, rt.TableValue(tbl)), nil
+}
+
+// timestampUnix returns a timestamp as a number of seconds since the Unix
+// epoch.
+func timestampUnix(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	seconds, nanos := timeFields(readableUserData(t, ud))
+	return c.PushingNext1(t.Runtime, secondsNanosToLua(seconds, nanos)), nil
+}
+
+// toTimeOperand classifies v as an operand of time arithmetic. Messages
+// are seen through the field hook of opts.
+func toTimeOperand(opts *Options, v rt.Value) timeOperand {
+	if msg, ok := unwrapReadable(opts, v); ok {
+		rmsg := msg.ProtoReflect()
+		var kind timeKind
+		switch rmsg.Descriptor().FullName() {
+		case durationFullName:
+			kind = timeKindDuration
+		case timestampFullName:
+			kind = timeKindTimestamp
+		default:
+			return timeOperand{}
+		}
+		seconds, nanos := timeFields(rmsg)
+		return timeOperand{
+			kind:    kind,
+			mt:      rmsg.Type(),
+			seconds: seconds,
+			nanos:   nanos,
+		}
+	}
+	// Numbers are durations in time arithmetic.
+	seconds, nanos, err := numberToSecondsNanos(v, maxDurationSeconds)
+	if err != nil {
+		return timeOperand{}
+	}
+	return timeOperand{
+		kind:    timeKindNumber,
+		seconds: seconds,
+		nanos:   nanos,
+	}
+}
@@ -0,0 +1,394 @@
+package proto
+
+import (
+	"strings"
+
+	rt "github.com/arnodel/golua/runtime"
+	"google.golang.org/protobuf/proto"
+	pr "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/runtime/protoiface"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// ChangeTracker records the changes made to a message wrapped with
+// WrapTracked.
+type ChangeTracker struct {
+	// changes contains the paths of the changed fields, in the order of their
+	// first change.
+	changes []string
+
+	// seen contains the paths in changes.
+	seen map[string]bool
+}
+
+// trackedMessage is a view of a message recording all changes.
+type trackedMessage struct {
+	// tracker records the changes.
+	tracker *ChangeTracker
+
+	// rmsg is the viewed message.
+	rmsg pr.Message
+
+	// path is the path of rmsg.
+	path string
+
+	// inContainer is true if rmsg is a list element or map value. Changes to
+	// rmsg are then recorded as changes of path, the containing field.
+	inContainer bool
+}
+
+// trackedList is a view of a repeated field recording all changes.
+type trackedList struct {
+	// tracker records the changes.
+	tracker *ChangeTracker
+
+	// list is the viewed list.
+	list pr.List
+
+	// path is the path of list.
+	path string
+}
+
+// trackedMap is a view of a map field recording all changes.
+type trackedMap struct {
+	// tracker records the changes.
+	tracker *ChangeTracker
+
+	// m is the viewed map.
+	m pr.Map
+
+	// path is the path of m.
+	path string
+}
+
+// init initializes the change tracking methods of messages.
+func init() {
+	setMapFunc(msgMethods, "Changes", msgChanges, 1, false, cpuIOTimeSafe)
+}
+
+// msgChanges returns the list of paths of the fields changed in a tracked
+// message, or nil if the message is not tracked.
+func msgChanges(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	tm, ok := ud.Value().(proto.Message).ProtoReflect().(*trackedMessage)
+	if !ok {
+		return c.PushingNext1(t.Runtime, rt.NilValue), nil
+	}
+	tbl := rt.NewTable()
+	for i, path := range tm.tracker.changes {
+		t.Runtime.SetTable(tbl, rt.IntValue(int64(i)+1), rt.StringValue(path))
+	}
+	return c.PushingNext1(t.Runtime, rt.TableValue(tbl)), nil
+}
+
+// WrapTracked returns the given protobuf message as a Lua value.
+// All changes made to msg through the returned value are recorded by the
+// returned ChangeTracker. Changes within list elements and map values are
+// recorded as changes of the repeated or map field.
+func WrapTracked(msg proto.Message) (rt.Value, *ChangeTracker) {
+	tracker := &ChangeTracker{seen: make(map[string]bool)}
+	return Wrap(&trackedMessage{
+		tracker: tracker,
+		rmsg:    msg.ProtoReflect(),
+	}), tracker
+}
+
+// Changes returns the paths of the changed fields, in the order of their
+// first change. Path components are field names separated by dots, with
+// extension fields given by their full name in brackets.
+func (c *ChangeTracker) Changes() []string {
+	return append([]string(nil), c.changes...)
+}
+
+// FieldMask returns the changes as a normalized field mask.
+// Field masks cannot refer to extension fields, so changes of extension
+// fields and of the fields within them are left out.
+func (c *ChangeTracker) FieldMask() *fieldmaskpb.FieldMask {
+	mask := new(fieldmaskpb.FieldMask)
+	for _, path := range c.changes {
+		// Only extension fields are bracketed in change paths.
+		if !strings.Contains(path, "[") {
+			mask.Paths = append(mask.Paths, path)
+		}
+	}
+	mask.Normalize()
+	return mask
+}
+
+// record records a change of the field at path.
+func (c *ChangeTracker) record(path string) {
+	if !c.seen[path] {
+		c.seen[path] = true
+		c.changes = append(c.changes, path)
+	}
+}
+
+// fieldPath returns the path of the field fd of m.
+func (m *trackedMessage) fieldPath(fd pr.FieldDescriptor) string {
+	if m.inContainer {
+		return m.path
+	}
+	return fieldPath(m.path, fd)
+}
+
+// wrapValue returns a tracked view of the value v of the field fd of m,
+// if v is composite and set.
+func (m *trackedMessage) wrapValue(fd pr.FieldDescriptor, v pr.Value) pr.Value {
+	path := m.fieldPath(fd)
+	switch {
+	case fd.IsList():
+		if !v.List().IsValid() {
+			return v
+		}
+		return pr.ValueOfList(&trackedList{
+			tracker: m.tracker,
+			list:    v.List(),
+			path:    path,
+		})
+	case fd.IsMap():
+		if !v.Map().IsValid() {
+			return v
+		}
+		return pr.ValueOfMap(&trackedMap{
+			tracker: m.tracker,
+			m:       v.Map(),
+			path:    path,
+		})
+	case fd.Kind() == pr.MessageKind || fd.Kind() == pr.GroupKind:
+		return m.tracker.wrapMessage(v, path, m.inContainer)
+	default:
+		return v
+	}
+}
+
+// wrapMessage returns a tracked view of the message value v at path,
+// if v is valid.
+func (c *ChangeTracker) wrapMessage(
+	v pr.Value, path string, inContainer bool,
+) pr.Value {
+	if !v.Message().IsValid() {
+		return v
+	}
+	return pr.ValueOfMessage(&trackedMessage{
+		tracker:     c,
+		rmsg:        v.Message(),
+		path:        path,
+		inContainer: inContainer,
+	})
+}
+
+// ProtoReflect implements proto.Message.
+func (m *trackedMessage) ProtoReflect() pr.Message {
+	return m
+}
+
+// Descriptor implements pr.Message.
+func (m *trackedMessage) Descriptor() pr.MessageDescriptor {
+	return m.rmsg.Descriptor()
+}
+
+// Type implements pr.Message.
+func (m *trackedMessage) Type() pr.MessageType {
+	return m.rmsg.Type()
+}
+
+// New implements pr.Message.
+func (m *trackedMessage) New() pr.Message {
+	return m.rmsg.New()
+}
+
+// Interface implements pr.Message.
+func (m *trackedMessage) Interface() pr.ProtoMessage {
+	return m
+}
+
+// Range implements pr.Message.
+func (m *trackedMessage) Range(f func(pr.FieldDescriptor, pr.Value) bool) {
+	m.rmsg.Range(func(fd pr.FieldDescriptor, v pr.Value) bool {
+		return f(fd, m.wrapValue(fd, v))
+	})
+}
+
+// Has implements pr.Message.
+func (m *trackedMessage) Has(fd pr.FieldDescriptor) bool {
+	return m.rmsg.Has(fd)
+}
+
+// Clear implements pr.Message.
+func (m *trackedMessage) Clear(fd pr.FieldDescriptor) {
+	if m.rmsg.Has(fd) {
+		m.tracker.record(m.fieldPath(fd))
+	}
+	m.rmsg.Clear(fd)
+}
+
+// Get implements pr.Message.
+func (m *trackedMessage) Get(fd pr.FieldDescriptor) pr.Value {
+	return m.wrapValue(fd, m.rmsg.Get(fd))
+}
+
+// Set implements pr.Message.
+func (m *trackedMessage) Set(fd pr.FieldDescriptor, v pr.Value) {
+	m.tracker.record(m.fieldPath(fd))
+	m.rmsg.Set(fd, v)
+}
+
+// Mutable implements pr.Message.
+func (m *trackedMessage) Mutable(fd pr.FieldDescriptor) pr.Value {
+	if !m.rmsg.Has(fd) {
+		m.tracker.record(m.fieldPath(fd))
+	}
+	return m.wrapValue(fd, m.rmsg.Mutable(fd))
+}
+
+// NewField implements pr.Message.
+func (m *trackedMessage) NewField(fd pr.FieldDescriptor) pr.Value {
+	return m.rmsg.NewField(fd)
+}
+
+// WhichOneof implements pr.Message.
+func (m *trackedMessage) WhichOneof(od pr.OneofDescriptor) pr.FieldDescriptor {
+	return m.rmsg.WhichOneof(od)
+}
+
+// GetUnknown implements pr.Message.
+func (m *trackedMessage) GetUnknown() pr.RawFields {
+	return m.rmsg.GetUnknown()
+}
+
+// SetUnknown implements pr.Message.
+func (m *trackedMessage) SetUnknown(raw pr.RawFields) {
+	if m.inContainer {
+		m.tracker.record(m.path)
+	} else {
+		m.tracker.record(unknownPath(m.path))
+	}
+	m.rmsg.SetUnknown(raw)
+}
+
+// IsValid implements pr.Message.
+func (m *trackedMessage) IsValid() bool {
+	return m.rmsg.IsValid()
+}
+
+// ProtoMethods implements pr.Message.
+// No fast-path methods are provided.
+func (m *trackedMessage) ProtoMethods() *protoiface.Methods {
+	return nil
+}
+
+// Len implements pr.List.
+func (l *trackedList) Len() int {
+	return l.list.Len()
+}
+
+// Get implements pr.List.
+func (l *trackedList) Get(i int) pr.Value {
+	v := l.list.Get(i)
+	if _, ok := v.Interface().(pr.Message); !ok {
+		return v
+	}
+	return l.tracker.wrapMessage(v, l.path, true)
+}
+
+// Set implements pr.List.
+func (l *trackedList) Set(i int, v pr.Value) {
+	l.tracker.record(l.path)
+	l.list.Set(i, v)
+}
+
+// Append implements pr.List.
+func (l *trackedList) Append(v pr.Value) {
+	l.tracker.record(l.path)
+	l.list.Append(v)
+}
+
+// AppendMutable implements pr.List.
+func (l *trackedList) AppendMutable() pr.Value {
+	l.tracker.record(l.path)
+	return l.tracker.wrapMessage(l.list.AppendMutable(), l.path, true)
+}
+
+// Truncate implements pr.List.
+func (l *trackedList) Truncate(n int) {
+	if n < l.list.Len() {
+		l.tracker.record(l.path)
+	}
+	l.list.Truncate(n)
+}
+
+// NewElement implements pr.List.
+func (l *trackedList) NewElement() pr.Value {
+	return l.list.NewElement()
+}
+
+// IsValid implements pr.List.
+func (l *trackedList) IsValid() bool {
+	return l.list.IsValid()
+}
+
+// wrapValue returns a tracked view of the map value v, if it is a message.
+func (m *trackedMap) wrapValue(v pr.Value) pr.Value {
+	if _, ok := v.Interface().(pr.Message); !ok {
+		return v
+	}
+	return m.tracker.wrapMessage(v, m.path, true)
+}
+
+// Len implements pr.Map.
+func (m *trackedMap) Len() int {
+	return m.m.Len()
+}
+
+// Range implements pr.Map.
+func (m *trackedMap) Range(f func(pr.MapKey, pr.Value) bool) {
+	m.m.Range(func(k pr.MapKey, v pr.Value) bool {
+		return f(k, m.wrapValue(v))
+	})
+}
+
+// Has implements pr.Map.
+func (m *trackedMap) Has(k pr.MapKey) bool {
+	return m.m.Has(k)
+}
+
+// Clear implements pr.Map.
+func (m *trackedMap) Clear(k pr.MapKey) {
+	if m.m.Has(k) {
+		m.tracker.record(m.path)
+	}
+	m.m.Clear(k)
+}
+
+// Get implements pr.Map.
+func (m *trackedMap) Get(k pr.MapKey) pr.Value {
+	v := m.m.Get(k)
+	if !v.IsValid() {
+		return v
+	}
+	return m.wrapValue(v)
+}
+
+// Set implements pr.Map.
+func (m *trackedMap) Set(k pr.MapKey, v pr.Value) {
+	m.tracker.record(m.path)
+	m.m.Set(k, v)
+}
+
+// Mutable implements pr.Map.
+func (m *trackedMap) Mutable(k pr.MapKey) pr.Value {
+	if !m.m.Has(k) {
+		m.tracker.record(m.path)
+	}
+	return m.wrapValue(m.m.Mutable(k))
+}
+
+// NewValue implements pr.Map.
+func (m *trackedMap) NewValue() pr.Value {
+	return m.m.NewValue()
+}
+
+// IsValid implements pr.Map.
+func (m *trackedMap) IsValid() bool {
+	return m.m.IsValid()
+}
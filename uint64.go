@@ -0,0 +1,308 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	rt "github.com/arnodel/golua/runtime"
+)
+
+var (
+	// uint64Table is the metatable for uint64 values which do not fit into
+	// a Lua integer.
+	uint64Table *rt.Table
+)
+
+// init initializes uint64Table.
+func init() {
+	uint64Table = rt.NewTable()
+	uint64Table.Set(rt.StringValue("__name"), rt.StringValue("uint64"))
+	setTableFunc("__add", uint64Add, 2, false, cpuIOMemTimeSafe, uint64Table)
+	setTableFunc("__concat", uint64Concat, 2, false, cpuIOTimeSafe, uint64Table)
+	setTableFunc("__div", uint64Div, 2, false, cpuIOMemTimeSafe, uint64Table)
+	setTableFunc("__eq", uint64Equal, 2, false, cpuIOMemTimeSafe, uint64Table)
+	setTableFunc("__idiv", uint64IDiv, 2, false, cpuIOMemTimeSafe, uint64Table)
+	setTableFunc("__le", uint64Le, 2, false, cpuIOMemTimeSafe, uint64Table)
+	setTableFunc("__lt", uint64Lt, 2, false, cpuIOMemTimeSafe, uint64Table)
+	setTableFunc("__mod", uint64Mod, 2, false, cpuIOMemTimeSafe, uint64Table)
+	setTableFunc("__mul", uint64Mul, 2, false, cpuIOMemTimeSafe, uint64Table)
+	setTableFunc("__sub", uint64Sub, 2, false, cpuIOMemTimeSafe, uint64Table)
+	setTableFunc(
+		"__tostring", uint64ToString, 1, false, cpuIOTimeSafe, uint64Table)
+}
+
+// luaToUint64 converts the given Lua value to a uint64.
+// Only non-negative integers and uint64 values are accepted.
+func luaToUint64(v rt.Value) (uint64, error) {
+	if i, ok := v.TryInt(); ok {
+		if i < 0 {
+			return 0, fmt.Errorf("negative value %d out of bounds for uint64", i)
+		}
+		return uint64(i), nil
+	}
+	if u, ok := tryUint64(v); ok {
+		return u, nil
+	}
+	return 0, fmt.Errorf("expected integer, got %s", v.TypeName())
+}
+
+// protoUint64 converts a non-negative integer or a decimal string to
+// a uint64 value.
+func protoUint64(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	if err := c.Check1Arg(); err != nil {
+		return nil, err
+	}
+	arg := c.Arg(0)
+	if s, ok := arg.TryString(); ok {
+		u, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return c.PushingNext1(t.Runtime, uint64ToLua(u)), nil
+	}
+	u, err := luaToUint64(arg)
+	if err != nil {
+		return nil, err
+	}
+	return c.PushingNext1(t.Runtime, uint64ToLua(u)), nil
+}
+
+// tryUint64 returns the uint64 wrapped in v, if any.
+func tryUint64(v rt.Value) (uint64, bool) {
+	ud, ok := v.TryUserData()
+	if !ok {
+		return 0, false
+	}
+	u, ok := ud.Value().(uint64)
+	return u, ok
+}
+
+// uint64Add implements the __add metamethod for uint64 values.
+func uint64Add(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	return uint64Arith(t, c, "add", func(x, y uint64) (uint64, error) {
+		return x + y, nil
+	}, func(x, y float64) float64 {
+		return x + y
+	})
+}
+
+// uint64Arith implements an arithmetic metamethod for uint64 values.
+// Integer operands are converted to uint64 in two's complement, so that
+// arithmetic wraps around like Lua integer arithmetic. If either operand is
+// a float, floating point arithmetic is used instead.
+func uint64Arith(
+	t *rt.Thread, c *rt.GoCont, op string,
+	intOp func(x, y uint64) (uint64, error), floatOp func(x, y float64) float64,
+) (rt.Cont, error) {
+	lhs, rhs := c.Arg(0), c.Arg(1)
+	_, lhsIsFloat := lhs.TryFloat()
+	_, rhsIsFloat := rhs.TryFloat()
+	if lhsIsFloat || rhsIsFloat {
+		x, xOK := uint64OperandFloat(lhs)
+		y, yOK := uint64OperandFloat(rhs)
+		if !xOK || !yOK {
+			return nil, uint64ArithError(op, lhs, rhs)
+		}
+		return c.PushingNext1(t.Runtime, rt.FloatValue(floatOp(x, y))), nil
+	}
+	x, xOK := uint64Operand(lhs)
+	y, yOK := uint64Operand(rhs)
+	if !xOK || !yOK {
+		return nil, uint64ArithError(op, lhs, rhs)
+	}
+	result, err := intOp(x, y)
+	if err != nil {
+		return nil, err
+	}
+	return c.PushingNext1(t.Runtime, uint64ToLua(result)), nil
+}
+
+// uint64ArithError returns an error for an unsupported arithmetic operation.
+func uint64ArithError(op string, lhs, rhs rt.Value) error {
+	return fmt.Errorf("cannot %s %s and %s",
+		op, lhs.CustomTypeName(), rhs.CustomTypeName())
+}
+
+// uint64Compare compares two values at least one of which is a uint64.
+// The result is negative, zero, or positive like in strings.Compare.
+func uint64Compare(lhs, rhs rt.Value) (int, error) {
+	lhsU, lhsIsUint64 := tryUint64(lhs)
+	rhsU, rhsIsUint64 := tryUint64(rhs)
+	switch {
+	case lhsIsUint64 && rhsIsUint64:
+		return compareOrdered(lhsU, rhsU), nil
+	case lhsIsUint64:
+		return uint64CompareNumber(lhsU, rhs)
+	default:
+		cmp, err := uint64CompareNumber(rhsU, lhs)
+		return -cmp, err
+	}
+}
+
+// uint64CompareNumber compares the uint64 u with the Lua number v.
+func uint64CompareNumber(u uint64, v rt.Value) (int, error) {
+	if i, ok := v.TryInt(); ok {
+		if i < 0 {
+			return 1, nil
+		}
+		return compareOrdered(u, uint64(i)), nil
+	}
+	if f, ok := v.TryFloat(); ok {
+		if math.IsNaN(f) {
+			return 0, errors.New("cannot compare uint64 with NaN")
+		}
+		return compareOrdered(float64(u), f), nil
+	}
+	return 0, fmt.Errorf("cannot compare uint64 with %s", v.CustomTypeName())
+}
+
+// compareOrdered compares x and y.
+func compareOrdered[T uint64 | float64](x, y T) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// uint64Concat implements the __concat metamethod for uint64 values.
+func uint64Concat(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	var s [2]string
+	for i := range s {
+		arg := c.Arg(i)
+		if u, ok := tryUint64(arg); ok {
+			s[i] = strconv.FormatUint(u, 10)
+			continue
+		}
+		if _, ok := arg.TryBool(); ok {
+			return nil, fmt.Errorf("cannot concatenate a boolean value")
+		}
+		str, ok := arg.ToString()
+		if !ok {
+			return nil, fmt.Errorf(
+				"cannot concatenate a %s value", arg.CustomTypeName())
+		}
+		s[i] = str
+	}
+	return pushingString(t, c, s[0]+s[1])
+}
+
+// uint64Div implements the __div metamethod for uint64 values.
+// As in Lua, the result is always a float.
+func uint64Div(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	lhs, rhs := c.Arg(0), c.Arg(1)
+	x, xOK := uint64OperandFloat(lhs)
+	y, yOK := uint64OperandFloat(rhs)
+	if !xOK || !yOK {
+		return nil, uint64ArithError("divide", lhs, rhs)
+	}
+	return c.PushingNext1(t.Runtime, rt.FloatValue(x/y)), nil
+}
+
+// uint64Equal implements the __eq metamethod for uint64 values.
+func uint64Equal(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	x, xOK := tryUint64(c.Arg(0))
+	y, yOK := tryUint64(c.Arg(1))
+	return pushingBool(t, c, xOK && yOK && x == y)
+}
+
+// uint64IDiv implements the __idiv metamethod for uint64 values.
+func uint64IDiv(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	return uint64Arith(t, c, "divide", func(x, y uint64) (uint64, error) {
+		if y == 0 {
+			return 0, errors.New("attempt to perform 'n//0'")
+		}
+		return x / y, nil
+	}, func(x, y float64) float64 {
+		return math.Floor(x / y)
+	})
+}
+
+// uint64Le implements the __le metamethod for uint64 values.
+func uint64Le(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	cmp, err := uint64Compare(c.Arg(0), c.Arg(1))
+	if err != nil {
+		return nil, err
+	}
+	return pushingBool(t, c, cmp <= 0)
+}
+
+// uint64Lt implements the __lt metamethod for uint64 values.
+func uint64Lt(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	cmp, err := uint64Compare(c.Arg(0), c.Arg(1))
+	if err != nil {
+		return nil, err
+	}
+	return pushingBool(t, c, cmp < 0)
+}
+
+// uint64Mod implements the __mod metamethod for uint64 values.
+func uint64Mod(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	return uint64Arith(t, c, "divide", func(x, y uint64) (uint64, error) {
+		if y == 0 {
+			return 0, errors.New("attempt to perform 'n%0'")
+		}
+		return x % y, nil
+	}, func(x, y float64) float64 {
+		return x - math.Floor(x/y)*y
+	})
+}
+
+// uint64Mul implements the __mul metamethod for uint64 values.
+func uint64Mul(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	return uint64Arith(t, c, "multiply", func(x, y uint64) (uint64, error) {
+		return x * y, nil
+	}, func(x, y float64) float64 {
+		return x * y
+	})
+}
+
+// uint64Operand converts the integer or uint64 value v to a uint64.
+// Negative integers are converted in two's complement.
+func uint64Operand(v rt.Value) (uint64, bool) {
+	if i, ok := v.TryInt(); ok {
+		return uint64(i), true
+	}
+	return tryUint64(v)
+}
+
+// uint64OperandFloat converts the number or uint64 value v to a float.
+func uint64OperandFloat(v rt.Value) (float64, bool) {
+	if u, ok := tryUint64(v); ok {
+		return float64(u), true
+	}
+	if i, ok := v.TryInt(); ok {
+		return float64(i), true
+	}
+	return v.TryFloat()
+}
+
+// uint64Sub implements the __sub metamethod for uint64 values.
+func uint64Sub(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	return uint64Arith(t, c, "subtract", func(x, y uint64) (uint64, error) {
+		return x - y, nil
+	}, func(x, y float64) float64 {
+		return x - y
+	})
+}
+
+// uint64ToLua converts the given uint64 to a Lua value.
+// Values which fit into a Lua integer are returned as such, larger values
+// are returned as uint64 user data.
+func uint64ToLua(u uint64) rt.Value {
+	if u <= math.MaxInt64 {
+		return rt.IntValue(int64(u))
+	}
+	return rt.UserDataValue(rt.NewUserData(u, uint64Table))
+}
+
+// uint64ToString implements the __tostring metamethod for uint64 values.
+func uint64ToString(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	return pushingString(t, c, strconv.FormatUint(ud.Value().(uint64), 10))
+}
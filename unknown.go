@@ -0,0 +1,214 @@
+package proto
+
+import (
+	"fmt"
+
+	rt "github.com/arnodel/golua/runtime"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	pr "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// wireTypeNames are the Lua names of the protobuf wire types.
+var wireTypeNames = map[protowire.Type]string{
+	protowire.VarintType:     "varint",
+	protowire.Fixed32Type:    "fixed32",
+	protowire.Fixed64Type:    "fixed64",
+	protowire.BytesType:      "bytes",
+	protowire.StartGroupType: "group",
+}
+
+// wireField is a single field in wire-format encoding.
+type wireField struct {
+	// number is the field number.
+	number protowire.Number
+
+	// typ is the wire type.
+	typ protowire.Type
+
+	// varint is the value of varint, fixed32 and fixed64 fields.
+	varint uint64
+
+	// raw is the value of bytes fields and the contents of groups.
+	raw []byte
+}
+
+// init initializes the unknown field methods of messages.
+func init() {
+	setMapFunc(msgMethods, "DiscardUnknown", msgDiscardUnknown, 1, false,
+		cpuIOMemTimeSafe)
+	setMapFunc(msgMethods, "HasUnknown", msgHasUnknown, 1, false,
+		cpuIOMemTimeSafe)
+	setMapFunc(msgMethods, "UnknownFields", msgUnknownFields, 1, false,
+		cpuIOTimeSafe)
+}
+
+// discardUnknown recursively discards the unknown fields of rmsg and all
+// messages it contains.
+func discardUnknown(rmsg pr.Message) {
+	if len(rmsg.GetUnknown()) > 0 {
+		rmsg.SetUnknown(nil)
+	}
+	rangeSubMessages(rmsg, func(sub pr.Message) bool {
+		discardUnknown(sub)
+		return true
+	})
+}
+
+// hasUnknown checks whether rmsg or any message it contains has unknown
+// fields.
+func hasUnknown(rmsg pr.Message) bool {
+	if len(rmsg.GetUnknown()) > 0 {
+		return true
+	}
+	found := false
+	rangeSubMessages(rmsg, func(sub pr.Message) bool {
+		found = hasUnknown(sub)
+		return !found
+	})
+	return found
+}
+
+// msgDiscardUnknown discards the unknown fields of a message and all
+// messages it contains.
+func msgDiscardUnknown(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	if ud.Metatable() == msgTableReadOnly {
+		return nil, errReadOnly
+	}
+	rmsg := ud.Value().(proto.Message).ProtoReflect()
+	if err := checkWritable(rmsg); err != nil {
+		return nil, err
+	}
+	discardUnknown(rmsg)
+	return c.Next(), nil
+}
+
+// msgHasUnknown checks whether a message or any message it contains has
+// unknown fields.
+func msgHasUnknown(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	return pushingBool(t, c, hasUnknown(readableUserData(t, ud)))
+}
+
+// msgUnknownFields returns the unknown fields of a message as a list of
+// tables with number, type and value entries.
+func msgUnknownFields(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	ud, _ := c.UserDataArg(0)
+	rmsg := readableUserData(t, ud)
+	fields, err := parseWireFields(rmsg.GetUnknown())
+	if err != nil {
+		return nil, err
+	}
+	opts := runtimeOptions(t.Runtime)
+	tbl := rt.NewTable()
+	for i := range fields {
+		t.Runtime.SetTable(tbl, rt.IntValue(int64(i)+1),
+			wireFieldToLua(t.Runtime, opts, &fields[i]))
+	}
+	return c.PushingNext1(t.Runtime, rt.TableValue(tbl)), nil
+}
+
+// parseWireFields parses the given wire-format encoding into its fields.
+func parseWireFields(b []byte) ([]wireField, error) {
+	var fields []wireField
+	for len(b) > 0 {
+		field, n, err := consumeWireField(b)
+		if err != nil {
+			return nil, err
+		}
+		b = b[n:]
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// consumeWireField parses the wire field at the start of b and returns it
+// together with its length.
+func consumeWireField(b []byte) (wireField, int, error) {
+	num, typ, n := protowire.ConsumeTag(b)
+	if n < 0 {
+		return wireField{}, 0, protowire.ParseError(n)
+	}
+	field := wireField{
+		number: num,
+		typ:    typ,
+	}
+	var m int
+	switch typ {
+	case protowire.VarintType:
+		field.varint, m = protowire.ConsumeVarint(b[n:])
+	case protowire.Fixed32Type:
+		var v uint32
+		v, m = protowire.ConsumeFixed32(b[n:])
+		field.varint = uint64(v)
+	case protowire.Fixed64Type:
+		field.varint, m = protowire.ConsumeFixed64(b[n:])
+	case protowire.BytesType:
+		field.raw, m = protowire.ConsumeBytes(b[n:])
+	case protowire.StartGroupType:
+		field.raw, m = protowire.ConsumeGroup(num, b[n:])
+	default:
+		return wireField{}, 0, fmt.Errorf(
+			"unexpected wire type %d for field %d", typ, num)
+	}
+	if m < 0 {
+		return wireField{}, 0, protowire.ParseError(m)
+	}
+	return field, n + m, nil
+}
+
+// rangeSubMessages calls f for each populated message directly contained in
+// rmsg, including list elements and map values, until f returns false.
+func rangeSubMessages(rmsg pr.Message, f func(pr.Message) bool) {
+	rmsg.Range(func(fd pr.FieldDescriptor, v pr.Value) bool {
+		switch {
+		case fd.IsList() &&
+			(fd.Kind() == pr.MessageKind || fd.Kind() == pr.GroupKind):
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				if !f(list.Get(i).Message()) {
+					return false
+				}
+			}
+		case fd.IsMap() && fd.MapValue().Kind() == pr.MessageKind:
+			cont := true
+			v.Map().Range(func(_ pr.MapKey, v pr.Value) bool {
+				cont = f(v.Message())
+				return cont
+			})
+			return cont
+		case !fd.IsList() && !fd.IsMap() &&
+			(fd.Kind() == pr.MessageKind || fd.Kind() == pr.GroupKind):
+			return f(v.Message())
+		}
+		return true
+	})
+}
+
+// wireFieldToLua converts the given wire field to a Lua table with number,
+// type and value entries.
+func wireFieldToLua(r *rt.Runtime, opts *Options, field *wireField) rt.Value {
+	tbl := rt.NewTable()
+	r.SetTable(tbl, rt.StringValue("number"), rt.IntValue(int64(field.number)))
+	r.SetTable(tbl, rt.StringValue("type"),
+		rt.StringValue(wireTypeNames[field.typ]))
+	r.SetTable(tbl, rt.StringValue("value"), wireValueToLua(opts, field))
+	return rt.TableValue(tbl)
+}
+
+// wireValueToLua converts the value of the given wire field to a Lua value.
+// The values of bytes fields and the contents of groups are strings, or
+// bytes values if the BytesUserData option is set. Other values are
+// unsigned integers.
+func wireValueToLua(opts *Options, field *wireField) rt.Value {
+	switch field.typ {
+	case protowire.BytesType, protowire.StartGroupType:
+		if opts.BytesUserData {
+			return wrapBytes(field.raw)
+		}
+		return rt.StringValue(string(field.raw))
+	default:
+		return uint64ToLua(field.varint)
+	}
+}
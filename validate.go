@@ -0,0 +1,670 @@
+package proto
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/arnodel/golua/code"
+	rt "github.com/arnodel/golua/runtime"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	pr "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// validateSchema is the schema of the validation rule annotations.
+//
+// Field rules are set with the golua.validate.field option. For repeated and
+// map fields, required, min_len and max_len apply to the number of entries,
+// while the other rules apply to each element or map value.
+// Message rules are set with the golua.validate.message option. Each
+// constraint is a Lua expression or chunk, evaluated with the message bound
+// to msg, which must yield a true value. Apart from msg, only the builtins in
+// constraintBuiltins and copies of the libraries in constraintLibs are
+// visible to constraints.
+// The schema is not registered globally, see RegisterValidateSchema.
+const validateSchema = `
+name: "golua/validate.proto"
+package: "golua.validate"
+dependency: "google/protobuf/descriptor.proto"
+syntax: "proto2"
+message_type {
+  name: "FieldRules"
+  field { name: "min" number: 1 label: LABEL_OPTIONAL type: TYPE_DOUBLE }
+  field { name: "max" number: 2 label: LABEL_OPTIONAL type: TYPE_DOUBLE }
+  field { name: "min_len" number: 3 label: LABEL_OPTIONAL type: TYPE_UINT64 }
+  field { name: "max_len" number: 4 label: LABEL_OPTIONAL type: TYPE_UINT64 }
+  field { name: "pattern" number: 5 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "required" number: 6 label: LABEL_OPTIONAL type: TYPE_BOOL }
+  field { name: "in" number: 7 label: LABEL_REPEATED type: TYPE_STRING }
+  field { name: "not_in" number: 8 label: LABEL_REPEATED type: TYPE_STRING }
+  field { name: "unique" number: 9 label: LABEL_OPTIONAL type: TYPE_BOOL }
+}
+message_type {
+  name: "Constraint"
+  field { name: "expr" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "message" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+}
+message_type {
+  name: "MessageRules"
+  field {
+    name: "constraints" number: 1 label: LABEL_REPEATED
+    type: TYPE_MESSAGE type_name: ".golua.validate.Constraint"
+  }
+}
+extension {
+  name: "field" number: 73516 label: LABEL_OPTIONAL
+  type: TYPE_MESSAGE type_name: ".golua.validate.FieldRules"
+  extendee: ".google.protobuf.FieldOptions"
+}
+extension {
+  name: "message" number: 73516 label: LABEL_OPTIONAL
+  type: TYPE_MESSAGE type_name: ".golua.validate.MessageRules"
+  extendee: ".google.protobuf.MessageOptions"
+}
+`
+
+// Violation describes a validation rule which a message does not satisfy.
+type Violation struct {
+	// Path is the path to the offending field. It is empty for message
+	// constraints of the validated message itself.
+	Path string
+
+	// Rule is the name of the violated rule, or "expr" for message
+	// constraints.
+	Rule string
+
+	// Message describes the violation.
+	Message string
+}
+
+// fieldRules are the parsed validation rules of a field.
+type fieldRules struct {
+	min, max       *float64
+	minLen, maxLen *uint64
+	pattern        *regexp.Regexp
+	required       bool
+	unique         bool
+	in, notIn      map[string]bool
+}
+
+// constraint is a message-level validation constraint.
+type constraint struct {
+	// expr is the Lua source of the constraint.
+	expr string
+
+	// message is the violation message.
+	message string
+
+	// unit is the compiled constraint.
+	unit *code.Unit
+}
+
+var (
+	// validateFile is the file descriptor of validateSchema. It is not
+	// registered globally unless RegisterValidateSchema is called.
+	validateFile pr.FileDescriptor
+
+	// validateTypes contains the validation option extensions. It is used
+	// to decode the options of descriptors, so the extensions need not be
+	// registered globally.
+	validateTypes = new(protoregistry.Types)
+
+	// fieldRulesExt and messageRulesExt are the validation option extensions.
+	fieldRulesExt, messageRulesExt pr.ExtensionType
+
+	// fieldRulesCache caches the parsed rules of field descriptors.
+	// A nil value means the field has no rules.
+	fieldRulesCache sync.Map
+
+	// constraintsCache caches the compiled constraints of message
+	// descriptors.
+	constraintsCache sync.Map
+
+	// constraintBuiltins are the global functions visible to constraints.
+	constraintBuiltins = []string{
+		"assert", "error", "ipairs", "next", "pairs", "rawequal", "rawget",
+		"rawlen", "select", "tonumber", "tostring", "type",
+	}
+
+	// constraintLibs are the libraries visible to constraints, if loaded.
+	constraintLibs = []string{"math", "string", "utf8"}
+)
+
+// init parses the validation rule annotations and registers the Validate
+// method.
+func init() {
+	fdp := new(descriptorpb.FileDescriptorProto)
+	if err := prototext.Unmarshal([]byte(validateSchema), fdp); err != nil {
+		panic(err)
+	}
+	var err error
+	validateFile, err = protodesc.NewFile(fdp, protoregistry.GlobalFiles)
+	if err != nil {
+		panic(err)
+	}
+	fieldRulesExt = dynamicpb.NewExtensionType(
+		validateFile.Extensions().ByName("field"))
+	messageRulesExt = dynamicpb.NewExtensionType(
+		validateFile.Extensions().ByName("message"))
+	for _, xt := range []pr.ExtensionType{fieldRulesExt, messageRulesExt} {
+		if err = validateTypes.RegisterExtension(xt); err != nil {
+			panic(err)
+		}
+	}
+	setMapFunc(msgMethods, "Validate", msgValidate, 1, false, cpuIOTimeSafe)
+}
+
+// RegisterValidateSchema registers the file golua/validate.proto with the
+// validation rule annotations, its messages and its extensions in the
+// global registries. This is needed only if schemas importing the file are
+// built or parsed from the global registries. The extensions use field
+// number 73516 of google.protobuf.FieldOptions and
+// google.protobuf.MessageOptions.
+func RegisterValidateSchema() error {
+	// The global registries panic on conflicts by default, so conflicts are
+	// checked for first.
+	_, err := protoregistry.GlobalFiles.FindFileByPath(validateFile.Path())
+	if err == nil {
+		return fmt.Errorf("file %s is already registered", validateFile.Path())
+	}
+	var names []pr.FullName
+	for i := 0; i < validateFile.Messages().Len(); i++ {
+		names = append(names, validateFile.Messages().Get(i).FullName())
+	}
+	for i := 0; i < validateFile.Extensions().Len(); i++ {
+		names = append(names, validateFile.Extensions().Get(i).FullName())
+	}
+	for _, name := range names {
+		_, err = protoregistry.GlobalFiles.FindDescriptorByName(name)
+		if err == nil {
+			return fmt.Errorf("name %s is already registered", name)
+		}
+	}
+	for _, xt := range []pr.ExtensionType{fieldRulesExt, messageRulesExt} {
+		xd := xt.TypeDescriptor()
+		_, err = protoregistry.GlobalTypes.FindExtensionByNumber(
+			xd.ContainingMessage().FullName(), xd.Number())
+		if err == nil {
+			return fmt.Errorf("extension number %d of %s is already registered",
+				xd.Number(), xd.ContainingMessage().FullName())
+		}
+	}
+	if err := protoregistry.GlobalFiles.RegisterFile(validateFile); err != nil {
+		return err
+	}
+	for i := 0; i < validateFile.Messages().Len(); i++ {
+		mt := dynamicpb.NewMessageType(validateFile.Messages().Get(i))
+		if err := protoregistry.GlobalTypes.RegisterMessage(mt); err != nil {
+			return err
+		}
+	}
+	for _, xt := range []pr.ExtensionType{fieldRulesExt, messageRulesExt} {
+		if err := protoregistry.GlobalTypes.RegisterExtension(xt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks the protobuf message wrapped in v against the validation
+// rules annotated in its schema. Message constraints are evaluated in t.
+func Validate(t *rt.Thread, v rt.Value) ([]Violation, error) {
+	msg, ok := unwrapReadable(runtimeOptions(t.Runtime), v)
+	if !ok {
+		return nil, fmt.Errorf("cannot validate %s", v.TypeName())
+	}
+	return validateMessage(t, msg.ProtoReflect(), "", nil)
+}
+
+// getFieldRules returns the validation rules of fd, or nil if it has none.
+func getFieldRules(fd pr.FieldDescriptor) (*fieldRules, error) {
+	if cached, ok := fieldRulesCache.Load(fd); ok {
+		return cached.(*fieldRules), nil
+	}
+	rules, err := parseFieldRules(fd)
+	if err != nil {
+		return nil, err
+	}
+	fieldRulesCache.Store(fd, rules)
+	return rules, nil
+}
+
+// getConstraints returns the validation constraints of md, compiled in r.
+func getConstraints(
+	r *rt.Runtime, md pr.MessageDescriptor,
+) ([]constraint, error) {
+	if cached, ok := constraintsCache.Load(md); ok {
+		return cached.([]constraint), nil
+	}
+	rules, err := optionsExtension(md, messageRulesExt)
+	if err != nil {
+		return nil, err
+	}
+	var constraints []constraint
+	if rules != nil {
+		fd := rules.Descriptor().Fields().ByName("constraints")
+		list := rules.Get(fd).List()
+		for i := 0; i < list.Len(); i++ {
+			rmsg := list.Get(i).Message()
+			fields := rmsg.Descriptor().Fields()
+			expr := rmsg.Get(fields.ByName("expr")).String()
+			unit, size, err := r.CompileLuaChunkOrExp(
+				string(md.FullName()), []byte(expr))
+			// The unit is cached, so it does not count against the quota.
+			r.ReleaseMem(size)
+			if err != nil {
+				return nil, err
+			}
+			constraints = append(constraints, constraint{
+				expr:    expr,
+				message: rmsg.Get(fields.ByName("message")).String(),
+				unit:    unit,
+			})
+		}
+	}
+	constraintsCache.Store(md, constraints)
+	return constraints, nil
+}
+
+// msgValidate validates a message against the validation rules annotated in
+// its schema and returns the list of violations as tables with path, rule
+// and message entries.
+func msgValidate(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	violations, err := Validate(t, c.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+	tbl := rt.NewTable()
+	for i, v := range violations {
+		entry := rt.NewTable()
+		t.Runtime.SetTable(entry, rt.StringValue("path"), rt.StringValue(v.Path))
+		t.Runtime.SetTable(entry, rt.StringValue("rule"), rt.StringValue(v.Rule))
+		t.Runtime.SetTable(
+			entry, rt.StringValue("message"), rt.StringValue(v.Message))
+		t.Runtime.SetTable(tbl, rt.IntValue(int64(i)+1), rt.TableValue(entry))
+	}
+	return c.PushingNext1(t.Runtime, rt.TableValue(tbl)), nil
+}
+
+// optionsExtension returns the value of the message extension xt in the
+// options of desc, or nil if it is not set. The options are decoded with
+// validateTypes, so the extension is found whether or not it is registered
+// globally.
+func optionsExtension(
+	desc pr.Descriptor, xt pr.ExtensionType,
+) (pr.Message, error) {
+	opts := desc.Options()
+	if opts == nil {
+		return nil, nil
+	}
+	buf, err := proto.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+	rmsg := opts.ProtoReflect().New()
+	err = proto.UnmarshalOptions{
+		Resolver: validateTypes,
+	}.Unmarshal(buf, rmsg.Interface())
+	if err != nil {
+		return nil, err
+	}
+	if !rmsg.Has(xt.TypeDescriptor()) {
+		return nil, nil
+	}
+	return rmsg.Get(xt.TypeDescriptor()).Message(), nil
+}
+
+// parseFieldRules parses the validation rules of fd.
+func parseFieldRules(fd pr.FieldDescriptor) (*fieldRules, error) {
+	rmsg, err := optionsExtension(fd, fieldRulesExt)
+	if err != nil || rmsg == nil {
+		return nil, err
+	}
+	fields := rmsg.Descriptor().Fields()
+	has := func(name pr.Name) (pr.Value, bool) {
+		fd := fields.ByName(name)
+		return rmsg.Get(fd), rmsg.Has(fd)
+	}
+	rules := new(fieldRules)
+	if v, ok := has("min"); ok {
+		f := v.Float()
+		rules.min = &f
+	}
+	if v, ok := has("max"); ok {
+		f := v.Float()
+		rules.max = &f
+	}
+	if v, ok := has("min_len"); ok {
+		u := v.Uint()
+		rules.minLen = &u
+	}
+	if v, ok := has("max_len"); ok {
+		u := v.Uint()
+		rules.maxLen = &u
+	}
+	if v, ok := has("pattern"); ok {
+		if rules.pattern, err = regexp.Compile(v.String()); err != nil {
+			return nil, fmt.Errorf("field '%s': invalid pattern: %w",
+				fd.FullName(), err)
+		}
+	}
+	if v, ok := has("required"); ok {
+		rules.required = v.Bool()
+	}
+	if v, ok := has("unique"); ok {
+		rules.unique = v.Bool()
+	}
+	for name, set := range map[pr.Name]*map[string]bool{
+		"in":     &rules.in,
+		"not_in": &rules.notIn,
+	} {
+		if v, ok := has(name); ok {
+			list := v.List()
+			*set = make(map[string]bool, list.Len())
+			for i := 0; i < list.Len(); i++ {
+				(*set)[list.Get(i).String()] = true
+			}
+		}
+	}
+	return rules, nil
+}
+
+// validateConstraints evaluates the constraints of the message rmsg at
+// path in t.
+func validateConstraints(
+	t *rt.Thread, rmsg pr.Message, path string, violations []Violation,
+) ([]Violation, error) {
+	constraints, err := getConstraints(t.Runtime, rmsg.Descriptor())
+	if err != nil || len(constraints) == 0 {
+		return violations, err
+	}
+	msg := WrapReadOnly(rmsg.Interface())
+	for _, cons := range constraints {
+		env := constraintEnv(t.Runtime)
+		env.Set(rt.StringValue("msg"), msg)
+		chunk := t.Runtime.LoadLuaUnit(cons.unit, rt.TableValue(env))
+		result, err := rt.Call1(t, rt.FunctionValue(chunk))
+		if err != nil {
+			return nil, err
+		}
+		if rt.Truth(result) {
+			continue
+		}
+		message := cons.message
+		if message == "" {
+			message = fmt.Sprintf("constraint '%s' failed", cons.expr)
+		}
+		violations = append(violations, Violation{
+			Path:    path,
+			Rule:    "expr",
+			Message: message,
+		})
+	}
+	return violations, nil
+}
+
+// constraintEnv returns a new global environment for constraints with the
+// builtins and libraries of r which constraints may use.
+func constraintEnv(r *rt.Runtime) *rt.Table {
+	globals := r.GlobalEnv()
+	env := rt.NewTable()
+	for _, name := range constraintBuiltins {
+		key := rt.StringValue(name)
+		env.Set(key, globals.Get(key))
+	}
+	for _, name := range constraintLibs {
+		key := rt.StringValue(name)
+		lib, ok := globals.Get(key).TryTable()
+		if !ok {
+			continue
+		}
+		// Copy the library so constraints cannot change it.
+		libCopy := rt.NewTable()
+		k, v, _ := lib.Next(rt.NilValue)
+		for ; !k.IsNil(); k, v, _ = lib.Next(k) {
+			libCopy.Set(k, v)
+		}
+		env.Set(key, rt.TableValue(libCopy))
+	}
+	return env
+}
+
+// validateField validates the field fd of rmsg at path against its rules.
+func validateField(
+	t *rt.Thread, rmsg pr.Message, fd pr.FieldDescriptor, path string,
+	violations []Violation,
+) ([]Violation, error) {
+	rules, err := getFieldRules(fd)
+	if err != nil {
+		return nil, err
+	}
+	has := rmsg.Has(fd)
+	if rules != nil && rules.required && !has {
+		violations = append(violations, Violation{
+			Path:    path,
+			Rule:    "required",
+			Message: "field is required",
+		})
+	}
+	if !has && (fd.HasPresence() || fd.IsList() || fd.IsMap()) {
+		return violations, nil
+	}
+	v := rmsg.Get(fd)
+	switch {
+	case fd.IsList():
+		list := v.List()
+		if rules != nil {
+			violations = validateLen(rules, list.Len(), "items", path, violations)
+		}
+		seen := make(map[string]bool)
+		for i := 0; i < list.Len(); i++ {
+			elemPath := listIndexPath(path, i)
+			if rules != nil && rules.unique {
+				key, err := valueKey(fd, list.Get(i))
+				if err != nil {
+					return nil, err
+				}
+				if seen[key] {
+					violations = append(violations, Violation{
+						Path:    elemPath,
+						Rule:    "unique",
+						Message: "duplicate item",
+					})
+				}
+				seen[key] = true
+			}
+			violations, err = validateValue(
+				t, rules, fd, list.Get(i), elemPath, violations)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case fd.IsMap():
+		m := v.Map()
+		if rules != nil {
+			violations = validateLen(rules, m.Len(), "entries", path, violations)
+		}
+		for _, k := range sortedMapKeys(m) {
+			violations, err = validateValue(t, rules, fd.MapValue(), m.Get(k),
+				mapKeyPath(path, k), violations)
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		violations, err = validateValue(t, rules, fd, v, path, violations)
+	}
+	return violations, err
+}
+
+// validateLen validates the length n of a value at path against rules.
+func validateLen(
+	rules *fieldRules, n int, unit, path string, violations []Violation,
+) []Violation {
+	if rules.minLen != nil && uint64(n) < *rules.minLen {
+		message := fmt.Sprintf("%d %s is less than minimum %d",
+			n, unit, *rules.minLen)
+		violations = append(violations, Violation{
+			Path:    path,
+			Rule:    "min_len",
+			Message: message,
+		})
+	}
+	if rules.maxLen != nil && uint64(n) > *rules.maxLen {
+		message := fmt.Sprintf("%d %s is more than maximum %d",
+			n, unit, *rules.maxLen)
+		violations = append(violations, Violation{
+			Path:    path,
+			Rule:    "max_len",
+			Message: message,
+		})
+	}
+	return violations
+}
+
+// validateMessage validates rmsg at path and all messages it contains.
+func validateMessage(
+	t *rt.Thread, rmsg pr.Message, path string, violations []Violation,
+) ([]Violation, error) {
+	fields := rmsg.Descriptor().Fields()
+	var err error
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		violations, err = validateField(
+			t, rmsg, fd, fieldPath(path, fd), violations)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return validateConstraints(t, rmsg, path, violations)
+}
+
+// validateValue validates a singular value, list element or map value v of
+// the field fd at path against rules. Messages are validated recursively.
+func validateValue(
+	t *rt.Thread, rules *fieldRules, fd pr.FieldDescriptor, v pr.Value,
+	path string, violations []Violation,
+) ([]Violation, error) {
+	if fd.Kind() == pr.MessageKind || fd.Kind() == pr.GroupKind {
+		return validateMessage(t, v.Message(), path, violations)
+	}
+	if rules == nil {
+		return violations, nil
+	}
+	violate := func(rule, format string, args ...interface{}) {
+		violations = append(violations, Violation{
+			Path:    path,
+			Rule:    rule,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+	if f, ok := numericValue(fd, v); ok {
+		if rules.min != nil && f < *rules.min {
+			violate("min", "value %v is less than minimum %v", v, *rules.min)
+		}
+		if rules.max != nil && f > *rules.max {
+			violate("max", "value %v is more than maximum %v", v, *rules.max)
+		}
+	}
+	switch fd.Kind() {
+	case pr.StringKind:
+		s := v.String()
+		if !fd.IsList() && !fd.IsMap() {
+			violations = validateLen(
+				rules, utf8.RuneCountInString(s), "characters", path, violations)
+		}
+		if rules.pattern != nil && !rules.pattern.MatchString(s) {
+			violate("pattern", "value does not match pattern '%s'", rules.pattern)
+		}
+	case pr.BytesKind:
+		b := v.Bytes()
+		if !fd.IsList() && !fd.IsMap() {
+			violations = validateLen(rules, len(b), "bytes", path, violations)
+		}
+		if rules.pattern != nil && !rules.pattern.Match(b) {
+			violate("pattern", "value does not match pattern '%s'", rules.pattern)
+		}
+	}
+	if rules.in == nil && rules.notIn == nil {
+		return violations, nil
+	}
+	keys := valueKeys(fd, v)
+	if rules.in != nil && !anyKeyIn(keys, rules.in) {
+		violate("in", "value '%s' is not in the allowed set", keys[0])
+	}
+	if anyKeyIn(keys, rules.notIn) {
+		violate("not_in", "value '%s' is not allowed", keys[0])
+	}
+	return violations, nil
+}
+
+// anyKeyIn checks whether any of the given keys is in set.
+func anyKeyIn(keys []string, set map[string]bool) bool {
+	for _, key := range keys {
+		if set[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// numericValue returns the value v of field fd as a float, if fd is
+// numeric.
+func numericValue(fd pr.FieldDescriptor, v pr.Value) (float64, bool) {
+	switch fd.Kind() {
+	case pr.Int32Kind, pr.Sint32Kind, pr.Sfixed32Kind,
+		pr.Int64Kind, pr.Sint64Kind, pr.Sfixed64Kind:
+		return float64(v.Int()), true
+	case pr.Uint32Kind, pr.Fixed32Kind, pr.Uint64Kind, pr.Fixed64Kind:
+		return float64(v.Uint()), true
+	case pr.FloatKind, pr.DoubleKind:
+		return v.Float(), !math.IsNaN(v.Float())
+	default:
+		return 0, false
+	}
+}
+
+// valueKey returns a string uniquely identifying the value v of field fd.
+func valueKey(fd pr.FieldDescriptor, v pr.Value) (string, error) {
+	if fd.Kind() == pr.MessageKind || fd.Kind() == pr.GroupKind {
+		buf, err := proto.MarshalOptions{
+			Deterministic: true,
+		}.Marshal(v.Message().Interface())
+		return string(buf), err
+	}
+	return valueKeys(fd, v)[0], nil
+}
+
+// valueKeys returns the string representations of the scalar value v of
+// field fd used by the in and not_in rules. Enum values are represented
+// by both their name and their number.
+func valueKeys(fd pr.FieldDescriptor, v pr.Value) []string {
+	switch fd.Kind() {
+	case pr.BoolKind:
+		return []string{strconv.FormatBool(v.Bool())}
+	case pr.EnumKind:
+		number := strconv.FormatInt(int64(v.Enum()), 10)
+		if evd := fd.Enum().Values().ByNumber(v.Enum()); evd != nil {
+			return []string{string(evd.Name()), number}
+		}
+		return []string{number}
+	case pr.StringKind:
+		return []string{v.String()}
+	case pr.BytesKind:
+		return []string{string(v.Bytes())}
+	case pr.FloatKind, pr.DoubleKind:
+		return []string{strconv.FormatFloat(v.Float(), 'g', -1, 64)}
+	case pr.Uint32Kind, pr.Fixed32Kind, pr.Uint64Kind, pr.Fixed64Kind:
+		return []string{strconv.FormatUint(v.Uint(), 10)}
+	default:
+		return []string{strconv.FormatInt(v.Int(), 10)}
+	}
+}
@@ -3,16 +3,95 @@ package proto
 import (
 	"fmt"
 	"math"
+	"strconv"
+	"strings"
 
 	rt "github.com/arnodel/golua/runtime"
 	"google.golang.org/protobuf/proto"
 	pr "google.golang.org/protobuf/reflect/protoreflect"
 )
 
+// cloneMessage returns a deep copy of rmsg. Unlike proto.Clone, the copy is
+// always mutable, even if rmsg is an invalid message.
+func cloneMessage(rmsg pr.Message) pr.Message {
+	dst := rmsg.Type().New()
+	proto.Merge(dst.Interface(), rmsg.Interface())
+	return dst
+}
+
+// cloneScalarOrMessage returns a deep copy of the singular value, list
+// element or map value v.
+func cloneScalarOrMessage(v pr.Value) pr.Value {
+	switch x := v.Interface().(type) {
+	case pr.Message:
+		return pr.ValueOfMessage(cloneMessage(x))
+	case []byte:
+		return pr.ValueOfBytes(append([]byte(nil), x...))
+	default:
+		return v
+	}
+}
+
+// detachValue returns a deep copy of value, which is to be assigned to the
+// field fd of msg. This prevents read-only and copy-on-write values from
+// becoming mutable through aliasing.
+func detachValue(
+	msg pr.Message, fd pr.FieldDescriptor, value pr.Value,
+) pr.Value {
+	switch {
+	case fd.IsList():
+		src, dst := value.List(), msg.NewField(fd).List()
+		for i := 0; i < src.Len(); i++ {
+			dst.Append(cloneScalarOrMessage(src.Get(i)))
+		}
+		return pr.ValueOfList(dst)
+	case fd.IsMap():
+		src, dst := value.Map(), msg.NewField(fd).Map()
+		src.Range(func(k pr.MapKey, v pr.Value) bool {
+			dst.Set(k, cloneScalarOrMessage(v))
+			return true
+		})
+		return pr.ValueOfMap(dst)
+	default:
+		return cloneScalarOrMessage(value)
+	}
+}
+
+// mustDetachValue checks whether v is a read-only, copy-on-write or tracked
+// message, list or map, which must be copied on assignment.
+func mustDetachValue(v rt.Value) bool {
+	ud, ok := v.TryUserData()
+	if !ok {
+		return false
+	}
+	switch ud.Metatable() {
+	case msgTableReadOnly, listTableReadOnly, mapTableReadOnly:
+		return true
+	}
+	switch x := ud.Value().(type) {
+	case proto.Message:
+		switch x.ProtoReflect().(type) {
+		case *cowMessage, *trackedMessage:
+			return true
+		}
+	case *listWrapper:
+		switch x.list.(type) {
+		case *cowList, *trackedList:
+			return true
+		}
+	case *mapWrapper:
+		switch x.m.(type) {
+		case *cowMap, *trackedMap:
+			return true
+		}
+	}
+	return false
+}
+
 // luaToProtoValue converts the given luaValue to a protobuf value that can
 // be assigned to the given field descriptor.
 func luaToProtoValue(
-	fd pr.FieldDescriptor, luaValue rt.Value,
+	opts *Options, fd pr.FieldDescriptor, luaValue rt.Value,
 ) (pr.Value, error) {
 	switch {
 	case fd.IsMap():
@@ -106,20 +185,18 @@ func luaToProtoValue(
 		return pr.ValueOfEnum(n), nil
 	case fd.Kind() == pr.Int32Kind, fd.Kind() == pr.Sint32Kind,
 		fd.Kind() == pr.Sfixed32Kind:
-		i, ok := luaValue.TryInt()
-		if !ok {
-			return pr.Value{}, fmt.Errorf("expected integer, got %s",
-				luaValue.TypeName())
+		i, err := luaToInteger(opts, fd, luaValue)
+		if err != nil {
+			return pr.Value{}, err
 		}
 		if i < math.MinInt32 || i > math.MaxInt32 {
 			return pr.Value{}, fmt.Errorf("%s field out of bounds: %d", fd.Kind(), i)
 		}
 		return pr.ValueOfInt32(int32(i)), nil
 	case fd.Kind() == pr.Uint32Kind, fd.Kind() == pr.Fixed32Kind:
-		i, ok := luaValue.TryInt()
-		if !ok {
-			return pr.Value{}, fmt.Errorf("expected integer, got %s",
-				luaValue.TypeName())
+		i, err := luaToInteger(opts, fd, luaValue)
+		if err != nil {
+			return pr.Value{}, err
 		}
 		if i < 0 || i > math.MaxUint32 {
 			return pr.Value{}, fmt.Errorf("%s field out of bounds: %d", fd.Kind(), i)
@@ -127,39 +204,58 @@ func luaToProtoValue(
 		return pr.ValueOfUint32(uint32(i)), nil
 	case fd.Kind() == pr.Int64Kind, fd.Kind() == pr.Sint64Kind,
 		fd.Kind() == pr.Sfixed64Kind:
-		i, ok := luaValue.TryInt()
-		if !ok {
-			return pr.Value{}, fmt.Errorf("expected integer, got %s",
-				luaValue.TypeName())
+		if u, ok := tryUint64(luaValue); ok {
+			return pr.Value{}, fmt.Errorf("%s field out of bounds: %d", fd.Kind(), u)
+		}
+		i, err := luaToInteger(opts, fd, luaValue)
+		if err != nil {
+			return pr.Value{}, err
 		}
 		return pr.ValueOfInt64(i), nil
 	case fd.Kind() == pr.Uint64Kind, fd.Kind() == pr.Fixed64Kind:
-		i, ok := luaValue.TryInt()
-		if !ok {
-			return pr.Value{}, fmt.Errorf("expected integer, got %s",
-				luaValue.TypeName())
+		if u, ok := tryUint64(luaValue); ok {
+			return pr.ValueOfUint64(u), nil
+		}
+		if s, ok := luaValue.TryString(); ok &&
+			opts.NumberConversion == NumberConversionLenient {
+			if u, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64); err == nil {
+				return pr.ValueOfUint64(u), nil
+			}
+		}
+		if f, ok := luaValue.TryFloat(); ok &&
+			opts.NumberConversion == NumberConversionLenient &&
+			f >= 1<<63 && f < 1<<64 {
+			// beyond the int64 range, all floats are integers
+			return pr.ValueOfUint64(uint64(f)), nil
+		}
+		i, err := luaToInteger(opts, fd, luaValue)
+		if err != nil {
+			return pr.Value{}, err
+		}
+		if i < 0 {
+			return pr.Value{}, fmt.Errorf("%s field out of bounds: %d", fd.Kind(), i)
 		}
 		return pr.ValueOfUint64(uint64(i)), nil
 	case fd.Kind() == pr.FloatKind:
-		var f float32
-		if i, ok := luaValue.TryInt(); ok {
-			f = float32(i)
-		} else if f64, ok := luaValue.TryFloat(); ok {
-			f = float32(f64)
-		} else {
-			return pr.Value{}, fmt.Errorf("expected number, got %s",
-				luaValue.TypeName())
+		f64, err := luaToFloat(opts, fd, luaValue)
+		if err != nil {
+			return pr.Value{}, err
+		}
+		f := float32(f64)
+		if opts.NumberConversion == NumberConversionStrict &&
+			!math.IsNaN(f64) && float64(f) != f64 {
+			if math.IsInf(float64(f), 0) {
+				return pr.Value{}, fmt.Errorf(
+					"field '%s': %g overflows %s", fd.Name(), f64, fd.Kind())
+			}
+			return pr.Value{}, fmt.Errorf(
+				"field '%s': %g loses precision as %s", fd.Name(), f64, fd.Kind())
 		}
 		return pr.ValueOfFloat32(f), nil
 	case fd.Kind() == pr.DoubleKind:
-		var f float64
-		if i, ok := luaValue.TryInt(); ok {
-			f = float64(i)
-		} else if f64, ok := luaValue.TryFloat(); ok {
-			f = f64
-		} else {
-			return pr.Value{}, fmt.Errorf("expected number, got %s",
-				luaValue.TypeName())
+		f, err := luaToFloat(opts, fd, luaValue)
+		if err != nil {
+			return pr.Value{}, err
 		}
 		return pr.ValueOfFloat64(f), nil
 	case fd.Kind() == pr.StringKind:
@@ -170,14 +266,21 @@ func luaToProtoValue(
 		}
 		return pr.ValueOfString(s), nil
 	case fd.Kind() == pr.BytesKind:
-		s, ok := luaValue.TryString()
+		b, ok := luaToBytes(luaValue)
 		if !ok {
 			return pr.Value{}, fmt.Errorf("expected string, got %s",
 				luaValue.TypeName())
 		}
-		return pr.ValueOfBytes([]byte(s)), nil
+		if _, ok := luaValue.TryUserData(); ok {
+			// Bytes user data shares its array with the field it was read from.
+			b = append([]byte(nil), b...)
+		}
+		return pr.ValueOfBytes(b), nil
 	case fd.Kind() == pr.MessageKind:
 		ud, ok := luaValue.TryUserData()
+		if !ok && opts.UnwrapWrappers && isWrapper(fd.Message()) {
+			return luaToWrapperValue(opts, fd.Message(), luaValue)
+		}
 		if !ok {
 			return pr.Value{}, fmt.Errorf("expected userdata, got %s",
 				luaValue.TypeName())
@@ -186,7 +289,7 @@ func luaToProtoValue(
 		if !ok {
 			return pr.Value{}, fmt.Errorf("expected message, got %T", ud.Value())
 		}
-		rmsg := msg.ProtoReflect()
+		rmsg := readableMessage(opts, msg)
 		lhsMD, rhsMD := fd.Message(), rmsg.Descriptor()
 		if lhsMD.FullName() != rhsMD.FullName() {
 			return pr.Value{}, fmt.Errorf(
@@ -199,14 +302,88 @@ func luaToProtoValue(
 	}
 }
 
+// luaToFloat converts the given Lua value to a float for the floating point
+// field fd according to the number conversion policy in opts.
+func luaToFloat(
+	opts *Options, fd pr.FieldDescriptor, luaValue rt.Value,
+) (float64, error) {
+	if i, ok := luaValue.TryInt(); ok {
+		f := float64(i)
+		if opts.NumberConversion == NumberConversionStrict &&
+			(f >= math.MaxInt64 || int64(f) != i) {
+			return 0, fmt.Errorf(
+				"field '%s': %d loses precision as %s", fd.Name(), i, fd.Kind())
+		}
+		return f, nil
+	}
+	if f, ok := luaValue.TryFloat(); ok {
+		return f, nil
+	}
+	if u, ok := tryUint64(luaValue); ok {
+		f := float64(u)
+		if opts.NumberConversion == NumberConversionStrict &&
+			(f >= math.MaxUint64 || uint64(f) != u) {
+			return 0, fmt.Errorf(
+				"field '%s': %d loses precision as %s", fd.Name(), u, fd.Kind())
+		}
+		return f, nil
+	}
+	if _, ok := luaValue.TryString(); ok &&
+		opts.NumberConversion == NumberConversionLenient {
+		if f, ok := rt.ToFloat(luaValue); ok {
+			return f, nil
+		}
+		return 0, fmt.Errorf(
+			"field '%s': cannot convert '%s' to %s",
+			fd.Name(), luaValue.AsString(), fd.Kind())
+	}
+	return 0, fmt.Errorf("expected number, got %s", luaValue.TypeName())
+}
+
+// luaToInteger converts the given Lua value to an integer for the integer
+// field fd according to the number conversion policy in opts.
+// The caller must check the bounds of the field.
+func luaToInteger(
+	opts *Options, fd pr.FieldDescriptor, luaValue rt.Value,
+) (int64, error) {
+	if i, ok := luaValue.TryInt(); ok {
+		return i, nil
+	}
+	if opts.NumberConversion != NumberConversionLenient {
+		return 0, fmt.Errorf("field '%s': expected integer, got %s",
+			fd.Name(), luaValue.TypeName())
+	}
+	if f, ok := luaValue.TryFloat(); ok {
+		i, tp := rt.FloatToInt(f)
+		if tp != rt.IsInt && math.Trunc(f) == f {
+			return 0, fmt.Errorf("%s field out of bounds: %g", fd.Kind(), f)
+		}
+		if tp != rt.IsInt {
+			return 0, fmt.Errorf("field '%s': %g has no exact %s representation",
+				fd.Name(), f, fd.Kind())
+		}
+		return i, nil
+	}
+	if s, ok := luaValue.TryString(); ok {
+		i, ok := rt.ToInt(luaValue)
+		if !ok {
+			return 0, fmt.Errorf(
+				"field '%s': cannot convert '%s' to %s", fd.Name(), s, fd.Kind())
+		}
+		return i, nil
+	}
+	return 0, fmt.Errorf("field '%s': expected integer, got %s",
+		fd.Name(), luaValue.TypeName())
+}
+
 // protoFieldToLua converts the given protobuf value specified as a message
 // and a message field to a Lua value.
 // If the value is not supported, nil is returned.
 // If readOnly is true, composite fields will be returned as a read-only value.
 func protoFieldToLua(
-	rmsg pr.Message, fd pr.FieldDescriptor, readOnly bool,
+	opts *Options, rmsg pr.Message, fd pr.FieldDescriptor, readOnly bool,
 ) rt.Value {
-	return protoValueToLua(fd, rmsg.Get(fd), readOnly)
+	return protoValueToLua(opts, fd, rmsg.Get(fd), readOnly)
 }
 
 // protoValueToLua returns the given protobuf value from the given field
@@ -214,7 +391,7 @@ func protoFieldToLua(
 // If the value is not supported, nil is returned.
 // If readOnly is true, a composite value will be returned as a read-only value.
 func protoValueToLua(
-	fd pr.FieldDescriptor, value pr.Value, readOnly bool,
+	opts *Options, fd pr.FieldDescriptor, value pr.Value, readOnly bool,
 ) rt.Value {
 	switch x := value.Interface().(type) {
 	case bool:
@@ -226,7 +403,7 @@ func protoValueToLua(
 	case uint32:
 		return rt.IntValue(int64(x))
 	case uint64:
-		return rt.IntValue(int64(x))
+		return uint64ToLua(x)
 	case float32:
 		return rt.FloatValue(float64(x))
 	case float64:
@@ -234,10 +411,16 @@ func protoValueToLua(
 	case string:
 		return rt.StringValue(x)
 	case []byte:
+		if opts.BytesUserData {
+			return wrapBytes(x)
+		}
 		return rt.StringValue(string(x))
 	case pr.EnumNumber:
 		return rt.IntValue(int64(x))
 	case pr.Message:
+		if opts.UnwrapWrappers && isWrapper(x.Descriptor()) {
+			return wrapperToLua(opts, x)
+		}
 		return wrap(x.Interface(), readOnly || !x.IsValid())
 	case pr.List:
 		return wrapList(fd, x, readOnly || !x.IsValid())
@@ -0,0 +1,204 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	rt "github.com/arnodel/golua/runtime"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// newWireTable returns the proto.wire table with the functions for the
+// low-level wire-format encoding.
+func newWireTable(r *rt.Runtime) *rt.Table {
+	wire := rt.NewTable()
+	rt.SolemnlyDeclareCompliance(
+		cpuIOTimeSafe,
+		r.SetEnvGoFunc(wire, "decode", wireDecode, 1, false),
+		r.SetEnvGoFunc(wire, "encode", wireEncode, 1, false),
+	)
+	return wire
+}
+
+// wireDecode returns an iterator over the fields of a wire-format encoded
+// string or bytes value. The iterator returns the field number, the wire
+// type and the value of each field, and nil after the last field. The
+// value of a bytes field or group can be decoded in turn.
+func wireDecode(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	if err := c.Check1Arg(); err != nil {
+		return nil, err
+	}
+	b, ok := luaToBytes(c.Arg(0))
+	if !ok {
+		return nil, fmt.Errorf("string expected, got %s", c.Arg(0).TypeName())
+	}
+	opts := runtimeOptions(t.Runtime)
+	iteratorFunction := rt.NewGoFunction(
+		func(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+			if len(b) == 0 {
+				return c.PushingNext1(t.Runtime, rt.NilValue), nil
+			}
+			field, n, err := consumeWireField(b)
+			if err != nil {
+				return nil, err
+			}
+			b = b[n:]
+			return c.PushingNext(t.Runtime,
+				rt.IntValue(int64(field.number)),
+				rt.StringValue(wireTypeNames[field.typ]),
+				wireValueToLua(opts, &field)), nil
+		}, "iterator", 2, false)
+	rt.SolemnlyDeclareCompliance(cpuIOTimeSafe, iteratorFunction)
+	return c.PushingNext1(t.Runtime, rt.FunctionValue(iteratorFunction)), nil
+}
+
+// wireEncode encodes a list of fields in wire format. Each field is a table
+// with number, type and value entries, as returned by msg:UnknownFields().
+// The value of a bytes field or group may also be a list of fields, which
+// is encoded in turn, up to protowire.DefaultRecursionLimit levels deep.
+func wireEncode(t *rt.Thread, c *rt.GoCont) (rt.Cont, error) {
+	if err := c.Check1Arg(); err != nil {
+		return nil, err
+	}
+	fields, err := c.TableArg(0)
+	if err != nil {
+		return nil, err
+	}
+	b, err := appendWireFields(nil, fields, make(map[*rt.Table]bool))
+	if err != nil {
+		return nil, err
+	}
+	return pushingString(t, c, string(b))
+}
+
+// appendWireFields appends the wire-format encoding of the list of fields
+// to b. The lists of fields currently being encoded are in visiting.
+func appendWireFields(
+	b []byte, fields *rt.Table, visiting map[*rt.Table]bool,
+) ([]byte, error) {
+	if visiting[fields] {
+		return nil, errors.New("cannot encode list of fields with cycles")
+	}
+	if len(visiting) >= protowire.DefaultRecursionLimit {
+		return nil, errors.New("list of fields nested too deeply")
+	}
+	visiting[fields] = true
+	defer delete(visiting, fields)
+	for i := int64(1); ; i++ {
+		v := fields.Get(rt.IntValue(i))
+		if v.IsNil() {
+			return b, nil
+		}
+		tbl, ok := v.TryTable()
+		if !ok {
+			return nil, fmt.Errorf("field %d: table expected, got %s",
+				i, v.TypeName())
+		}
+		var err error
+		if b, err = appendWireField(b, tbl, visiting); err != nil {
+			return nil, fmt.Errorf("field %d: %w", i, err)
+		}
+	}
+}
+
+// appendWireField appends the wire-format encoding of the field given by
+// the table tbl to b. The lists of fields currently being encoded are in
+// visiting.
+func appendWireField(
+	b []byte, tbl *rt.Table, visiting map[*rt.Table]bool,
+) ([]byte, error) {
+	numValue := tbl.Get(rt.StringValue("number"))
+	num, ok := numValue.TryInt()
+	if !ok {
+		return nil, fmt.Errorf("field number must be an integer, not %s",
+			numValue.TypeName())
+	}
+	if num < int64(protowire.MinValidNumber) ||
+		num > int64(protowire.MaxValidNumber) {
+		return nil, fmt.Errorf("invalid field number %d", num)
+	}
+	typ, err := luaToWireType(tbl.Get(rt.StringValue("type")))
+	if err != nil {
+		return nil, err
+	}
+	value := tbl.Get(rt.StringValue("value"))
+	b = protowire.AppendTag(b, protowire.Number(num), typ)
+	switch typ {
+	case protowire.VarintType:
+		u, err := luaToWireInt(value)
+		if err != nil {
+			return nil, err
+		}
+		return protowire.AppendVarint(b, u), nil
+	case protowire.Fixed32Type:
+		if f, ok := value.TryFloat(); ok {
+			return protowire.AppendFixed32(b, math.Float32bits(float32(f))), nil
+		}
+		u, err := luaToWireInt(value)
+		if err != nil {
+			return nil, err
+		}
+		if int64(u) < math.MinInt32 || (int64(u) >= 0 && u > math.MaxUint32) {
+			return nil, fmt.Errorf("fixed32 value out of bounds: %d", int64(u))
+		}
+		return protowire.AppendFixed32(b, uint32(u)), nil
+	case protowire.Fixed64Type:
+		if f, ok := value.TryFloat(); ok {
+			return protowire.AppendFixed64(b, math.Float64bits(f)), nil
+		}
+		u, err := luaToWireInt(value)
+		if err != nil {
+			return nil, err
+		}
+		return protowire.AppendFixed64(b, u), nil
+	}
+	var raw []byte
+	if nested, ok := value.TryTable(); ok {
+		if raw, err = appendWireFields(nil, nested, visiting); err != nil {
+			return nil, err
+		}
+	} else if raw, ok = luaToBytes(value); !ok {
+		return nil, fmt.Errorf("string or list of fields expected, got %s",
+			value.TypeName())
+	}
+	if typ == protowire.BytesType {
+		return protowire.AppendBytes(b, raw), nil
+	}
+	b = append(b, raw...)
+	return protowire.AppendTag(b, protowire.Number(num), protowire.EndGroupType),
+		nil
+}
+
+// luaToWireType converts the name of a wire type to the wire type.
+func luaToWireType(v rt.Value) (protowire.Type, error) {
+	name, ok := v.TryString()
+	if !ok {
+		return 0, fmt.Errorf("wire type must be a string, not %s", v.TypeName())
+	}
+	for typ, typName := range wireTypeNames {
+		if typName == name {
+			return typ, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid wire type '%s'", name)
+}
+
+// luaToWireInt converts an integer, uint64 or boolean Lua value to the
+// unsigned integer value of a varint, fixed32 or fixed64 field. Negative
+// integers are encoded in two's complement.
+func luaToWireInt(v rt.Value) (uint64, error) {
+	if u, ok := tryUint64(v); ok {
+		return u, nil
+	}
+	if i, ok := v.TryInt(); ok {
+		return uint64(i), nil
+	}
+	if b, ok := v.TryBool(); ok {
+		if b {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("integer expected, got %s", v.TypeName())
+}
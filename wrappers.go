@@ -0,0 +1,60 @@
+package proto
+
+import (
+	"fmt"
+
+	rt "github.com/arnodel/golua/runtime"
+	pr "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+	_ "google.golang.org/protobuf/types/known/wrapperspb" // register wrappers
+)
+
+// wrapperFullNames contains the full names of the well-known wrapper types.
+var wrapperFullNames = map[pr.FullName]bool{
+	"google.protobuf.BoolValue":   true,
+	"google.protobuf.BytesValue":  true,
+	"google.protobuf.DoubleValue": true,
+	"google.protobuf.FloatValue":  true,
+	"google.protobuf.Int32Value":  true,
+	"google.protobuf.Int64Value":  true,
+	"google.protobuf.StringValue": true,
+	"google.protobuf.UInt32Value": true,
+	"google.protobuf.UInt64Value": true,
+}
+
+// isWrapper checks whether md describes one of the well-known wrapper types.
+func isWrapper(md pr.MessageDescriptor) bool {
+	return wrapperFullNames[md.FullName()]
+}
+
+// luaToWrapperValue converts the given Lua scalar to a wrapper message
+// described by md.
+func luaToWrapperValue(
+	opts *Options, md pr.MessageDescriptor, luaValue rt.Value,
+) (pr.Value, error) {
+	valueFD := md.Fields().ByName("value")
+	value, err := luaToProtoValue(opts, valueFD, luaValue)
+	if err != nil {
+		return pr.Value{}, fmt.Errorf("%s: %w", md.Name(), err)
+	}
+	var rmsg pr.Message
+	mt, err := protoregistry.GlobalTypes.FindMessageByName(md.FullName())
+	if err == nil {
+		rmsg = mt.New()
+	} else {
+		rmsg = dynamicpb.NewMessage(md)
+	}
+	rmsg.Set(valueFD, value)
+	return pr.ValueOfMessage(rmsg), nil
+}
+
+// wrapperToLua returns the scalar wrapped in the given wrapper message,
+// or nil if the wrapper is not set.
+func wrapperToLua(opts *Options, rmsg pr.Message) rt.Value {
+	if !rmsg.IsValid() {
+		return rt.NilValue
+	}
+	return protoFieldToLua(
+		opts, rmsg, rmsg.Descriptor().Fields().ByName("value"), true)
+}